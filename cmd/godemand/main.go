@@ -11,8 +11,8 @@ import (
 
 	"contrib.go.opencensus.io/exporter/stackdriver"
 	goredis "github.com/go-redis/redis"
+	"github.com/rueian/godemand-example/service"
 	"github.com/rueian/godemand/api"
-	"github.com/rueian/godemand/config"
 	"github.com/rueian/godemand/metrics"
 	"github.com/rueian/godemand/plugin"
 	"github.com/rueian/godemand/redis"
@@ -20,7 +20,7 @@ import (
 )
 
 func main() {
-	cfg, err := config.LoadConfig(os.Getenv("CONFIG_PATH"))
+	cfg, err := service.LoadConfig(os.Getenv("CONFIG_PATH"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -53,11 +53,13 @@ func main() {
 		log.Fatal(err)
 	}
 
-	service := &api.Service{
-		Pool:      pool,
-		Locker:    locker,
-		Launchpad: launchpad,
-		Config:    cfg,
+	svc := &service.Service{
+		Service: &api.Service{
+			Pool:      pool,
+			Locker:    locker,
+			Launchpad: launchpad,
+			Config:    cfg,
+		},
 	}
 
 	syncer := &syncer.ResourceSyncer{
@@ -71,11 +73,11 @@ func main() {
 		for {
 			time.Sleep(5 * time.Second)
 
-			cfg, err := config.LoadConfig(os.Getenv("CONFIG_PATH"))
+			cfg, err := service.LoadConfig(os.Getenv("CONFIG_PATH"))
 			if err != nil {
 				continue
 			}
-			service.Config = cfg
+			svc.Config = cfg
 			syncer.Config = cfg
 			if err = launchpad.SetLaunchers(cfg.GetPluginCmd()); err != nil {
 				continue
@@ -91,15 +93,23 @@ func main() {
 		syncer.Run(ctx, 1)
 	}()
 
+	go func() {
+		svc.Scale(ctx, 10*time.Second)
+	}()
+
+	mux := api.NewHTTPMux(svc)
+	mux.HandleFunc("/Preempted", svc.HandlePreempted)
+
 	server := &http.Server{
 		Addr:    ":8080",
-		Handler: api.NewHTTPMux(service),
+		Handler: mux,
 	}
 
 	go func() {
 		<-sigs
 		cancel()
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 		server.Shutdown(ctx)
 	}()
 
@@ -3,8 +3,13 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"cloud.google.com/go/compute/metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/rueian/godemand-example/pgplugin"
 	"github.com/rueian/godemand-example/tools"
 	"github.com/rueian/godemand/plugin"
@@ -24,20 +29,103 @@ func StartParam(params map[string]interface{}, snapshot string) pgplugin.Startup
 }
 
 func CallParam(params map[string]interface{}) pgplugin.CallParam {
-	projectID, _ := metadata.ProjectID()
+	var projectID string
+	if metadata.OnGCE() {
+		projectID, _ = metadata.ProjectID()
+	}
 
 	return pgplugin.CallParam{
-		MaxLoads:          tools.GetInt(params, "MaxLoads", 10),
-		MaxServSecond:     tools.GetInt(params, "MaxServSecond", 10800),
-		MaxLifeSecond:     tools.GetInt(params, "MaxLifeSecond", 1800),
-		MaxIdleSecond:     tools.GetInt(params, "MaxIdleSecond", 300),
-		MaxSyncWindow:     tools.GetInt(params, "MaxSyncWindow", 30),
-		SnapshotPrefix:    tools.GetStr(params, "SnapshotPrefix", "pg11"),
-		SnapshotProjectID: tools.GetStr(params, "SnapshotProjectID", projectID),
-		InstanceProjectID: tools.GetStr(params, "InstanceProjectID", projectID),
-		InstanceZone:      tools.GetStr(params, "InstanceZone", "us-west1-a"),
-		InstanceMachine:   tools.GetStr(params, "InstanceMachine", "f1-micro"),
+		Provider:             tools.GetStr(params, "Provider", "gcp"),
+		RoutingPolicy:        tools.GetStr(params, "RoutingPolicy", pgplugin.RoutingNewestFirst),
+		MaxLoads:             tools.GetInt(params, "MaxLoads", 10),
+		MinInstances:         tools.GetInt(params, "MinInstances", 0),
+		MaxInstances:         tools.GetInt(params, "MaxInstances", 0),
+		WarmInstances:        tools.GetInt(params, "WarmInstances", 0),
+		WarmState:            tools.GetStr(params, "WarmState", pgplugin.WarmTerminated),
+		WarmSchedule:         tools.GetStr(params, "WarmSchedule", ""),
+		TimeZone:             tools.GetStr(params, "TimeZone", "UTC"),
+		MaxServSecond:        tools.GetInt(params, "MaxServSecond", 10800),
+		DrainSecond:          tools.GetInt(params, "DrainSecond", 300),
+		MaxLifeSecond:        tools.GetInt(params, "MaxLifeSecond", 1800),
+		MaxIdleSecond:        tools.GetInt(params, "MaxIdleSecond", 300),
+		MaxSyncWindow:        tools.GetInt(params, "MaxSyncWindow", 30),
+		SnapshotPrefix:       tools.GetStr(params, "SnapshotPrefix", "pg11"),
+		SnapshotProjectID:    tools.GetStr(params, "SnapshotProjectID", projectID),
+		InstanceProjectID:    tools.GetStr(params, "InstanceProjectID", projectID),
+		InstanceZone:         tools.GetStr(params, "InstanceZone", "us-west1-a"),
+		InstanceMachine:      tools.GetStr(params, "InstanceMachine", "f1-micro"),
+		InstanceCPUs:         tools.GetInt(params, "InstanceCPUs", 0),
+		InstanceMemoryMB:     tools.GetInt(params, "InstanceMemoryMB", 0),
+		Provisioning:         tools.GetStr(params, "Provisioning", pgplugin.ProvisioningPreemptible),
+		DiskType:             tools.GetStr(params, "DiskType", ""),
+		DiskSizeGb:           int64(tools.GetInt(params, "DiskSizeGb", 0)),
+		Network:              tools.GetStr(params, "Network", "default"),
+		Subnetwork:           tools.GetStr(params, "Subnetwork", ""),
+		NoExternalIP:         tools.GetBool(params, "NoExternalIP", false),
+		ServiceAccount:       tools.GetStr(params, "ServiceAccount", ""),
+		ServiceAccountScopes: tools.GetStrs(params, "ServiceAccountScopes"),
+		NetworkTags:          tools.GetStrs(params, "NetworkTags"),
+		Labels:               tools.GetStrMap(params, "Labels"),
+		FallbackZones:        tools.GetStrs(params, "FallbackZones"),
+		FallbackMachines:     tools.GetStrs(params, "FallbackMachines"),
+		NotifyAddr:           tools.GetStr(params, "NotifyAddr", ""),
+		MonthlyBudget:        tools.GetFloat(params, "MonthlyBudget", 0),
+		InstanceHourPrices:   InstanceHourPrices(params),
+		DiskGbHourPrices:     DiskGbHourPrices(params),
+		Schedules:            Schedules(params),
+	}
+}
+
+// DefaultInstanceHourPrices are the hourly prices of preemptible machine types in us-west1.
+var DefaultInstanceHourPrices = map[string]float64{
+	"f1-micro":      0.0035,
+	"g1-small":      0.007,
+	"n1-standard-1": 0.01,
+	"n1-standard-2": 0.02,
+	"n1-standard-4": 0.04,
+	"n1-standard-8": 0.08,
+}
+
+func InstanceHourPrices(params map[string]interface{}) map[string]float64 {
+	prices := make(map[string]float64, len(DefaultInstanceHourPrices))
+	for k, v := range DefaultInstanceHourPrices {
+		prices[k] = v
+	}
+	for k, v := range tools.GetFloats(params, "InstanceHourPrices") {
+		prices[k] = v
+	}
+	return prices
+}
+
+// DefaultDiskGbHourPrices are the hourly prices per GB of disk types in us-west1.
+var DefaultDiskGbHourPrices = map[string]float64{
+	"pd-standard": 0.000055,
+	"pd-balanced": 0.000137,
+	"pd-ssd":      0.000233,
+}
+
+func DiskGbHourPrices(params map[string]interface{}) map[string]float64 {
+	prices := make(map[string]float64, len(DefaultDiskGbHourPrices))
+	for k, v := range DefaultDiskGbHourPrices {
+		prices[k] = v
 	}
+	for k, v := range tools.GetFloats(params, "DiskGbHourPrices") {
+		prices[k] = v
+	}
+	return prices
+}
+
+func Schedules(params map[string]interface{}) (schedules []pgplugin.Schedule) {
+	for _, m := range tools.GetMaps(params, "Schedules") {
+		schedules = append(schedules, pgplugin.Schedule{
+			Window:        tools.GetStr(m, "Window", ""),
+			MaxIdleSecond: tools.GetInt(m, "MaxIdleSecond", 0),
+			MaxServSecond: tools.GetInt(m, "MaxServSecond", 0),
+			MaxLifeSecond: tools.GetInt(m, "MaxLifeSecond", 0),
+			Shutdown:      tools.GetBool(m, "Shutdown", false),
+		})
+	}
+	return
 }
 
 func main() {
@@ -46,18 +134,43 @@ func main() {
 
 	ctx := context.Background()
 
-	cred, err := google.FindDefaultCredentials(ctx, compute.ComputeScope)
+	providers := map[string]pgplugin.Provider{
+		"local": tools.NewLocalService(getEnv("LOCAL_ROOT", filepath.Join(os.TempDir(), "godemand")), getEnv("LOCAL_SNAPSHOT_DIR", "snapshots"), getEnv("PG_CTL", "pg_ctl")),
+	}
+
+	if service, err := NewGCPService(ctx); err == nil {
+		providers["gcp"] = service
+	} else {
+		log.Printf("gcp provider is disabled: %s\n", err.Error())
+	}
+
+	if imageID := os.Getenv("AWS_IMAGE_ID"); imageID != "" {
+		if service, err := NewEC2Service(imageID); err == nil {
+			providers["aws"] = service
+		} else {
+			log.Printf("aws provider is disabled: %s\n", err.Error())
+		}
+	}
+
+	usage, err := pgplugin.NewUsageLedger(os.Getenv("USAGE_PATH"))
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	if addr := os.Getenv("USAGE_ADDR"); addr != "" {
+		go func() {
+			log.Printf("fail to serve usage: %s\n", http.ListenAndServe(addr, usage))
+		}()
 	}
 
-	service, err := compute.NewService(ctx, option.WithCredentials(cred))
+	audit, err := pgplugin.NewAuditSink(getEnv("AUDIT_SINKS", "stderr"))
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
 	controller := &pgplugin.Controller{
-		Service:          tools.NewComputeService(service),
+		Audit:            audit,
+		Usage:            usage,
+		Providers:        providers,
 		StartupFactory:   StartParam,
 		CallParamFactory: CallParam,
 	}
@@ -66,3 +179,38 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+func NewGCPService(ctx context.Context) (*tools.ComputeService, error) {
+	cred, err := google.FindDefaultCredentials(ctx, compute.ComputeScope)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := compute.NewService(ctx, option.WithCredentials(cred))
+	if err != nil {
+		return nil, err
+	}
+
+	return tools.NewComputeService(service), nil
+}
+
+func NewEC2Service(imageID string) (*tools.EC2Service, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	if v := os.Getenv("AWS_SECURITY_GROUP_IDS"); v != "" {
+		groups = strings.Split(v, ",")
+	}
+
+	return tools.NewEC2Service(sess, imageID, groups, os.Getenv("AWS_SUBNET_ID")), nil
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/rueian/godemand-example/pgproxy"
 )
@@ -16,18 +21,173 @@ func main() {
 		godemandHost = "http://godemand"
 	}
 
+	routingPath := os.Getenv("ROUTING_PATH")
+	if routingPath == "" {
+		routingPath = "routing.yaml"
+	}
+
+	router := &pgproxy.Router{}
+	if err := router.Load(routingPath); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go router.Watch(ctx, routingPath, 5*time.Second)
+
 	resolver := &pgproxy.GodemandResolver{
-		Host:        godemandHost,
-		DatabaseMap: pgproxy.DatabaseMap,
+		Host:   godemandHost,
+		Router: router,
+		Drains: pgproxy.NewDrainWatcher(godemandHost, 10*time.Second),
+	}
+
+	// share server connections between clients in the session or the transaction mode,
+	// the backends of md5 or scram-sha-256 authentication are only shared with the AUTH_PATH
+	if mode := os.Getenv("POOL_MODE"); mode != "" {
+		if mode != pgproxy.PoolingSession && mode != pgproxy.PoolingTransaction {
+			log.Fatalf("unknown POOL_MODE %q", mode)
+		}
+		if os.Getenv("AUTH_PATH") == "" {
+			log.Printf("POOL_MODE without AUTH_PATH only shares the backends of trust or password authentication\n")
+		}
+		size, _ := strconv.Atoi(os.Getenv("POOL_SIZE"))
+		if size <= 0 {
+			size = 20
+		}
+		idle, _ := strconv.Atoi(os.Getenv("POOL_IDLE_SECOND"))
+		if idle <= 0 {
+			idle = 60
+		}
+		resolver.Pool = pgproxy.NewServerPool(mode, size, time.Duration(idle)*time.Second)
+		if query, ok := os.LookupEnv("POOL_RESET_QUERY"); ok {
+			resolver.Pool.ResetQuery = query
+		}
+		go resolver.Pool.Reap(ctx, 10*time.Second)
+	}
+
+	// replace the lost backends of idle sessions with new resources
+	if timeout, _ := strconv.Atoi(os.Getenv("FAILOVER_TIMEOUT_SECOND")); timeout > 0 {
+		resolver.FailoverTimeout = time.Duration(timeout) * time.Second
 	}
 
-	broker := pgproxy.NewPGBroker(resolver)
+	// re-encrypt the connections to backends
+	switch mode := os.Getenv("BACKEND_SSL_MODE"); mode {
+	case "", "disable":
+	case "require":
+		resolver.BackendTLS = &tls.Config{InsecureSkipVerify: true}
+	case "verify-full":
+		resolver.BackendTLS = &tls.Config{}
+		if path := os.Getenv("BACKEND_SSL_ROOT_CERT"); path != "" {
+			roots, err := pgproxy.LoadCertPool(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			resolver.BackendTLS.RootCAs = roots
+		}
+	default:
+		log.Fatalf("unknown BACKEND_SSL_MODE %q", mode)
+	}
+	if resolver.Pool != nil {
+		resolver.Pool.BackendTLS = resolver.BackendTLS
+	}
+
+	// log queries in full by default, or only their fingerprints, redacted, or not at all
+	logMode := os.Getenv("QUERY_LOG_MODE")
+	if logMode == "" {
+		logMode = pgproxy.QueryLogFull
+	}
+	sampleRate := 1.0
+	if rate := os.Getenv("QUERY_LOG_SAMPLE_RATE"); rate != "" {
+		var err error
+		if sampleRate, err = strconv.ParseFloat(rate, 64); err != nil {
+			log.Fatal(err)
+		}
+	}
+	queryLog, err := pgproxy.NewQueryLogger(logMode, sampleRate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := queryLog.SetOverrides(os.Getenv("QUERY_LOG_DATABASES")); err != nil {
+		log.Fatal(err)
+	}
+
+	// block queries by the firewall rules
+	if firewallPath := os.Getenv("FIREWALL_PATH"); firewallPath != "" {
+		firewall := &pgproxy.Firewall{QueryLog: queryLog}
+		if err := firewall.Load(firewallPath); err != nil {
+			log.Fatal(err)
+		}
+		go firewall.Watch(ctx, firewallPath, 5*time.Second)
+		resolver.Firewall = firewall
+	}
+
+	// queue clients requesting the same pool, so that a burst against a cold pool does not hammer godemand
+	if concurrency, _ := strconv.Atoi(os.Getenv("ADMISSION_CONCURRENCY")); concurrency > 0 {
+		waiters, _ := strconv.Atoi(os.Getenv("ADMISSION_MAX_WAITERS"))
+		wait, _ := strconv.Atoi(os.Getenv("ADMISSION_MAX_WAIT_SECOND"))
+		resolver.Admission = pgproxy.NewAdmission(concurrency, waiters, time.Duration(wait)*time.Second)
+	}
+
+	// collect query stats, which are served over http with the admission queues and logged if slower than the threshold
+	var stats *pgproxy.QueryStats
+	if addr := os.Getenv("STATS_ADDR"); addr != "" {
+		slow, _ := strconv.Atoi(os.Getenv("SLOW_QUERY_MS"))
+		stats = pgproxy.NewQueryStats(time.Duration(slow) * time.Millisecond)
+		stats.QueryLog = queryLog
+
+		mux := http.NewServeMux()
+		mux.Handle("/", stats)
+		if resolver.Admission != nil {
+			mux.Handle("/admission", resolver.Admission)
+		}
+		go func() {
+			log.Printf("fail to serve query stats: %s\n", http.ListenAndServe(addr, mux))
+		}()
+	}
+
+	broker := pgproxy.NewPGBroker(resolver, pgproxy.BrokerOptions{Stats: stats, QueryLog: queryLog})
 
 	ln, err := net.Listen("tcp", ":5432")
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// terminate TLS of clients with the certificate reloaded on file changes
+	if certPath := os.Getenv("TLS_CERT_PATH"); certPath != "" {
+		certs, err := pgproxy.NewCertReloader(certPath, os.Getenv("TLS_KEY_PATH"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go certs.Watch(ctx, 30*time.Second)
+
+		config := &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+		if path := os.Getenv("TLS_CLIENT_CA_PATH"); path != "" {
+			if config.ClientCAs, err = pgproxy.LoadCertPool(path); err != nil {
+				log.Fatal(err)
+			}
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		ln = pgproxy.NewTLSListener(ln, config, os.Getenv("TLS_REQUIRED") == "true")
+	}
+
+	// authenticate clients by the proxy before requesting resources for them
+	if authPath := os.Getenv("AUTH_PATH"); authPath != "" {
+		resolver.Auth = pgproxy.NewAuthenticator()
+		if err := resolver.Auth.Load(authPath); err != nil {
+			log.Fatal(err)
+		}
+		go resolver.Auth.Watch(ctx, authPath, 5*time.Second)
+		ln = resolver.Auth.Listener(ln)
+	}
+
+	// notice clients the boot progress of their backends, and answer the failures with retry hints
+	bootTimeout, _ := strconv.Atoi(os.Getenv("BOOT_TIMEOUT_SECOND"))
+	resolver.Boot = pgproxy.NewBootNotifier(os.Getenv("BOOT_NOTICES") == "true", time.Duration(bootTimeout)*time.Second)
+	if retry, _ := strconv.Atoi(os.Getenv("BOOT_RETRY_SECOND")); retry > 0 {
+		resolver.Boot.RetryAfter = time.Duration(retry) * time.Second
+	}
+	ln = resolver.Boot.Listener(ln)
+
 	go broker.Serve(ln)
 
 	sigs := make(chan os.Signal, 1)
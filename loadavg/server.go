@@ -4,10 +4,19 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
 )
 
 func main() {
+	if metadata.OnGCE() {
+		go watchPreemption()
+	}
+
 	ln, err := net.Listen("tcp", ":8743")
 	if err != nil {
 		log.Fatal(err)
@@ -34,3 +43,47 @@ func main() {
 		}()
 	}
 }
+
+// watchPreemption notifies godemand when the instance is preempted, so that the resource is moved out of rotation
+// and replaced before the instance stops. The godemand address and the pool are given by the instance attributes.
+func watchPreemption() {
+	addr, err := metadata.InstanceAttributeValue("godemand-addr")
+	if err != nil || addr == "" {
+		log.Println("preemption notice is disabled without the godemand-addr attribute")
+		return
+	}
+	pool, err := metadata.InstanceAttributeValue("godemand-pool")
+	if err != nil {
+		log.Println("fail to get the godemand-pool attribute", err.Error())
+		return
+	}
+	name, err := metadata.InstanceName()
+	if err != nil {
+		log.Println("fail to get the instance name", err.Error())
+		return
+	}
+
+	err = metadata.Subscribe("instance/preempted", func(v string, ok bool) error {
+		if v != "TRUE" {
+			return nil
+		}
+		log.Println("instance is preempted, notify godemand")
+		for i := 0; i < 5; i++ {
+			resp, err := http.PostForm(addr+"/Preempted", url.Values{"poolID": {pool}, "id": {name}})
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					return nil
+				}
+				log.Println("fail to notify godemand of the preemption, status", resp.StatusCode)
+			} else {
+				log.Println("fail to notify godemand of the preemption", err.Error())
+			}
+			time.Sleep(time.Second)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("fail to watch the preemption", err.Error())
+	}
+}
@@ -0,0 +1,156 @@
+package pgplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rueian/godemand/types"
+)
+
+// AuditEvent is a state transition of a resource.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	ResourceID string    `json:"resource_id"`
+	PoolID     string    `json:"pool_id"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Reason     string    `json:"reason"`
+	Status     string    `json:"status,omitempty"`
+	// Duration is the seconds the resource stayed in the previous state
+	Duration float64 `json:"duration"`
+}
+
+type AuditSink interface {
+	Emit(event AuditEvent) error
+}
+
+// NewAuditSink makes sinks of the specs separated by ",": "stderr", "stdout", "file:<path>" or a webhook url.
+// The stdout of the plugin is the handshake channel with godemand, so the events should go to stderr instead.
+func NewAuditSink(specs string) (AuditSink, error) {
+	var sinks MultiSink
+	for _, spec := range strings.Split(specs, ",") {
+		switch spec = strings.TrimSpace(spec); {
+		case spec == "":
+		case spec == "stderr":
+			sinks = append(sinks, NewWriterSink(os.Stderr))
+		case spec == "stdout":
+			sinks = append(sinks, NewWriterSink(os.Stdout))
+		case strings.HasPrefix(spec, "file:"):
+			f, err := os.OpenFile(strings.TrimPrefix(spec, "file:"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, NewWriterSink(f))
+		case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+			sinks = append(sinks, NewWebhookSink(spec, 1000))
+		default:
+			return nil, fmt.Errorf("unknown audit sink %q", spec)
+		}
+	}
+	return sinks, nil
+}
+
+type MultiSink []AuditSink
+
+func (s MultiSink) Emit(event AuditEvent) (err error) {
+	for _, sink := range s {
+		if e := sink.Emit(event); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// WriterSink writes events as json lines.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *WriterSink) Emit(event AuditEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// WebhookSink posts events as json to the URL in background, events are dropped if the queue is full.
+func NewWebhookSink(url string, size int) *WebhookSink {
+	s := &WebhookSink{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan []byte, size),
+	}
+	go s.run()
+	return s
+}
+
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+
+	queue chan []byte
+}
+
+func (s *WebhookSink) Emit(event AuditEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.queue <- b:
+		return nil
+	default:
+		return fmt.Errorf("audit webhook queue is full, drop event of %q", event.ResourceID)
+	}
+}
+
+func (s *WebhookSink) run() {
+	for b := range s.queue {
+		for i := 0; i < 3; i++ {
+			resp, err := s.Client.Post(s.URL, "application/json", bytes.NewReader(b))
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode < 300 {
+					break
+				}
+				err = fmt.Errorf("http status %d", resp.StatusCode)
+			}
+			log.Printf("fail to post audit event to webhook: %s\n", err.Error())
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (c *Controller) audit(prev, next types.Resource, ev AuditEvent) {
+	if c.Audit == nil || (prev.ID != "" && prev.State == next.State) {
+		return
+	}
+	ev.Time = time.Now()
+	ev.ResourceID = next.ID
+	ev.PoolID = next.PoolID
+	ev.To = next.State.String()
+	if prev.ID != "" {
+		ev.From = prev.State.String()
+		ev.Duration = time.Since(prev.StateChange).Seconds()
+	}
+	if err := c.Audit.Emit(ev); err != nil {
+		log.Printf("fail to emit audit event of %q: %s\n", next.ID, err.Error())
+	}
+}
@@ -0,0 +1,246 @@
+package pgplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rueian/godemand/types"
+)
+
+// Usage is the accumulated instance-hours, disk-hours and their cost of a pool.
+type Usage struct {
+	InstanceHours float64
+	DiskHours     float64
+	Cost          float64
+}
+
+func (u *Usage) Add(o Usage) {
+	u.InstanceHours += o.InstanceHours
+	u.DiskHours += o.DiskHours
+	u.Cost += o.Cost
+}
+
+// usageEntry is the Usage of a resource in a month. The Usage of the Last interval is replaced instead of added
+// if the interval is accrued again, like when the resource fails to be saved after the accrual.
+type usageEntry struct {
+	Usage
+	Last      string
+	LastUsage Usage
+}
+
+// UsageLedger keeps the monthly Usage of the resources of pools, including the deleted ones which are no longer in the pools.
+// It is saved to the Path as json if the Path is not empty.
+func NewUsageLedger(path string) (*UsageLedger, error) {
+	l := &UsageLedger{Path: path, months: map[string]map[string]map[string]*usageEntry{}}
+	if path == "" {
+		return l, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &l.months); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+type UsageLedger struct {
+	Path string
+
+	mu     sync.Mutex
+	months map[string]map[string]map[string]*usageEntry
+}
+
+// Add records the Usage of the resource in the interval starting from the from.
+func (l *UsageLedger) Add(month, poolID, resourceID, from string, u Usage) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	pools, ok := l.months[month]
+	if !ok {
+		pools = map[string]map[string]*usageEntry{}
+		l.months[month] = pools
+	}
+	resources, ok := pools[poolID]
+	if !ok {
+		resources = map[string]*usageEntry{}
+		pools[poolID] = resources
+	}
+	e, ok := resources[resourceID]
+	if !ok {
+		e = &usageEntry{}
+		resources[resourceID] = e
+	}
+	if e.Last == from {
+		e.Add(Usage{InstanceHours: -e.LastUsage.InstanceHours, DiskHours: -e.LastUsage.DiskHours, Cost: -e.LastUsage.Cost})
+	}
+	e.Add(u)
+	e.Last, e.LastUsage = from, u
+
+	if l.Path == "" {
+		return nil
+	}
+	b, err := json.Marshal(l.months)
+	if err != nil {
+		return err
+	}
+	// the ledger is replaced by rename, so that it is never left partially written
+	tmp := l.Path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.Path)
+}
+
+func (l *UsageLedger) Get(month, poolID string) Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var u Usage
+	for _, e := range l.months[month][poolID] {
+		u.Add(e.Usage)
+	}
+	return u
+}
+
+// ServeHTTP responds the usages of pools in the month of the query, or the current month by default.
+func (l *UsageLedger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = Month(time.Now())
+	}
+
+	l.mu.Lock()
+	pools := make(map[string]*Usage, len(l.months[month]))
+	for poolID, resources := range l.months[month] {
+		u := &Usage{}
+		for _, e := range resources {
+			u.Add(e.Usage)
+		}
+		pools[poolID] = u
+	}
+	l.mu.Unlock()
+
+	b, err := json.Marshal(pools)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func Month(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// AccrueInterval is the interval of the accruals of the resources without state changes.
+const AccrueInterval = 10 * time.Minute
+
+// Accrue records the usage of the resource since its last accrual into its Meta and the ledger, on the state changes
+// or every AccrueInterval. The instance is billed while it is running, and the disk is billed by its size and type
+// since the instance is created.
+func (c *Controller) Accrue(prev, next types.Resource, cp CallParam) types.Resource {
+	now := time.Now()
+	from := metaStr(prev.Meta, "usage_at")
+	at, err := time.Parse(time.RFC3339Nano, from)
+	if err == nil && prev.State == next.State && now.Sub(at) < AccrueInterval {
+		return next
+	}
+
+	// the machine is set by the instance creation, which may be one of the FallbackMachines
+	machine := metaStr(next.Meta, "machine")
+	if machine == "" {
+		machine = metaStr(prev.Meta, "machine")
+	}
+	if machine == "" {
+		machine = cp.machine()
+	}
+
+	var u Usage
+	if err == nil {
+		hours := now.Sub(at).Hours()
+		switch prev.State {
+		case types.ResourceBooting, types.ResourceServing, types.ResourceTerminating:
+			u.InstanceHours = hours
+			u.DiskHours = hours
+		case types.ResourceTerminated, types.ResourceDeleting:
+			u.DiskHours = hours
+		}
+		price, ok := cp.InstanceHourPrices[machine]
+		if !ok && u.InstanceHours > 0 {
+			log.Printf("machine %q of %q has no price in InstanceHourPrices, its cost is not counted\n", machine, prev.ID)
+		}
+		gb := metaFloat(prev.Meta, "disk_gb")
+		if gb == 0 {
+			gb = metaFloat(next.Meta, "disk_gb")
+		}
+		if gb == 0 {
+			gb = float64(cp.DiskSizeGb)
+		}
+		u.Cost = u.InstanceHours*price + u.DiskHours*gb*cp.DiskGbHourPrices[cp.diskType()]
+	}
+
+	if next.Meta == nil {
+		next.Meta = types.Meta{}
+	}
+	next.Meta["machine"] = machine
+	next.Meta["usage_at"] = now.Format(time.RFC3339Nano)
+	next.Meta["instance_hours"] = metaFloat(prev.Meta, "instance_hours") + u.InstanceHours
+	next.Meta["disk_hours"] = metaFloat(prev.Meta, "disk_hours") + u.DiskHours
+	next.Meta["cost"] = metaFloat(prev.Meta, "cost") + u.Cost
+
+	if c.Usage != nil && u != (Usage{}) {
+		if err := c.Usage.Add(Month(now), prev.PoolID, prev.ID, from, u); err != nil {
+			log.Printf("fail to save usage of pool %q: %s\n", prev.PoolID, err.Error())
+		}
+	}
+	return next
+}
+
+// checkPrices makes sure the cost of every machine type and the disk type can be counted for the MonthlyBudget.
+func (cp CallParam) checkPrices() error {
+	if cp.MonthlyBudget <= 0 {
+		return nil
+	}
+	for _, machine := range cp.machines() {
+		if _, ok := cp.InstanceHourPrices[machine]; !ok {
+			return fmt.Errorf("machine %q has no price in InstanceHourPrices for the MonthlyBudget", machine)
+		}
+	}
+	if _, ok := cp.DiskGbHourPrices[cp.diskType()]; !ok {
+		return fmt.Errorf("disk type %q has no price in DiskGbHourPrices for the MonthlyBudget", cp.diskType())
+	}
+	return nil
+}
+
+// CheckBudget rejects new resources of the pool once its cost of this month exceeds the MonthlyBudget.
+func (c *Controller) CheckBudget(poolID string, cp CallParam) error {
+	if c.Usage == nil || cp.MonthlyBudget <= 0 {
+		return nil
+	}
+	if u := c.Usage.Get(Month(time.Now()), poolID); u.Cost >= cp.MonthlyBudget {
+		return fmt.Errorf("pool %q exceeded its monthly budget %.2f with cost %.2f: %w", poolID, cp.MonthlyBudget, u.Cost, RejectedErr)
+	}
+	return nil
+}
+
+func metaStr(meta types.Meta, k string) string {
+	v, _ := meta[k].(string)
+	return v
+}
+
+func metaFloat(meta types.Meta, k string) float64 {
+	v, _ := meta[k].(float64)
+	return v
+}
@@ -2,6 +2,7 @@ package pgplugin
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"sort"
@@ -11,21 +12,51 @@ import (
 	"time"
 
 	"github.com/rueian/godemand-example/tools"
+	"github.com/rueian/godemand/plugin"
 	"github.com/rueian/godemand/types"
 	"google.golang.org/api/compute/v1"
 )
 
 type CallParam struct {
-	MaxLoads          int
-	MaxLifeSecond     int
-	MaxServSecond     int
-	MaxIdleSecond     int
-	MaxSyncWindow     int
-	SnapshotPrefix    string
-	SnapshotProjectID string
-	InstanceProjectID string
-	InstanceZone      string
-	InstanceMachine   string
+	Provider             string
+	RoutingPolicy        string
+	MaxLoads             int
+	MinInstances         int
+	MaxInstances         int
+	WarmInstances        int
+	WarmState            string
+	WarmSchedule         string
+	TimeZone             string
+	MaxLifeSecond        int
+	MaxServSecond        int
+	DrainSecond          int
+	MaxIdleSecond        int
+	MaxSyncWindow        int
+	SnapshotPrefix       string
+	SnapshotProjectID    string
+	InstanceProjectID    string
+	InstanceZone         string
+	InstanceMachine      string
+	InstanceCPUs         int
+	InstanceMemoryMB     int
+	Provisioning         string
+	DiskType             string
+	DiskSizeGb           int64
+	Network              string
+	Subnetwork           string
+	NoExternalIP         bool
+	ServiceAccount       string
+	ServiceAccountScopes []string
+	NetworkTags          []string
+	Labels               map[string]string
+	FallbackZones        []string
+	FallbackMachines     []string
+	NotifyAddr           string
+	MonthlyBudget        float64
+	InstanceHourPrices   map[string]float64
+	DiskGbHourPrices     map[string]float64
+	Schedules            []Schedule
+	Shutdown             bool
 }
 
 type SnapshotCache struct {
@@ -35,10 +66,34 @@ type SnapshotCache struct {
 }
 
 type Controller struct {
-	Service          *tools.ComputeService
+	Service          Provider
+	Providers        map[string]Provider
 	StartupFactory   func(params map[string]interface{}, snapshot string) StartupParam
 	CallParamFactory func(params map[string]interface{}) CallParam
+	Usage            *UsageLedger
+	Audit            AuditSink
 	LatestSnapshots  sync.Map
+	RoundRobin       sync.Map
+}
+
+var ScaleSatisfiedErr = errors.New("no instance to scale")
+var RejectedErr = errors.New("request rejected")
+
+// ErrCodes are the codes prefixing the known errors of FindResource as "[code] ", the errors are flattened into
+// strings by the rpc, so the godemand service restores them by the codes.
+var ErrCodes = map[string]error{
+	"acquire-later":   plugin.AcquireLaterErr,
+	"scale-satisfied": ScaleSatisfiedErr,
+	"rejected":        RejectedErr,
+}
+
+func codeErr(err error) error {
+	for code, known := range ErrCodes {
+		if errors.Is(err, known) {
+			return fmt.Errorf("[%s] %w", code, err)
+		}
+	}
+	return err
 }
 
 var StateOrder = map[types.ResourceState]int{
@@ -53,8 +108,18 @@ var StateOrder = map[types.ResourceState]int{
 	types.ResourceError:       99,
 }
 
-func (c *Controller) GetLatestSnapshot(snapshotProjectID, snapshotPrefix string) (*compute.Snapshot, error) {
-	k := snapshotProjectID + snapshotPrefix
+func (c *Controller) GetService(cp CallParam) (Provider, error) {
+	if cp.Provider == "" {
+		return c.Service, nil
+	}
+	if service, ok := c.Providers[cp.Provider]; ok {
+		return service, nil
+	}
+	return nil, fmt.Errorf("provider %q is not available", cp.Provider)
+}
+
+func (c *Controller) GetLatestSnapshot(service SnapshotProvider, cp CallParam) (*compute.Snapshot, error) {
+	k := cp.Provider + cp.SnapshotProjectID + cp.SnapshotPrefix
 
 	cache, _ := c.LatestSnapshots.LoadOrStore(k, &SnapshotCache{})
 	if cache, ok := cache.(*SnapshotCache); ok {
@@ -69,7 +134,7 @@ func (c *Controller) GetLatestSnapshot(snapshotProjectID, snapshotPrefix string)
 			return cache.Snapshot, nil
 		}
 
-		snapshot, err := c.Service.FindLatestSnapshot(snapshotProjectID, snapshotPrefix)
+		snapshot, err := service.FindLatestSnapshot(cp.SnapshotProjectID, cp.SnapshotPrefix)
 		if err != nil {
 			return nil, err
 		}
@@ -82,16 +147,56 @@ func (c *Controller) GetLatestSnapshot(snapshotProjectID, snapshotPrefix string)
 }
 
 func (c *Controller) FindResource(pool types.ResourcePool, params map[string]interface{}) (types.Resource, error) {
-	cp := c.CallParamFactory(params)
+	res, err := c.findResource(pool, params)
+	if err != nil {
+		return res, codeErr(err)
+	}
+	ev := AuditEvent{Reason: "client-requested"}
+	if tools.GetBool(params, "ClientScale", false) {
+		ev.Reason = "scale-out"
+	} else {
+		res = taken(res)
+	}
+	res.PoolID = pool.ID
+	c.audit(pool.Resources[res.ID], res, ev)
+	return res, nil
+}
+
+func (c *Controller) findResource(pool types.ResourcePool, params map[string]interface{}) (types.Resource, error) {
+	cp, err := c.CallParamFactory(params).Scheduled(time.Now())
+	if err != nil {
+		return types.Resource{}, err
+	}
+
+	service, err := c.GetService(cp)
+	if err != nil {
+		log.Printf("fail to get provider of pool: %s\n", err.Error())
+		return types.Resource{}, err
+	}
 
 	var resources []types.Resource
 
 	for _, res := range pool.Resources {
+		if _, draining := drainingSince(res); draining {
+			// the draining resources are replaced by new ones
+			continue
+		}
 		if StateOrder[res.State] < 99 {
 			resources = append(resources, res)
 		}
 	}
 
+	if cp.Shutdown {
+		if tools.GetBool(params, "ClientScale", false) {
+			return types.Resource{}, fmt.Errorf("pool %q is shut down by schedule: %w", pool.ID, ScaleSatisfiedErr)
+		}
+		return types.Resource{}, fmt.Errorf("pool %q is shut down by schedule: %w", pool.ID, RejectedErr)
+	}
+
+	if tools.GetBool(params, "ClientScale", false) {
+		return c.Scale(pool, resources, cp)
+	}
+
 	sort.Slice(resources, func(i, j int) bool {
 		if resources[i].State == resources[j].State {
 			if resources[i].State == types.ResourceServing {
@@ -103,19 +208,46 @@ func (c *Controller) FindResource(pool types.ResourcePool, params map[string]int
 		return StateOrder[resources[i].State] < StateOrder[resources[j].State]
 	})
 
+	if cp.RoutingPolicy == "" {
+		cp.RoutingPolicy = RoutingNewestFirst
+	}
+	policy, ok := RoutingPolicies[cp.RoutingPolicy]
+	if !ok {
+		return types.Resource{}, fmt.Errorf("unknown routing policy %q", cp.RoutingPolicy)
+	}
+
+	var candidates []Candidate
+	var overloaded bool
+
 	for _, res := range resources {
 		if time.Since(res.CreatedAt) > time.Duration(cp.MaxLifeSecond)*time.Second {
-			snapshot, _ := c.GetLatestSnapshot(cp.SnapshotProjectID, cp.SnapshotPrefix)
+			snapshot, _ := c.GetLatestSnapshot(service, cp)
 			if link, ok := res.Meta["snapshot"].(string); ok && snapshot != nil && link != snapshot.SelfLink {
 				continue
 			}
 		}
 
-		if loadAddr, ok := res.Meta["load"].(string); ok && res.State == types.ResourceServing {
-			m1, m5, m15, err := tools.GetLoad(loadAddr)
-			if err == nil && m1 > m5 && m1 > m15 && m1 > float64(cp.MaxLoads) {
-				continue
+		if res.State == types.ResourceServing {
+			candidate := Candidate{Resource: res}
+			if loadAddr, ok := res.Meta["load"].(string); ok {
+				m1, m5, m15, err := service.GetLoad(loadAddr)
+				if err == nil && m1 > m5 && m1 > m15 && m1 > float64(cp.MaxLoads) {
+					overloaded = true
+					continue
+				}
+				candidate.Load = m1
+			}
+			if cp.RoutingPolicy == RoutingNewestFirst {
+				return res, nil
 			}
+			candidates = append(candidates, candidate)
+			continue
+		}
+
+		// resources are sorted by state, there is no more serving one.
+		// a new instance is created if all serving ones are overloaded, instead of waiting for the others to boot.
+		if len(candidates) > 0 || overloaded {
+			break
 		}
 
 		if res.State == types.ResourceTerminated || res.State == types.ResourceTerminating {
@@ -124,21 +256,87 @@ func (c *Controller) FindResource(pool types.ResourcePool, params map[string]int
 		return res, nil
 	}
 
+	if len(candidates) > 0 {
+		return policy(c, pool.ID, candidates, params), nil
+	}
+
+	if cp.MaxInstances > 0 && len(resources) >= cp.MaxInstances {
+		return types.Resource{}, fmt.Errorf("pool %q reached MaxInstances %d: %w", pool.ID, cp.MaxInstances, plugin.AcquireLaterErr)
+	}
+
+	if err := cp.Validate(); err != nil {
+		return types.Resource{}, fmt.Errorf("pool %q has invalid instance params: %v: %w", pool.ID, err, RejectedErr)
+	}
+
+	if err := c.CheckBudget(pool.ID, cp); err != nil {
+		return types.Resource{}, err
+	}
+
+	return newResource(pool, cp), nil
+}
+
+func newResource(pool types.ResourcePool, cp CallParam) types.Resource {
 	return types.Resource{
 		ID:        "godemand-" + cp.SnapshotPrefix + "-" + time.Now().Format("20060102150405"),
 		PoolID:    pool.ID,
 		State:     types.ResourcePending,
 		CreatedAt: time.Now(),
-	}, nil
+	}
 }
 
 func (c *Controller) SyncResource(resource types.Resource, params map[string]interface{}) (types.Resource, error) {
-	cp := c.CallParamFactory(params)
+	var ev AuditEvent
+	next, err := c.syncResource(resource, params, &ev)
+	if err != nil {
+		return next, err
+	}
+	c.audit(resource, next, ev)
+	return c.Accrue(resource, next, c.CallParamFactory(params)), nil
+}
+
+func (c *Controller) syncResource(resource types.Resource, params map[string]interface{}, ev *AuditEvent) (types.Resource, error) {
+	cp, err := c.CallParamFactory(params).Scheduled(time.Now())
+	if err != nil {
+		log.Printf("fail to apply schedules of pool: %s\n", err.Error())
+		return types.Resource{}, err
+	}
+
+	service, err := c.GetService(cp)
+	if err != nil {
+		log.Printf("fail to get provider of pool: %s\n", err.Error())
+		return types.Resource{}, err
+	}
+
+	zones := cp.zones()
+	cp = cp.placed(resource)
+
+	if cp.Shutdown {
+		switch resource.State {
+		case types.ResourcePending:
+			// the pending resource boots after the shutdown
+			return resource, nil
+		case types.ResourceServing:
+			if !c.Drain(&resource, cp) {
+				resource.LastSynced = time.Now()
+				return resource, nil
+			}
+			fallthrough
+		case types.ResourceBooting:
+			log.Printf("instance %q is shut down by schedule, mark terminating\n", resource.ID)
+			ev.Reason = "schedule-shutdown"
+			resource.State = types.ResourceTerminating
+			delete(resource.Meta, "draining")
+			resource.LastSynced = time.Now()
+			return resource, nil
+		}
+	}
 
 	switch resource.State {
 	case types.ResourcePending:
-		found, err := c.Service.FindInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
+		found, err := service.FindInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
 		if found != nil {
+			ev.Status = found.Status
+			ev.Reason = "instance-found"
 			resource.State = types.ResourceBooting
 			resource.LastSynced = time.Now()
 			return resource, nil
@@ -148,28 +346,47 @@ func (c *Controller) SyncResource(resource types.Resource, params map[string]int
 			return types.Resource{}, err
 		}
 
+		if err := cp.Validate(); err != nil {
+			log.Printf("invalid instance params of %q, mark deleted: %s\n", resource.ID, err.Error())
+			ev.Reason = "invalid-params"
+			resource.State = types.ResourceDeleted
+			resource.LastSynced = time.Now()
+			return resource, nil
+		}
+
 		var d *compute.Disk
-		d, err = c.Service.FindDisk(cp.InstanceProjectID, cp.InstanceZone, resource.ID)
+		d, err = service.FindDisk(cp.InstanceProjectID, cp.InstanceZone, resource.ID)
 		if tools.IsStatusNotFound(err) {
-			snapshot, err := c.GetLatestSnapshot(cp.SnapshotProjectID, cp.SnapshotPrefix)
+			snapshot, err := c.GetLatestSnapshot(service, cp)
 			if err != nil {
 				log.Printf("fail to find latest snapshot of prefix %q: %s\n", cp.SnapshotPrefix, err.Error())
 				return types.Resource{}, err
 			}
 			if snapshot == nil {
 				log.Printf("no snapshot found of prefix %q, mark deleted\n", cp.SnapshotPrefix)
+				ev.Reason = "snapshot-missing"
 				resource.State = types.ResourceDeleted
 				resource.LastSynced = time.Now()
 				return resource, nil
 			}
-			err = c.Service.CreateDiskRetry(cp.InstanceProjectID, cp.InstanceZone, makeDisk(resource.ID, cp.SnapshotPrefix, snapshot.SelfLink), 5)
+			if cp.DiskSizeGb > 0 && cp.DiskSizeGb < snapshot.DiskSizeGb {
+				log.Printf("DiskSizeGb %d is smaller than the snapshot %q of %d GB, mark deleted\n", cp.DiskSizeGb, snapshot.Name, snapshot.DiskSizeGb)
+				ev.Reason = "invalid-params"
+				resource.State = types.ResourceDeleted
+				resource.LastSynced = time.Now()
+				return resource, nil
+			}
+			err = service.CreateDiskRetry(cp.InstanceProjectID, cp.InstanceZone, makeDisk(resource.ID, snapshot.SelfLink, cp), 5)
 			if err != nil {
 				log.Printf("fail to create disk of snapshot %q: %s\n", snapshot.Name, err.Error())
+				if tools.ClassifyError(err).Fallback() {
+					return c.nextZone(service, resource, zones, cp, ev)
+				}
 				return types.Resource{}, err
 			}
 		}
 		if d == nil || err != nil {
-			d, err = c.Service.FindDiskRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
+			d, err = service.FindDiskRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
 			if err != nil {
 				log.Printf("fail to find disk %q: %s\n", resource.ID, err.Error())
 				return types.Resource{}, err
@@ -182,7 +399,7 @@ func (c *Controller) SyncResource(resource types.Resource, params map[string]int
 		}
 		if d.Status == "FAILED" {
 			log.Printf("deleting the failed disk %q\n", resource.ID)
-			c.Service.DeleteDiskRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
+			service.DeleteDiskRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
 			return types.Resource{}, fmt.Errorf("disk %q status %q", d.Name, d.Status)
 		}
 
@@ -192,46 +409,79 @@ func (c *Controller) SyncResource(resource types.Resource, params map[string]int
 			return types.Resource{}, err
 		}
 
-		err = c.Service.CreateInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, makeInstance(resource.ID, cp.InstanceProjectID, cp.InstanceZone, cp.InstanceMachine, d, cp.SnapshotPrefix, params, c.StartupFactory), 5)
+		err = c.createInstance(service, &resource, d, cp, params)
 		if err != nil {
 			log.Printf("fail to create instance %q: %s\n", resource.ID, err.Error())
+			if tools.ClassifyError(err).Fallback() {
+				return c.nextZone(service, resource, zones, cp, ev)
+			}
 			return types.Resource{}, err
 		}
 
 		log.Printf("instance %q created\n", resource.ID)
-		resource.Meta = types.Meta{
-			"snapshot": d.SourceSnapshot,
+		if resource.Meta == nil {
+			resource.Meta = types.Meta{}
 		}
+		resource.Meta["snapshot"] = d.SourceSnapshot
+		if d.SizeGb > 0 {
+			resource.Meta["disk_gb"] = float64(d.SizeGb)
+		}
+		ev.Reason = "instance-created"
 		resource.State = types.ResourceBooting
 	case types.ResourceBooting:
+		if name := metaStr(resource.Meta, "operation"); name != "" {
+			if ops, ok := service.(OperationProvider); ok {
+				op, err := ops.FindOperation(cp.InstanceProjectID, cp.InstanceZone, name)
+				if err != nil {
+					log.Printf("fail to find operation %q of instance %q, try again later: %s\n", name, resource.ID, err.Error())
+					return types.Resource{}, err
+				}
+				if op.Status != "DONE" {
+					log.Printf("wait operation %q of instance %q to be done, got %q\n", name, resource.ID, op.Status)
+					return types.Resource{}, fmt.Errorf("wait operation %q of instance %q to be done, got %q", name, resource.ID, op.Status)
+				}
+				if err := tools.OperationError(op); err != nil {
+					return c.instanceFailed(service, resource, zones, cp, ev, err)
+				}
+			}
+			delete(resource.Meta, "operation")
+		}
 		// check service running
-		instance, err := c.Service.FindInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
+		instance, err := service.FindInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
 		if err != nil && tools.IsStatusNotFound(err) {
 			log.Printf("instance %q disappeared, mark deleted\n", resource.ID)
+			ev.Reason = "instance-disappeared"
 			resource.State = types.ResourceDeleted
 			break
 		}
+		if err != nil {
+			log.Printf("fail to find instance %q, try again later: %s\n", resource.ID, err.Error())
+			return types.Resource{}, err
+		}
+		ev.Status = instance.Status
 
 		switch instance.Status {
 		case "RUNNING":
-			if success, err := tools.Poke(instance, "8743", 5); success {
+			if success, err := service.Poke(instance, "8743", 5); success {
+				ev.Reason = "instance-ready"
 				resource.State = types.ResourceServing
-				resource.Meta = types.Meta{
-					"addr":     instance.NetworkInterfaces[0].NetworkIP + ":5432",
-					"load":     instance.NetworkInterfaces[0].NetworkIP + ":8743",
-					"snapshot": resource.Meta["snapshot"],
+				if resource.Meta == nil {
+					resource.Meta = types.Meta{}
 				}
+				resource.Meta["addr"] = service.Addr(instance, "5432")
+				resource.Meta["load"] = service.Addr(instance, "8743")
 			} else if err != nil {
 				log.Printf("fail to poke instance %q on startup port, try again later: %s\n", resource.ID, err.Error())
 			}
 		case "STOPPED", "TERMINATED":
-			if err := c.Service.StartInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5); err != nil {
+			if err := service.StartInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5); err != nil {
 				log.Printf("fail to start instance %q, try again later: %s\n", resource.ID, err.Error())
 			}
 		}
 
 		if time.Since(resource.StateChange) > 2*time.Duration(cp.MaxIdleSecond)*time.Second {
 			log.Printf("instance %q createing exceeds 2x MaxIdleSecond %d, mark deleting\n", resource.ID, 2*cp.MaxIdleSecond)
+			ev.Reason = "boot-timeout"
 			resource.State = types.ResourceDeleting
 		}
 	case types.ResourceServing:
@@ -239,40 +489,55 @@ func (c *Controller) SyncResource(resource types.Resource, params map[string]int
 			return resource, nil
 		}
 		// check service running
-		instance, err := c.Service.FindInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
+		instance, err := service.FindInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
 		if err != nil && tools.IsStatusNotFound(err) {
 			log.Printf("instance %q disappeared, mark deleted\n", resource.ID)
+			ev.Reason = "instance-disappeared"
 			resource.State = types.ResourceDeleted
 			break
 		}
+		if err != nil {
+			log.Printf("fail to find instance %q, try again later: %s\n", resource.ID, err.Error())
+			return types.Resource{}, err
+		}
+		ev.Status = instance.Status
 		if instance.Status == "STOPPING" {
 			log.Printf("instance %q stopping, mark terminating\n", resource.ID)
+			ev.Reason = "instance-stopping"
 			resource.State = types.ResourceTerminating
 			break
 		}
 		if instance.Status == "TERMINATED" {
 			log.Printf("instance %q stopped, mark termintated\n", resource.ID)
+			ev.Reason = "instance-stopped"
 			resource.State = types.ResourceTerminated
 			break
 		}
 		if instance.Status == "PROVISIONING" {
 			log.Printf("instance %q provisioning, mark booting\n", resource.ID)
+			ev.Reason = "instance-restarting"
 			resource.State = types.ResourceBooting
 			break
 		}
 		if instance.Status == "STAGING" {
 			log.Printf("instance %q staging, mark booting\n", resource.ID)
+			ev.Reason = "instance-restarting"
 			resource.State = types.ResourceBooting
 			break
 		}
 		if instance.Status != "RUNNING" {
 			log.Printf("instance %q not running but %s, mark deleting\n", instance.Status, resource.ID)
+			ev.Reason = "instance-abnormal"
 			resource.State = types.ResourceDeleting
 			break
 		}
 
 		if time.Since(resource.CreatedAt) > time.Duration(cp.MaxServSecond)*time.Second {
+			if !c.Drain(&resource, cp) {
+				break
+			}
 			log.Printf("instance %q exceeds MaxServSecond %d, mark deleting\n", resource.ID, cp.MaxServSecond)
+			ev.Reason = "max-serv-exceeded"
 			resource.State = types.ResourceDeleting
 			break
 		}
@@ -282,31 +547,54 @@ func (c *Controller) SyncResource(resource types.Resource, params map[string]int
 			ts = resource.StateChange
 		}
 
+		if warm, ok := resource.Meta["warm"].(string); ok {
+			if !resource.LastClientHeartbeat.IsZero() {
+				// the warm instance is taken by clients, treat it as a normal one from now on.
+				delete(resource.Meta, "warm")
+			} else if warm == WarmTerminated {
+				log.Printf("warm instance %q is ready, mark terminating\n", resource.ID)
+				ev.Reason = "warm-ready"
+				resource.State = types.ResourceTerminating
+				break
+			} else if active, _ := tools.InSchedule(cp.WarmSchedule, cp.TimeZone, time.Now()); active {
+				ts = time.Now()
+			}
+		}
+
 		if time.Since(ts) > time.Duration(cp.MaxIdleSecond)*time.Second {
 			log.Printf("instance %q exceeds MaxIdleSecond %d, mark terminating\n", resource.ID, cp.MaxIdleSecond)
+			ev.Reason = "max-idle-exceeded"
 			resource.State = types.ResourceTerminating
 			break
 		}
 
-		if _, err := tools.Poke(instance, "5432", 5); err != nil {
+		if _, err := service.Poke(instance, "5432", 5); err != nil {
 			log.Printf("fail to poke instance %q, mark terminating: %s\n", resource.ID, err.Error())
+			ev.Reason = "poke-failed"
 			resource.State = types.ResourceTerminating
 			break
 		}
 
 	case types.ResourceTerminating:
-		instance, err := c.Service.FindInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
+		instance, err := service.FindInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
 		if err != nil && tools.IsStatusNotFound(err) {
 			log.Printf("instance %q disappeared, mark deleted\n", resource.ID)
+			ev.Reason = "instance-disappeared"
 			resource.State = types.ResourceDeleted
 			break
 		}
+		if err != nil {
+			log.Printf("fail to find instance %q, try again later: %s\n", resource.ID, err.Error())
+			return types.Resource{}, err
+		}
+		ev.Status = instance.Status
 		if instance.Status == "RUNNING" {
-			if err := c.Service.TerminateInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5); err != nil {
+			if err := service.TerminateInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5); err != nil {
 				log.Printf("fail to stop instance %q, try again later: %s\n", resource.ID, err.Error())
 			}
 		} else if instance.Status == "TERMINATED" {
 			log.Printf("instance %q stopped, mark terminated\n", resource.ID)
+			ev.Reason = "instance-stopped"
 			resource.State = types.ResourceTerminated
 		}
 	case types.ResourceTerminated:
@@ -314,17 +602,24 @@ func (c *Controller) SyncResource(resource types.Resource, params map[string]int
 			return resource, nil
 		}
 
-		instance, err := c.Service.FindInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
+		instance, err := service.FindInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
 		if err != nil && tools.IsStatusNotFound(err) {
 			log.Printf("instance %q disappeared, mark deleted\n", resource.ID)
+			ev.Reason = "instance-disappeared"
 			resource.State = types.ResourceDeleted
 			break
 		}
+		if err != nil {
+			log.Printf("fail to find instance %q, try again later: %s\n", resource.ID, err.Error())
+			return types.Resource{}, err
+		}
+		ev.Status = instance.Status
 
 		if time.Since(resource.CreatedAt) > time.Duration(cp.MaxLifeSecond)*time.Second {
-			snapshot, _ := c.GetLatestSnapshot(cp.SnapshotProjectID, cp.SnapshotPrefix)
+			snapshot, _ := c.GetLatestSnapshot(service, cp)
 			if link, ok := resource.Meta["snapshot"].(string); ok && snapshot != nil && link != snapshot.SelfLink {
 				log.Printf("instance %q exceeds MaxLifeSecond %d, mark deleting\n", resource.ID, cp.MaxLifeSecond)
+				ev.Reason = "snapshot-outdated"
 				resource.State = types.ResourceDeleting
 				break
 			}
@@ -332,19 +627,22 @@ func (c *Controller) SyncResource(resource types.Resource, params map[string]int
 
 		if instance.Status == "RUNNING" {
 			log.Printf("instance %q running again, mark booting\n", resource.ID)
+			ev.Reason = "instance-running"
 			resource.State = types.ResourceBooting
 		}
 	case types.ResourceDeleting:
 		// if instance not found
-		_, err := c.Service.FindInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
+		_, err := service.FindInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5)
 		if err != nil && tools.IsStatusNotFound(err) {
 			log.Printf("instance %q disappeared, mark deleted\n", resource.ID)
+			ev.Reason = "instance-disappeared"
 			resource.State = types.ResourceDeleted
 			break
 		}
-		if err := c.Service.DeleteInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5); err != nil {
+		if err := service.DeleteInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5); err != nil {
 			log.Printf("fail to delete instance %q: %v", resource.ID, err)
 		} else {
+			ev.Reason = "instance-deleted"
 			resource.State = types.ResourceDeleted
 			log.Printf("instance %q deleted\n", resource.ID)
 		}
@@ -352,45 +650,94 @@ func (c *Controller) SyncResource(resource types.Resource, params map[string]int
 		// skip
 	}
 
+	if resource.State != types.ResourceServing && resource.Meta != nil {
+		// the draining ends with the serving, the resource may serve again after booting
+		delete(resource.Meta, "draining")
+		delete(resource.Meta, "preempted")
+	}
 	resource.LastSynced = time.Now()
 
 	return resource, nil
 }
 
-func makeDisk(name, snapshotPrefix, snapshotLink string) *compute.Disk {
-	return &compute.Disk{
+func makeDisk(name, snapshotLink string, cp CallParam) *compute.Disk {
+	disk := &compute.Disk{
 		Name:           name,
 		SourceSnapshot: snapshotLink,
-		Labels: map[string]string{
-			"godemand": snapshotPrefix,
-		},
+		SizeGb:         cp.DiskSizeGb,
+		Labels:         cp.labels(),
 	}
+	if cp.DiskType != "" {
+		disk.Type = "zones/" + cp.InstanceZone + "/diskTypes/" + cp.DiskType
+	}
+	return disk
+}
+
+// notifyAttributes tells the loadavg agent of the instance where to notify the preemption.
+func notifyAttributes(resource types.Resource, cp CallParam) map[string]string {
+	if cp.NotifyAddr == "" {
+		return nil
+	}
+	return map[string]string{"godemand-addr": cp.NotifyAddr, "godemand-pool": resource.PoolID}
 }
 
-func makeInstance(name, projectID, zone, machineType string, disk *compute.Disk, snapshotPrefix string, params map[string]interface{}, factory func(params map[string]interface{}, snapshot string) StartupParam) *compute.Instance {
+func makeInstance(name string, disk *compute.Disk, cp CallParam, attributes map[string]string, params map[string]interface{}, factory func(params map[string]interface{}, snapshot string) StartupParam) *compute.Instance {
 	buf := &bytes.Buffer{}
 	startup.Execute(buf, factory(params, disk.SourceSnapshot))
 	script := buf.String()
 
-	zs := strings.Split(zone, "-")
-	region := strings.Join(zs[:2], "-")
+	items := []*compute.MetadataItems{
+		{
+			Key:   "startup-script",
+			Value: &script,
+		},
+	}
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := attributes[k]
+		items = append(items, &compute.MetadataItems{Key: k, Value: &v})
+	}
+
+	zs := strings.Split(cp.InstanceZone, "-")
+	network, subnetwork := cp.networks(strings.Join(zs[:2], "-"))
+
+	var accessConfigs []*compute.AccessConfig
+	if !cp.NoExternalIP {
+		accessConfigs = []*compute.AccessConfig{
+			{
+				Type: "ONE_TO_ONE_NAT",
+			},
+		}
+	}
+
+	var serviceAccounts []*compute.ServiceAccount
+	if cp.ServiceAccount != "" {
+		scopes := cp.ServiceAccountScopes
+		if len(scopes) == 0 {
+			scopes = DefaultServiceAccountScopes
+		}
+		serviceAccounts = []*compute.ServiceAccount{{Email: cp.ServiceAccount, Scopes: scopes}}
+	}
+
+	var tags *compute.Tags
+	if len(cp.NetworkTags) > 0 {
+		tags = &compute.Tags{Items: cp.NetworkTags}
+	}
 
 	return &compute.Instance{
-		Name: name,
-		Labels: map[string]string{
-			"godemand": snapshotPrefix,
-		},
-		MachineType:  "zones/" + zone + "/machineTypes/" + machineType,
+		Name:         name,
+		Labels:       cp.labels(),
+		MachineType:  "zones/" + cp.InstanceZone + "/machineTypes/" + cp.machine(),
 		CanIpForward: true,
 		NetworkInterfaces: []*compute.NetworkInterface{
 			{
-				Network:    "projects/" + projectID + "/global/networks/default",
-				Subnetwork: "regions/" + region + "/subnetworks/default",
-				AccessConfigs: []*compute.AccessConfig{
-					{
-						Type: "ONE_TO_ONE_NAT",
-					},
-				},
+				Network:       network,
+				Subnetwork:    subnetwork,
+				AccessConfigs: accessConfigs,
 			},
 		},
 		Disks: []*compute.AttachedDisk{
@@ -401,16 +748,11 @@ func makeInstance(name, projectID, zone, machineType string, disk *compute.Disk,
 			},
 		},
 		Metadata: &compute.Metadata{
-			Items: []*compute.MetadataItems{
-				{
-					Key:   "startup-script",
-					Value: &script,
-				},
-			},
-		},
-		Scheduling: &compute.Scheduling{
-			Preemptible: true,
+			Items: items,
 		},
+		Scheduling:      cp.scheduling(),
+		ServiceAccounts: serviceAccounts,
+		Tags:            tags,
 	}
 }
 
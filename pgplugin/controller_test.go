@@ -0,0 +1,1203 @@
+package pgplugin
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rueian/godemand-example/tools"
+	"github.com/rueian/godemand/plugin"
+	"github.com/rueian/godemand/types"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	testProject = "project"
+	testZone    = "us-west1-a"
+	testID      = "godemand-pg11-20190101000000"
+)
+
+var testCallParam = CallParam{
+	MaxLoads:          10,
+	MaxServSecond:     10800,
+	MaxLifeSecond:     1800,
+	MaxIdleSecond:     300,
+	MaxSyncWindow:     30,
+	SnapshotPrefix:    "pg11",
+	SnapshotProjectID: testProject,
+	InstanceProjectID: testProject,
+	InstanceZone:      testZone,
+	InstanceMachine:   "f1-micro",
+}
+
+func newTestController() (*Controller, *tools.FakeComputeService) {
+	fake := tools.NewFakeComputeService()
+	return &Controller{
+		Service: fake,
+		StartupFactory: func(params map[string]interface{}, snapshot string) StartupParam {
+			return StartupParam{SnapshotSource: snapshot}
+		},
+		CallParamFactory: func(params map[string]interface{}) CallParam {
+			return testCallParam
+		},
+	}, fake
+}
+
+func addInstance(f *tools.FakeComputeService, status string) {
+	f.CreateInstanceRetry(testProject, testZone, &compute.Instance{
+		Name:              testID,
+		NetworkInterfaces: []*compute.NetworkInterface{{}},
+	}, 1)
+	f.SetInstanceStatus(testProject, testZone, testID, status)
+}
+
+func addDisk(f *tools.FakeComputeService, snapshot, status string) {
+	f.CreateDiskRetry(testProject, testZone, &compute.Disk{Name: testID, SourceSnapshot: snapshot}, 1)
+	f.SetDiskStatus(testProject, testZone, testID, status)
+}
+
+func TestController_SyncResource(t *testing.T) {
+	apiErr := &googleapi.Error{Code: http.StatusInternalServerError, Message: "backend error"}
+	now := time.Now()
+
+	cases := []struct {
+		Name     string
+		Resource types.Resource
+		Setup    func(f *tools.FakeComputeService)
+		Want     types.ResourceState
+		WantErr  bool
+		Check    func(t *testing.T, f *tools.FakeComputeService, res types.Resource)
+	}{
+		{
+			Name:     "pending without snapshot",
+			Resource: types.Resource{State: types.ResourcePending},
+			Want:     types.ResourceDeleted,
+		},
+		{
+			Name:     "pending creates disk from the latest snapshot",
+			Resource: types.Resource{State: types.ResourcePending},
+			Setup: func(f *tools.FakeComputeService) {
+				f.AddSnapshot(testProject, "pg11-old", "READY", now.Add(-time.Hour))
+				f.AddSnapshot(testProject, "pg11-new", "READY", now)
+				f.AddSnapshot(testProject, "pg11-creating", "CREATING", now.Add(time.Minute))
+			},
+			WantErr: true,
+			Check: func(t *testing.T, f *tools.FakeComputeService, res types.Resource) {
+				d := f.Disk(testProject, testZone, testID)
+				if d == nil || d.Status != "RESTORING" || d.SourceSnapshot != "projects/project/global/snapshots/pg11-new" {
+					t.Fatalf("unexpected disk %+v", d)
+				}
+			},
+		},
+		{
+			Name:     "pending fails to find snapshot",
+			Resource: types.Resource{State: types.ResourcePending},
+			Setup: func(f *tools.FakeComputeService) {
+				f.InjectError("FindLatestSnapshot", apiErr)
+			},
+			WantErr: true,
+		},
+		{
+			Name:     "pending waits for creating disk",
+			Resource: types.Resource{State: types.ResourcePending},
+			Setup: func(f *tools.FakeComputeService) {
+				addDisk(f, "snapshot", "CREATING")
+			},
+			WantErr: true,
+		},
+		{
+			Name:     "pending deletes failed disk",
+			Resource: types.Resource{State: types.ResourcePending},
+			Setup: func(f *tools.FakeComputeService) {
+				addDisk(f, "snapshot", "FAILED")
+			},
+			WantErr: true,
+			Check: func(t *testing.T, f *tools.FakeComputeService, res types.Resource) {
+				if d := f.Disk(testProject, testZone, testID); d != nil {
+					t.Fatalf("failed disk should be deleted")
+				}
+			},
+		},
+		{
+			Name:     "pending refuses disk in use",
+			Resource: types.Resource{State: types.ResourcePending},
+			Setup: func(f *tools.FakeComputeService) {
+				addDisk(f, "snapshot", "READY")
+				f.CreateInstanceRetry(testProject, testZone, &compute.Instance{
+					Name:  "other",
+					Disks: []*compute.AttachedDisk{{Source: f.Disk(testProject, testZone, testID).SelfLink}},
+				}, 1)
+			},
+			WantErr: true,
+		},
+		{
+			Name:     "pending creates instance on ready disk",
+			Resource: types.Resource{State: types.ResourcePending},
+			Setup: func(f *tools.FakeComputeService) {
+				addDisk(f, "snapshot", "READY")
+			},
+			Want: types.ResourceBooting,
+			Check: func(t *testing.T, f *tools.FakeComputeService, res types.Resource) {
+				i := f.Instance(testProject, testZone, testID)
+				if i == nil || i.Status != "PROVISIONING" {
+					t.Fatalf("unexpected instance %+v", i)
+				}
+				if res.Meta["snapshot"] != "snapshot" {
+					t.Fatalf("unexpected meta %v", res.Meta)
+				}
+			},
+		},
+		{
+			Name:     "pending fails to create instance",
+			Resource: types.Resource{State: types.ResourcePending},
+			Setup: func(f *tools.FakeComputeService) {
+				addDisk(f, "snapshot", "READY")
+				f.InjectError("CreateInstance", apiErr)
+			},
+			WantErr: true,
+		},
+		{
+			Name:     "pending with existing instance",
+			Resource: types.Resource{State: types.ResourcePending},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "PROVISIONING")
+			},
+			Want: types.ResourceBooting,
+		},
+		{
+			Name:     "pending fails to find instance",
+			Resource: types.Resource{State: types.ResourcePending},
+			Setup: func(f *tools.FakeComputeService) {
+				f.InjectError("FindInstance", apiErr)
+			},
+			WantErr: true,
+		},
+		{
+			Name:     "booting while provisioning",
+			Resource: types.Resource{State: types.ResourceBooting, StateChange: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "PROVISIONING")
+			},
+			Want: types.ResourceBooting,
+		},
+		{
+			Name:     "booting until startup port opens",
+			Resource: types.Resource{State: types.ResourceBooting, StateChange: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "RUNNING")
+				f.SetPortClosed(testID, "8743", true)
+			},
+			Want: types.ResourceBooting,
+		},
+		{
+			Name:     "booting to serving",
+			Resource: types.Resource{State: types.ResourceBooting, StateChange: now, Meta: types.Meta{"snapshot": "snapshot"}},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "RUNNING")
+			},
+			Want: types.ResourceServing,
+			Check: func(t *testing.T, f *tools.FakeComputeService, res types.Resource) {
+				if res.Meta["addr"] != "10.0.0.1:5432" || res.Meta["load"] != "10.0.0.1:8743" || res.Meta["snapshot"] != "snapshot" {
+					t.Fatalf("unexpected meta %v", res.Meta)
+				}
+			},
+		},
+		{
+			Name:     "booting starts stopped instance",
+			Resource: types.Resource{State: types.ResourceBooting, StateChange: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "TERMINATED")
+			},
+			Want: types.ResourceBooting,
+			Check: func(t *testing.T, f *tools.FakeComputeService, res types.Resource) {
+				if i := f.Instance(testProject, testZone, testID); i.Status != "STAGING" {
+					t.Fatalf("instance should be started, got %s", i.Status)
+				}
+			},
+		},
+		{
+			Name:     "booting too long",
+			Resource: types.Resource{State: types.ResourceBooting, StateChange: now.Add(-time.Hour)},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "STAGING")
+			},
+			Want: types.ResourceDeleting,
+		},
+		{
+			Name:     "booting instance disappeared",
+			Resource: types.Resource{State: types.ResourceBooting, StateChange: now},
+			Want:     types.ResourceDeleted,
+		},
+		{
+			Name:     "booting fails to find instance",
+			Resource: types.Resource{State: types.ResourceBooting, StateChange: now},
+			Setup: func(f *tools.FakeComputeService) {
+				f.InjectError("FindInstance", apiErr)
+			},
+			WantErr: true,
+		},
+		{
+			Name:     "serving within sync window",
+			Resource: types.Resource{State: types.ResourceServing, LastSynced: now},
+			Want:     types.ResourceServing,
+		},
+		{
+			Name:     "serving healthy",
+			Resource: types.Resource{State: types.ResourceServing, CreatedAt: now, StateChange: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "RUNNING")
+			},
+			Want: types.ResourceServing,
+		},
+		{
+			Name:     "serving instance stopping",
+			Resource: types.Resource{State: types.ResourceServing, CreatedAt: now, StateChange: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "STOPPING")
+			},
+			Want: types.ResourceTerminating,
+		},
+		{
+			Name:     "serving instance stopped",
+			Resource: types.Resource{State: types.ResourceServing, CreatedAt: now, StateChange: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "TERMINATED")
+			},
+			Want: types.ResourceTerminated,
+		},
+		{
+			Name:     "serving instance provisioning",
+			Resource: types.Resource{State: types.ResourceServing, CreatedAt: now, StateChange: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "PROVISIONING")
+			},
+			Want: types.ResourceBooting,
+		},
+		{
+			Name:     "serving instance staging",
+			Resource: types.Resource{State: types.ResourceServing, CreatedAt: now, StateChange: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "STAGING")
+			},
+			Want: types.ResourceBooting,
+		},
+		{
+			Name:     "serving instance in unknown status",
+			Resource: types.Resource{State: types.ResourceServing, CreatedAt: now, StateChange: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "SUSPENDED")
+			},
+			Want: types.ResourceDeleting,
+		},
+		{
+			Name:     "serving exceeds MaxServSecond",
+			Resource: types.Resource{State: types.ResourceServing, CreatedAt: now.Add(-4 * time.Hour), StateChange: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "RUNNING")
+			},
+			Want: types.ResourceDeleting,
+		},
+		{
+			Name:     "serving exceeds MaxIdleSecond",
+			Resource: types.Resource{State: types.ResourceServing, CreatedAt: now, StateChange: now.Add(-time.Hour), LastClientHeartbeat: now.Add(-10 * time.Minute)},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "RUNNING")
+			},
+			Want: types.ResourceTerminating,
+		},
+		{
+			Name:     "serving with recent heartbeat",
+			Resource: types.Resource{State: types.ResourceServing, CreatedAt: now, StateChange: now.Add(-time.Hour), LastClientHeartbeat: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "RUNNING")
+			},
+			Want: types.ResourceServing,
+		},
+		{
+			Name:     "serving with postgres down",
+			Resource: types.Resource{State: types.ResourceServing, CreatedAt: now, StateChange: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "RUNNING")
+				f.SetPortClosed(testID, "5432", true)
+			},
+			Want: types.ResourceTerminating,
+		},
+		{
+			Name:     "serving instance disappeared",
+			Resource: types.Resource{State: types.ResourceServing},
+			Want:     types.ResourceDeleted,
+		},
+		{
+			Name:     "terminating stops running instance",
+			Resource: types.Resource{State: types.ResourceTerminating},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "RUNNING")
+			},
+			Want: types.ResourceTerminating,
+			Check: func(t *testing.T, f *tools.FakeComputeService, res types.Resource) {
+				if i := f.Instance(testProject, testZone, testID); i.Status != "STOPPING" {
+					t.Fatalf("instance should be stopped, got %s", i.Status)
+				}
+			},
+		},
+		{
+			Name:     "terminating retries stop later",
+			Resource: types.Resource{State: types.ResourceTerminating},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "RUNNING")
+				f.InjectError("TerminateInstance", apiErr)
+			},
+			Want: types.ResourceTerminating,
+		},
+		{
+			Name:     "terminating to terminated",
+			Resource: types.Resource{State: types.ResourceTerminating},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "TERMINATED")
+			},
+			Want: types.ResourceTerminated,
+		},
+		{
+			Name:     "terminated within sync window",
+			Resource: types.Resource{State: types.ResourceTerminated, LastSynced: now},
+			Want:     types.ResourceTerminated,
+		},
+		{
+			Name:     "terminated running again",
+			Resource: types.Resource{State: types.ResourceTerminated, CreatedAt: now},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "RUNNING")
+			},
+			Want: types.ResourceBooting,
+		},
+		{
+			Name:     "terminated with outdated snapshot",
+			Resource: types.Resource{State: types.ResourceTerminated, CreatedAt: now.Add(-time.Hour), Meta: types.Meta{"snapshot": "old"}},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "TERMINATED")
+				f.AddSnapshot(testProject, "pg11-new", "READY", now)
+			},
+			Want: types.ResourceDeleting,
+		},
+		{
+			Name:     "terminated with latest snapshot",
+			Resource: types.Resource{State: types.ResourceTerminated, CreatedAt: now.Add(-time.Hour), Meta: types.Meta{"snapshot": "projects/project/global/snapshots/pg11-new"}},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "TERMINATED")
+				f.AddSnapshot(testProject, "pg11-new", "READY", now)
+			},
+			Want: types.ResourceTerminated,
+		},
+		{
+			Name:     "terminated instance disappeared",
+			Resource: types.Resource{State: types.ResourceTerminated},
+			Want:     types.ResourceDeleted,
+		},
+		{
+			Name:     "deleting deletes instance",
+			Resource: types.Resource{State: types.ResourceDeleting},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "RUNNING")
+			},
+			Want: types.ResourceDeleted,
+			Check: func(t *testing.T, f *tools.FakeComputeService, res types.Resource) {
+				if i := f.Instance(testProject, testZone, testID); i != nil {
+					t.Fatalf("instance should be deleted")
+				}
+			},
+		},
+		{
+			Name:     "deleting retries delete later",
+			Resource: types.Resource{State: types.ResourceDeleting},
+			Setup: func(f *tools.FakeComputeService) {
+				addInstance(f, "RUNNING")
+				f.InjectError("DeleteInstance", apiErr)
+			},
+			Want: types.ResourceDeleting,
+		},
+		{
+			Name:     "deleting instance disappeared",
+			Resource: types.Resource{State: types.ResourceDeleting},
+			Want:     types.ResourceDeleted,
+		},
+		{
+			Name:     "deleted",
+			Resource: types.Resource{State: types.ResourceDeleted},
+			Want:     types.ResourceDeleted,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			c, f := newTestController()
+			if tc.Setup != nil {
+				tc.Setup(f)
+			}
+			tc.Resource.ID = testID
+
+			res, err := c.SyncResource(tc.Resource, nil)
+			if tc.WantErr {
+				if err == nil {
+					t.Fatalf("expect error, got %v", res.State)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if res.State != tc.Want {
+					t.Fatalf("expect %v, got %v", tc.Want, res.State)
+				}
+			}
+			if tc.Check != nil {
+				tc.Check(t, f, res)
+			}
+		})
+	}
+}
+
+func TestController_SyncResourceLifecycle(t *testing.T) {
+	c, f := newTestController()
+	f.AddSnapshot(testProject, "pg11-1", "READY", time.Now())
+
+	res := types.Resource{ID: testID, State: types.ResourcePending, CreatedAt: time.Now(), StateChange: time.Now()}
+
+	sync := func(want types.ResourceState) {
+		t.Helper()
+		ret, err := c.SyncResource(res, nil)
+		if err != nil {
+			t.Fatalf("unexpected error on %v: %v", res.State, err)
+		}
+		if ret.State != want {
+			t.Fatalf("expect %v -> %v, got %v", res.State, want, ret.State)
+		}
+		if ret.State != res.State {
+			ret.StateChange = time.Now()
+		}
+		ret.LastSynced = time.Time{}
+		res = ret
+	}
+
+	// the disk is restoring from the snapshot
+	if _, err := c.SyncResource(res, nil); err == nil {
+		t.Fatalf("expect waiting for disk")
+	}
+	f.Step()
+	sync(types.ResourceBooting)
+	// the insert operation is polled on the later syncs
+	if _, err := c.SyncResource(res, nil); err == nil {
+		t.Fatalf("expect waiting for the insert operation")
+	}
+	f.Step()
+	sync(types.ResourceBooting)
+	if _, ok := res.Meta["operation"]; ok {
+		t.Fatalf("expect the done operation removed from meta, got %v", res.Meta)
+	}
+	f.Step()
+	sync(types.ResourceServing)
+	sync(types.ResourceServing)
+
+	res.StateChange = time.Now().Add(-time.Hour)
+	sync(types.ResourceTerminating)
+	sync(types.ResourceTerminating)
+	f.Step()
+	sync(types.ResourceTerminated)
+
+	f.SetInstanceStatus(testProject, testZone, testID, "RUNNING")
+	sync(types.ResourceBooting)
+	sync(types.ResourceServing)
+
+	res.CreatedAt = time.Now().Add(-4 * time.Hour)
+	sync(types.ResourceDeleting)
+	sync(types.ResourceDeleted)
+
+	if f.Instance(testProject, testZone, testID) != nil || f.Disk(testProject, testZone, testID) != nil {
+		t.Fatalf("instance and disk should be deleted")
+	}
+}
+
+func TestController_SyncResourceLatency(t *testing.T) {
+	c, f := newTestController()
+	f.Latency = 10 * time.Millisecond
+	addInstance(f, "RUNNING")
+
+	begin := time.Now()
+	res, err := c.SyncResource(types.Resource{ID: testID, State: types.ResourceDeleting}, nil)
+	if err != nil || res.State != types.ResourceDeleted {
+		t.Fatalf("unexpected result %v %v", res.State, err)
+	}
+	if time.Since(begin) < 2*f.Latency {
+		t.Fatalf("latency should be simulated")
+	}
+}
+
+func TestController_GetService(t *testing.T) {
+	c, f := newTestController()
+	local := tools.NewFakeComputeService()
+	c.Providers = map[string]Provider{"local": local}
+
+	if s, err := c.GetService(CallParam{}); err != nil || s != f {
+		t.Fatalf("expect the default service, got %v %v", s, err)
+	}
+	if s, err := c.GetService(CallParam{Provider: "local"}); err != nil || s != local {
+		t.Fatalf("expect the local service, got %v %v", s, err)
+	}
+	if _, err := c.GetService(CallParam{Provider: "aws"}); err == nil {
+		t.Fatalf("expect error on unavailable provider")
+	}
+}
+
+func TestController_FindResourceRouting(t *testing.T) {
+	now := time.Now()
+	serving := func(id string, age time.Duration, clients int) types.Resource {
+		res := types.Resource{
+			ID:        id,
+			State:     types.ResourceServing,
+			CreatedAt: now.Add(-age),
+			Meta:      types.Meta{"load": id + ":8743"},
+			Clients:   map[string]types.Client{},
+		}
+		for i := 0; i < clients; i++ {
+			res.Clients[id+string(rune('a'+i))] = types.Client{Heartbeat: now}
+		}
+		return res
+	}
+	pool := types.ResourcePool{ID: "pg11", Resources: map[string]types.Resource{
+		"a": serving("a", 1*time.Minute, 3),
+		"b": serving("b", 2*time.Minute, 1),
+		"c": serving("c", 3*time.Minute, 2),
+		"d": {ID: "d", State: types.ResourceBooting, CreatedAt: now},
+	}}
+
+	find := func(policy string, params map[string]interface{}) string {
+		t.Helper()
+		c, f := newTestController()
+		f.SetLoad("a:8743", 20, 1, 1)
+		f.SetLoad("b:8743", 5, 6, 6)
+		f.SetLoad("c:8743", 2, 3, 3)
+		c.CallParamFactory = func(map[string]interface{}) CallParam {
+			cp := testCallParam
+			cp.RoutingPolicy = policy
+			return cp
+		}
+		res, err := c.FindResource(pool, params)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return res.ID
+	}
+
+	// the "a" is overloaded
+	if id := find("", nil); id != "b" {
+		t.Fatalf("newest-first should pick b, got %s", id)
+	}
+	if id := find(RoutingLeastLoaded, nil); id != "c" {
+		t.Fatalf("least-loaded should pick c, got %s", id)
+	}
+	if id := find(RoutingLeastConnections, nil); id != "b" {
+		t.Fatalf("least-connections should pick b, got %s", id)
+	}
+
+	c, f := newTestController()
+	c.CallParamFactory = func(map[string]interface{}) CallParam {
+		cp := testCallParam
+		cp.RoutingPolicy = RoutingRoundRobin
+		return cp
+	}
+	f.SetLoad("a:8743", 20, 1, 1)
+	picked := map[string]int{}
+	for i := 0; i < 4; i++ {
+		res, _ := c.FindResource(pool, nil)
+		picked[res.ID]++
+	}
+	if picked["b"] != 2 || picked["c"] != 2 {
+		t.Fatalf("round-robin should rotate b and c, got %v", picked)
+	}
+
+	params := map[string]interface{}{"ClientUser": "alice", "ClientDatabase": "db2"}
+	first := find(RoutingConsistentHash, params)
+	for i := 0; i < 3; i++ {
+		if id := find(RoutingConsistentHash, params); id != first {
+			t.Fatalf("consistent-hash should be stable, got %s and %s", first, id)
+		}
+	}
+
+	c, _ = newTestController()
+	c.CallParamFactory = func(map[string]interface{}) CallParam {
+		cp := testCallParam
+		cp.RoutingPolicy = "random"
+		return cp
+	}
+	if _, err := c.FindResource(pool, nil); err == nil {
+		t.Fatalf("expect error on unknown policy")
+	}
+}
+
+func TestController_FindResourceScaling(t *testing.T) {
+	now := time.Now()
+	overloaded := types.ResourcePool{ID: "pg11", Resources: map[string]types.Resource{
+		"a": {ID: "a", State: types.ResourceServing, CreatedAt: now, Meta: types.Meta{"load": "a:8743"}},
+		"b": {ID: "b", State: types.ResourceServing, CreatedAt: now, Meta: types.Meta{"load": "b:8743"}},
+	}}
+
+	c, f := newTestController()
+	f.SetLoad("a:8743", 20, 1, 1)
+	f.SetLoad("b:8743", 20, 1, 1)
+
+	cp := testCallParam
+	c.CallParamFactory = func(map[string]interface{}) CallParam { return cp }
+
+	if res, err := c.FindResource(overloaded, nil); err != nil || res.State != types.ResourcePending {
+		t.Fatalf("expect scale out when all serving are overloaded, got %v %v", res.State, err)
+	}
+
+	cp.MaxInstances = 2
+	if _, err := c.FindResource(overloaded, nil); !errors.Is(err, plugin.AcquireLaterErr) {
+		t.Fatalf("expect acquire later on MaxInstances, got %v", err)
+	}
+
+	f.SetLoad("b:8743", 1, 1, 1)
+	if res, err := c.FindResource(overloaded, nil); err != nil || res.ID != "b" {
+		t.Fatalf("expect the not overloaded b, got %v %v", res.ID, err)
+	}
+
+	cp.MinInstances = 3
+	scale := map[string]interface{}{"ClientScale": true}
+	if _, err := c.FindResource(overloaded, scale); !errors.Is(err, plugin.AcquireLaterErr) {
+		t.Fatalf("expect MinInstances capped by MaxInstances, got %v", err)
+	}
+
+	cp.MaxInstances = 0
+	if res, err := c.FindResource(overloaded, scale); err != nil || res.State != types.ResourcePending {
+		t.Fatalf("expect scale out to MinInstances, got %v %v", res.State, err)
+	}
+
+	cp.MinInstances = 2
+	if _, err := c.FindResource(overloaded, scale); !errors.Is(err, ScaleSatisfiedErr) {
+		t.Fatalf("expect satisfied MinInstances, got %v", err)
+	}
+
+	// the stopped instance is not rebooted for the clients of the overloaded ones
+	cp.MinInstances = 0
+	f.SetLoad("b:8743", 20, 1, 1)
+	overloaded.Resources["c"] = types.Resource{ID: "c", State: types.ResourceTerminated, CreatedAt: now}
+	if res, err := c.FindResource(overloaded, nil); err != nil || res.State != types.ResourcePending {
+		t.Fatalf("expect scale out instead of the terminated c, got %v %v %v", res.ID, res.State, err)
+	}
+}
+
+func TestController_Warm(t *testing.T) {
+	now := time.Now()
+	c, f := newTestController()
+	cp := testCallParam
+	cp.WarmInstances = 1
+	cp.WarmState = WarmTerminated
+	c.CallParamFactory = func(map[string]interface{}) CallParam { return cp }
+
+	scale := map[string]interface{}{"ClientScale": true}
+	busy := types.ResourcePool{ID: "pg11", Resources: map[string]types.Resource{
+		"a": {ID: "a", State: types.ResourceServing, Clients: map[string]types.Client{"c": {Heartbeat: now}}},
+	}}
+
+	res, err := c.FindResource(busy, scale)
+	if err != nil || res.State != types.ResourcePending || res.Meta["warm"] != WarmTerminated {
+		t.Fatalf("expect a warm instance, got %v %v %v", res.State, res.Meta, err)
+	}
+
+	busy.Resources["b"] = types.Resource{ID: "b", State: types.ResourceTerminated}
+	if _, err := c.FindResource(busy, scale); !errors.Is(err, ScaleSatisfiedErr) {
+		t.Fatalf("expect satisfied WarmInstances, got %v", err)
+	}
+
+	// the terminated instance is not a warm one of the serving state
+	cp.WarmState = WarmServing
+	if res, err := c.FindResource(busy, scale); err != nil || res.State != types.ResourcePending || res.Meta["warm"] != WarmServing {
+		t.Fatalf("expect a serving warm instance, got %v %v %v", res.State, res.Meta, err)
+	}
+	busy.Resources["c"] = types.Resource{ID: "c", State: types.ResourceBooting, Meta: types.Meta{"warm": WarmServing}}
+	if _, err := c.FindResource(busy, scale); !errors.Is(err, ScaleSatisfiedErr) {
+		t.Fatalf("expect the booting warm instance counted, got %v", err)
+	}
+	delete(busy.Resources, "c")
+	cp.WarmState = WarmTerminated
+
+	// the warm instance taken by a client is not stopped again
+	taking := types.ResourcePool{ID: "pg11", Resources: map[string]types.Resource{
+		"w": {ID: "w", State: types.ResourceTerminated, Meta: types.Meta{"warm": WarmTerminated}},
+	}}
+	if res, err := c.FindResource(taking, nil); err != nil || res.ID != "w" || res.Meta["warm"] != nil {
+		t.Fatalf("expect the warm instance taken, got %v %v %v", res.ID, res.Meta, err)
+	}
+	if taking.Resources["w"].Meta["warm"] != WarmTerminated {
+		t.Fatal("expect the pool resource untouched")
+	}
+
+	// a window in the day after tomorrow
+	cp.WarmSchedule = now.UTC().AddDate(0, 0, 2).Weekday().String()[:3] + " 00:00-24:00"
+	cp.TimeZone = "UTC"
+	delete(busy.Resources, "b")
+	if _, err := c.FindResource(busy, scale); !errors.Is(err, ScaleSatisfiedErr) {
+		t.Fatalf("expect no warm instance out of schedule, got %v", err)
+	}
+
+	addInstance(f, "RUNNING")
+	warm := types.Resource{ID: testID, State: types.ResourceServing, CreatedAt: now, StateChange: now, Meta: types.Meta{"warm": WarmTerminated}}
+	if res, err := c.SyncResource(warm, nil); err != nil || res.State != types.ResourceTerminating {
+		t.Fatalf("expect warm instance to be stopped after ready, got %v %v", res.State, err)
+	}
+
+	warm.Meta = types.Meta{"warm": WarmServing}
+	warm.StateChange = now.Add(-time.Hour)
+	cp.WarmSchedule = ""
+	if res, err := c.SyncResource(warm, nil); err != nil || res.State != types.ResourceServing {
+		t.Fatalf("expect warm instance to be kept serving, got %v %v", res.State, err)
+	}
+
+	warm.Meta = types.Meta{"warm": WarmServing}
+	warm.LastClientHeartbeat = now.Add(-time.Hour)
+	if res, err := c.SyncResource(warm, nil); err != nil || res.State != types.ResourceTerminating || res.Meta["warm"] != nil {
+		t.Fatalf("expect taken warm instance to be idle as usual, got %v %v %v", res.State, res.Meta, err)
+	}
+}
+
+func TestController_Schedules(t *testing.T) {
+	now := time.Now()
+	c, f := newTestController()
+	cp := testCallParam
+	c.CallParamFactory = func(map[string]interface{}) CallParam { return cp }
+
+	addInstance(f, "RUNNING")
+	idle := types.Resource{ID: testID, State: types.ResourceServing, CreatedAt: now, StateChange: now.Add(-time.Hour)}
+	if res, err := c.SyncResource(idle, nil); err != nil || res.State != types.ResourceTerminating {
+		t.Fatalf("expect idle instance to be terminating, got %v %v", res.State, err)
+	}
+
+	cp.Schedules = []Schedule{
+		{Window: now.UTC().AddDate(0, 0, 2).Weekday().String()[:3] + " 00:00-24:00", Shutdown: true},
+		{Window: "* 00:00-24:00", MaxIdleSecond: 7200},
+	}
+	if res, err := c.SyncResource(idle, nil); err != nil || res.State != types.ResourceServing {
+		t.Fatalf("expect MaxIdleSecond to be extended by schedule, got %v %v", res.State, err)
+	}
+
+	cp.Schedules = []Schedule{{Window: "* 00:00-24:00", Shutdown: true}}
+	idle.StateChange = now
+	if res, err := c.SyncResource(idle, nil); err != nil || res.State != types.ResourceTerminating {
+		t.Fatalf("expect instance to be shut down by schedule, got %v %v", res.State, err)
+	}
+
+	// the serving instance is drained before the shutdown, and the pending one is not booted
+	cp.DrainSecond = 600
+	res, err := c.SyncResource(idle, nil)
+	if err != nil || res.State != types.ResourceServing || res.Meta["draining"] == nil {
+		t.Fatalf("expect instance to be draining before the shutdown, got %v %v %v", res.State, res.Meta, err)
+	}
+	res.Meta["draining"] = now.Add(-time.Minute).Format(time.RFC3339)
+	if res, err = c.SyncResource(res, nil); err != nil || res.State != types.ResourceTerminating || res.Meta["draining"] != nil {
+		t.Fatalf("expect drained instance to be shut down by schedule, got %v %v %v", res.State, res.Meta, err)
+	}
+	pending := types.Resource{ID: testID + "-2", State: types.ResourcePending}
+	if res, err := c.SyncResource(pending, nil); err != nil || res.State != types.ResourcePending || f.Disk(testProject, testZone, pending.ID) != nil {
+		t.Fatalf("expect pending resource not booted during shutdown, got %v %v", res.State, err)
+	}
+
+	pool := types.ResourcePool{ID: "pg11", Resources: map[string]types.Resource{"a": {ID: "a", State: types.ResourceTerminated}}}
+	// the code of the error is restored by the godemand service after the rpc
+	if _, err := c.FindResource(pool, nil); !errors.Is(err, RejectedErr) || !strings.HasPrefix(err.Error(), "[rejected] ") {
+		t.Fatalf("expect request to be rejected by schedule with the code, got %v", err)
+	}
+	if _, err := c.FindResource(pool, map[string]interface{}{"ClientScale": true}); !errors.Is(err, ScaleSatisfiedErr) {
+		t.Fatalf("expect no scaling during shutdown, got %v", err)
+	}
+
+	cp.Schedules = []Schedule{{Window: "Someday 00:00-24:00", Shutdown: true}}
+	if _, err := c.SyncResource(idle, nil); err == nil {
+		t.Fatalf("expect error of malformed window")
+	}
+}
+
+func TestController_Drain(t *testing.T) {
+	now := time.Now()
+	c, f := newTestController()
+	cp := testCallParam
+	cp.DrainSecond = 600
+	c.CallParamFactory = func(map[string]interface{}) CallParam { return cp }
+
+	addInstance(f, "RUNNING")
+	old := types.Resource{ID: testID, PoolID: "pg11", State: types.ResourceServing, CreatedAt: now.Add(-4 * time.Hour), StateChange: now}
+	res, err := c.SyncResource(old, nil)
+	if err != nil || res.State != types.ResourceServing || res.Meta["draining"] == nil {
+		t.Fatalf("expect instance exceeding MaxServSecond to be draining, got %v %v %v", res.State, res.Meta, err)
+	}
+
+	pool := types.ResourcePool{ID: "pg11", Resources: map[string]types.Resource{testID: res}}
+	if found, err := c.FindResource(pool, nil); err != nil || found.ID == testID || found.State != types.ResourcePending {
+		t.Fatalf("expect the draining instance replaced by a new one, got %v %v", found, err)
+	}
+
+	// clients are still running queries
+	res.Meta["draining"] = now.Add(-time.Minute).Format(time.RFC3339)
+	res.Clients = map[string]types.Client{"c": {ID: "c", Heartbeat: now}}
+	res.LastSynced = time.Time{}
+	if res, err = c.SyncResource(res, nil); err != nil || res.State != types.ResourceServing {
+		t.Fatalf("expect instance with in-flight queries to keep draining, got %v %v", res.State, err)
+	}
+
+	res.Clients = map[string]types.Client{"c": {ID: "c", Heartbeat: now.Add(-time.Minute)}}
+	res.LastSynced = time.Time{}
+	if res, err = c.SyncResource(res, nil); err != nil || res.State != types.ResourceDeleting {
+		t.Fatalf("expect drained instance to be deleting, got %v %v", res.State, err)
+	}
+	if _, ok := res.Meta["draining"]; ok {
+		t.Fatalf("expect the draining meta removed after serving, got %v", res.Meta)
+	}
+
+	res.State = types.ResourceServing
+	res.Clients = map[string]types.Client{"c": {ID: "c", Heartbeat: now}}
+	res.Meta["draining"] = now.Add(-time.Hour).Format(time.RFC3339)
+	res.LastSynced = time.Time{}
+	if res, err = c.SyncResource(res, nil); err != nil || res.State != types.ResourceDeleting {
+		t.Fatalf("expect instance exceeding DrainSecond to be deleting, got %v %v", res.State, err)
+	}
+}
+
+func TestMakeInstance_NotifyAttributes(t *testing.T) {
+	cp := testCallParam
+	cp.NotifyAddr = "http://godemand:8080"
+	factory := func(map[string]interface{}, string) StartupParam { return StartupParam{} }
+	i := makeInstance(testID, &compute.Disk{}, cp, notifyAttributes(types.Resource{PoolID: "pg11"}, cp), nil, factory)
+
+	items := map[string]string{}
+	for _, item := range i.Metadata.Items {
+		items[item.Key] = *item.Value
+	}
+	if len(items) != 3 || items["godemand-addr"] != "http://godemand:8080" || items["godemand-pool"] != "pg11" || items["startup-script"] == "" {
+		t.Fatalf("unexpected metadata %v", items)
+	}
+	if notifyAttributes(types.Resource{PoolID: "pg11"}, testCallParam) != nil {
+		t.Fatal("expect no attributes without NotifyAddr")
+	}
+}
+
+func TestMakeInstance_Params(t *testing.T) {
+	factory := func(map[string]interface{}, string) StartupParam { return StartupParam{} }
+
+	i := makeInstance(testID, &compute.Disk{}, testCallParam, nil, nil, factory)
+	if i.MachineType != "zones/us-west1-a/machineTypes/f1-micro" || !i.Scheduling.Preemptible || len(i.NetworkInterfaces[0].AccessConfigs) != 1 ||
+		i.NetworkInterfaces[0].Network != "projects/project/global/networks/default" || i.NetworkInterfaces[0].Subnetwork != "regions/us-west1/subnetworks/default" {
+		t.Fatalf("unexpected default instance %+v", i)
+	}
+
+	cp := testCallParam
+	cp.InstanceCPUs = 2
+	cp.InstanceMemoryMB = 4096
+	cp.Provisioning = ProvisioningOnDemand
+	cp.DiskType = "pd-ssd"
+	cp.DiskSizeGb = 50
+	cp.Network = "vpc"
+	cp.NoExternalIP = true
+	cp.ServiceAccount = "pg@project.iam.gserviceaccount.com"
+	cp.NetworkTags = []string{"pg"}
+	cp.Labels = map[string]string{"team": "data"}
+	if err := cp.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	d := makeDisk(testID, "snapshot", cp)
+	if d.Type != "zones/us-west1-a/diskTypes/pd-ssd" || d.SizeGb != 50 || d.Labels["team"] != "data" || d.Labels["godemand"] != "pg11" {
+		t.Fatalf("unexpected disk %+v", d)
+	}
+	i = makeInstance(testID, d, cp, nil, nil, factory)
+	if i.MachineType != "zones/us-west1-a/machineTypes/custom-2-4096" || i.Scheduling.Preemptible || len(i.NetworkInterfaces[0].AccessConfigs) != 0 ||
+		i.NetworkInterfaces[0].Network != "projects/project/global/networks/vpc" || i.NetworkInterfaces[0].Subnetwork != "regions/us-west1/subnetworks/vpc" ||
+		i.ServiceAccounts[0].Scopes[0] != DefaultServiceAccountScopes[0] || i.Tags.Items[0] != "pg" || i.Labels["team"] != "data" {
+		t.Fatalf("unexpected instance %+v", i)
+	}
+
+	cp.Provisioning = ProvisioningSpot
+	if err := cp.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if s := makeInstance(testID, d, cp, nil, nil, factory).Scheduling; s.Preemptible || s.ProvisioningModel != "SPOT" || s.InstanceTerminationAction != "STOP" || *s.AutomaticRestart {
+		t.Fatalf("unexpected spot scheduling %+v", s)
+	}
+
+	for _, invalid := range []func(cp *CallParam){
+		func(cp *CallParam) { cp.Provisioning = "reserved" },
+		func(cp *CallParam) { cp.DiskType = "pd-fast" },
+		func(cp *CallParam) { cp.InstanceCPUs = 3 },
+		func(cp *CallParam) { cp.InstanceMemoryMB = 1000 },
+		func(cp *CallParam) { cp.InstanceMemoryMB = 16384 },
+		func(cp *CallParam) { cp.NetworkTags = []string{"Pg"} },
+		func(cp *CallParam) { cp.Labels = map[string]string{"godemand": "other"} },
+	} {
+		invalid(&cp)
+		if err := cp.Validate(); err == nil {
+			t.Fatalf("expect invalid params %+v", cp)
+		}
+		cp = testCallParam
+		cp.InstanceCPUs = 2
+		cp.InstanceMemoryMB = 4096
+	}
+}
+
+func TestController_InvalidParams(t *testing.T) {
+	c, fake := newTestController()
+	snapshot := fake.AddSnapshot(testProject, "pg11-20190101", "READY", time.Now())
+	snapshot.DiskSizeGb = 100
+
+	cp := testCallParam
+	cp.DiskType = "pd-fast"
+	c.CallParamFactory = func(params map[string]interface{}) CallParam { return cp }
+	if _, err := c.FindResource(types.ResourcePool{ID: "pg11"}, nil); !errors.Is(err, RejectedErr) {
+		t.Fatalf("expect invalid params rejected, got %v", err)
+	}
+
+	cp.DiskType = "pd-ssd"
+	cp.DiskSizeGb = 10
+	res, err := c.SyncResource(types.Resource{ID: testID, State: types.ResourcePending}, nil)
+	if err != nil || res.State != types.ResourceDeleted {
+		t.Fatalf("expect disk smaller than the snapshot to be deleted, got %v %v", res.State, err)
+	}
+	if fake.Disk(testProject, testZone, testID) != nil {
+		t.Fatal("expect no disk created")
+	}
+}
+
+func TestController_Fallback(t *testing.T) {
+	exhausted := &tools.OperationErr{Codes: []string{"ZONE_RESOURCE_POOL_EXHAUSTED"}, Message: "no capacity"}
+	quota := &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}
+	fallbackZone := "us-west1-b"
+
+	c, fake := newTestController()
+	fake.AddSnapshot(testProject, "pg11-20190101", "READY", time.Now())
+	cp := testCallParam
+	cp.FallbackZones = []string{fallbackZone}
+	cp.FallbackMachines = []string{"g1-small"}
+	c.CallParamFactory = func(params map[string]interface{}) CallParam { return cp }
+
+	sync := func(res types.Resource) types.Resource {
+		for i := 0; i < 5; i++ {
+			next, err := c.SyncResource(res, nil)
+			if err == nil {
+				return next
+			}
+			fake.Step()
+		}
+		t.Fatal("expect the resource synced")
+		return res
+	}
+
+	// the next machine type in the same zone
+	fake.InjectError("CreateInstance", exhausted)
+	res := sync(types.Resource{ID: testID, State: types.ResourcePending})
+	if res.State != types.ResourceBooting || res.Meta["zone"] != testZone || res.Meta["machine"] != "g1-small" {
+		t.Fatalf("expect the instance of the fallback machine, got %v %v", res.State, res.Meta)
+	}
+
+	// the next zone with a new disk
+	id := testID + "-2"
+	fake.InjectError("CreateInstance", exhausted)
+	fake.InjectError("CreateInstance", quota)
+	res = sync(types.Resource{ID: id, State: types.ResourcePending})
+	if res.State != types.ResourcePending || res.Meta["zone"] != fallbackZone || fake.Disk(testProject, testZone, id) != nil {
+		t.Fatalf("expect the resource moved to the fallback zone, got %v %v", res.State, res.Meta)
+	}
+	res = sync(res)
+	if res.State != types.ResourceBooting || res.Meta["machine"] != "f1-micro" || fake.Instance(testProject, fallbackZone, id) == nil || fake.Disk(testProject, fallbackZone, id) == nil {
+		t.Fatalf("expect the instance in the fallback zone, got %v %v", res.State, res.Meta)
+	}
+	res.StateChange = time.Now()
+	if res = sync(res); res.State != types.ResourceBooting {
+		t.Fatalf("expect the instance found in the fallback zone, got %v", res.State)
+	}
+
+	// the capacity errors reported by the insert operation
+	id = testID + "-5"
+	fake.InjectError("InstanceOperation", exhausted)
+	res = sync(types.Resource{ID: id, State: types.ResourcePending, StateChange: time.Now()})
+	if res.State != types.ResourceBooting || res.Meta["operation"] == nil || fake.Instance(testProject, testZone, id) != nil {
+		t.Fatalf("expect the resource booting with the operation, got %v %v", res.State, res.Meta)
+	}
+	res = sync(res)
+	if res.State != types.ResourcePending || res.Meta["machine"] != "g1-small" || res.Meta["operation"] != nil {
+		t.Fatalf("expect the resource pending with the fallback machine, got %v %v", res.State, res.Meta)
+	}
+	fake.InjectError("InstanceOperation", exhausted)
+	res = sync(sync(res))
+	if res.State != types.ResourcePending || res.Meta["zone"] != fallbackZone || res.Meta["machine"] != "f1-micro" {
+		t.Fatalf("expect the resource pending in the fallback zone, got %v %v", res.State, res.Meta)
+	}
+	if res = sync(sync(res)); res.State != types.ResourceBooting || fake.Instance(testProject, fallbackZone, id) == nil {
+		t.Fatalf("expect the instance in the fallback zone, got %v %v", res.State, res.Meta)
+	}
+
+	// no more zone
+	id = testID + "-3"
+	fake.InjectError("CreateDisk", quota)
+	res = sync(types.Resource{ID: id, State: types.ResourcePending, Meta: types.Meta{"zone": fallbackZone}})
+	if res.State != types.ResourceDeleted {
+		t.Fatalf("expect the resource deleted without more zones, got %v", res.State)
+	}
+
+	// other errors are not fallen back
+	id = testID + "-4"
+	fake.InjectError("CreateInstance", &googleapi.Error{Code: http.StatusBadRequest})
+	res = types.Resource{ID: id, State: types.ResourcePending}
+	for i := 0; i < 5; i++ {
+		if _, err := c.SyncResource(res, nil); err != nil && fake.Disk(testProject, testZone, id).Status == "READY" {
+			break
+		}
+		fake.Step()
+	}
+	if fake.Instance(testProject, testZone, id) != nil || fake.Disk(testProject, testZone, id) == nil {
+		t.Fatal("expect the disk kept for retrying the same zone")
+	}
+}
+
+func TestController_Budget(t *testing.T) {
+	now := time.Now()
+	c, f := newTestController()
+	cp := testCallParam
+	cp.MonthlyBudget = 1
+	cp.InstanceHourPrices = map[string]float64{"f1-micro": 0.5}
+	cp.DiskGbHourPrices = map[string]float64{"pd-standard": 0.01}
+	cp.DiskSizeGb = 10
+	c.CallParamFactory = func(map[string]interface{}) CallParam { return cp }
+
+	for _, unpriced := range []func(cp *CallParam){
+		func(cp *CallParam) { cp.FallbackMachines = []string{"n1-standard-1"} },
+		func(cp *CallParam) { cp.InstanceCPUs, cp.InstanceMemoryMB = 2, 4096 },
+		func(cp *CallParam) { cp.DiskType = "pd-ssd" },
+	} {
+		invalid := cp
+		unpriced(&invalid)
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("expect unpriced params rejected with the budget %+v", invalid)
+		}
+	}
+
+	usage, err := NewUsageLedger("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Usage = usage
+
+	addInstance(f, "RUNNING")
+	res := types.Resource{ID: testID, PoolID: "pg11", State: types.ResourceServing, CreatedAt: now, StateChange: now, LastSynced: now}
+	res.Meta = types.Meta{"usage_at": now.Add(-time.Hour).Format(time.RFC3339Nano)}
+	res, err = c.SyncResource(res, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := res.Meta["instance_hours"].(float64); h < 1 || h > 1.01 {
+		t.Fatalf("expect 1 instance-hour, got %v", h)
+	}
+	if u := usage.Get(Month(now), "pg11"); u.Cost < 0.6 || u.Cost > 0.61 {
+		t.Fatalf("expect cost 0.6 of the pool, got %v", u)
+	}
+
+	// the interval is replaced if accrued again, like the resource failed to be saved
+	prev := res
+	prev.Meta = types.Meta{"usage_at": now.Add(-time.Hour).Format(time.RFC3339Nano)}
+	if _, err = c.SyncResource(prev, nil); err != nil {
+		t.Fatal(err)
+	}
+	if u := usage.Get(Month(now), "pg11"); u.Cost < 0.6 || u.Cost > 0.61 {
+		t.Fatalf("expect cost 0.6 of the pool accrued again, got %v", u)
+	}
+	// and not accrued within the AccrueInterval without state changes
+	if next, err := c.SyncResource(res, nil); err != nil || next.Meta["usage_at"] != res.Meta["usage_at"] {
+		t.Fatalf("expect no accrual within the interval, got %v %v", next.Meta, err)
+	}
+
+	pool := types.ResourcePool{ID: "pg11"}
+	if res, err := c.FindResource(pool, nil); err != nil || res.State != types.ResourcePending {
+		t.Fatalf("expect new resource within budget, got %v %v", res.State, err)
+	}
+
+	res.State = types.ResourceTerminated
+	res.Meta["usage_at"] = now.Add(-4 * time.Hour).Format(time.RFC3339Nano)
+	if _, err = c.SyncResource(res, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.FindResource(pool, nil); !errors.Is(err, RejectedErr) {
+		t.Fatalf("expect rejection over budget, got %v", err)
+	}
+	if _, err := c.FindResource(pool, map[string]interface{}{"ClientScale": true}); !errors.Is(err, RejectedErr) {
+		t.Fatalf("expect no scaling over budget, got %v", err)
+	}
+}
+
+func TestUsageLedger_Path(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "usage.json")
+	l, err := NewUsageLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, from := range []string{"a", "b", "b"} {
+		if err := l.Add("2019-01", "pg11", testID, from, Usage{Cost: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expect the temp file renamed, got %v", err)
+	}
+	if l, err = NewUsageLedger(path); err != nil {
+		t.Fatal(err)
+	}
+	if u := l.Get("2019-01", "pg11"); u.Cost != 2 {
+		t.Fatalf("expect cost 2 of the reloaded ledger, got %v", u)
+	}
+}
+
+type recordSink []AuditEvent
+
+func (s *recordSink) Emit(event AuditEvent) error {
+	*s = append(*s, event)
+	return nil
+}
+
+func TestController_Audit(t *testing.T) {
+	now := time.Now()
+	c, f := newTestController()
+	sink := &recordSink{}
+	c.Audit = sink
+
+	pool := types.ResourcePool{ID: "pg11", Resources: map[string]types.Resource{}}
+	res, err := c.FindResource(pool, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*sink) != 1 || (*sink)[0].From != "" || (*sink)[0].To != "pending" || (*sink)[0].Reason != "client-requested" {
+		t.Fatalf("unexpected audit events of new resource: %v", *sink)
+	}
+
+	addInstance(f, "TERMINATED")
+	res = types.Resource{ID: testID, PoolID: "pg11", State: types.ResourceServing, CreatedAt: now, StateChange: now.Add(-time.Minute)}
+	if res, err = c.SyncResource(res, nil); err != nil || res.State != types.ResourceTerminated {
+		t.Fatalf("expect terminated, got %v %v", res.State, err)
+	}
+	if _, err = c.SyncResource(res, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(*sink) != 2 {
+		t.Fatalf("expect only 1 event of the transition, got %v", *sink)
+	}
+	ev := (*sink)[1]
+	if ev.ResourceID != testID || ev.PoolID != "pg11" || ev.From != "serving" || ev.To != "terminated" ||
+		ev.Reason != "instance-stopped" || ev.Status != "TERMINATED" || ev.Duration < 60 {
+		t.Fatalf("unexpected audit event: %+v", ev)
+	}
+}
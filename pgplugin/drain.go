@@ -0,0 +1,54 @@
+package pgplugin
+
+import (
+	"log"
+	"time"
+
+	"github.com/rueian/godemand/types"
+)
+
+// DrainQuiet is the time without client heartbeats for a draining resource to be drained.
+// The pgproxy sends heartbeats every 10 seconds while the clients have queries in flight.
+const DrainQuiet = 30 * time.Second
+
+// Drain keeps the serving resource out of rotation by the "draining" Meta, which tells the pgproxy to finish the
+// in-flight transactions and disconnect the idle sessions. It reports whether the resource is drained, that is
+// no client heartbeat in the DrainQuiet, or the DrainSecond elapses. Resources are drained at once if the DrainSecond is zero.
+func (c *Controller) Drain(resource *types.Resource, cp CallParam) bool {
+	if cp.DrainSecond <= 0 {
+		return true
+	}
+
+	since, ok := drainingSince(*resource)
+	if !ok {
+		log.Printf("instance %q starts draining\n", resource.ID)
+		if resource.Meta == nil {
+			resource.Meta = types.Meta{}
+		}
+		resource.Meta["draining"] = time.Now().Format(time.RFC3339)
+		return false
+	}
+	if time.Since(since) > time.Duration(cp.DrainSecond)*time.Second {
+		log.Printf("instance %q exceeds DrainSecond %d\n", resource.ID, cp.DrainSecond)
+		return true
+	}
+	if time.Since(since) < DrainQuiet {
+		return false
+	}
+	for _, client := range resource.Clients {
+		if time.Since(client.Heartbeat) < DrainQuiet {
+			return false
+		}
+	}
+	return true
+}
+
+// drainingSince returns when the resource starts draining.
+func drainingSince(res types.Resource) (time.Time, bool) {
+	s, ok := res.Meta["draining"].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t, err == nil
+}
@@ -0,0 +1,134 @@
+package pgplugin
+
+import (
+	"log"
+	"time"
+
+	"github.com/rueian/godemand-example/tools"
+	"github.com/rueian/godemand/types"
+	"google.golang.org/api/compute/v1"
+)
+
+// zones returns the InstanceZone followed by the FallbackZones.
+func (cp CallParam) zones() []string {
+	return dedupe(append([]string{cp.InstanceZone}, cp.FallbackZones...))
+}
+
+// machines returns the machine type followed by the FallbackMachines.
+func (cp CallParam) machines() []string {
+	return dedupe(append([]string{cp.machine()}, cp.FallbackMachines...))
+}
+
+// placed returns the CallParam in the zone of the resource, which may be one of the FallbackZones.
+func (cp CallParam) placed(resource types.Resource) CallParam {
+	if zone := metaStr(resource.Meta, "zone"); zone != "" {
+		cp.InstanceZone = zone
+	}
+	return cp
+}
+
+// createInstance creates the instance with the machine types in order, it falls back to the next one on capacity or quota errors.
+// The machine types before the one in the Meta are skipped, they have failed in the operations of the previous attempts.
+func (c *Controller) createInstance(service Provider, resource *types.Resource, d *compute.Disk, cp CallParam, params map[string]interface{}) (err error) {
+	machines := cp.machines()
+	for i, machine := range machines {
+		if machine == metaStr(resource.Meta, "machine") {
+			machines = machines[i:]
+		}
+	}
+	for _, machine := range machines {
+		mcp := cp
+		mcp.InstanceMachine, mcp.InstanceCPUs, mcp.InstanceMemoryMB = machine, 0, 0
+		instance := makeInstance(resource.ID, d, mcp, notifyAttributes(*resource, cp), params, c.StartupFactory)
+		var op string
+		if ops, ok := service.(OperationProvider); ok {
+			op, err = ops.InsertInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, instance, 5)
+		} else {
+			err = service.CreateInstanceRetry(cp.InstanceProjectID, cp.InstanceZone, instance, 5)
+		}
+		if err == nil {
+			if resource.Meta == nil {
+				resource.Meta = types.Meta{}
+			}
+			resource.Meta["zone"] = cp.InstanceZone
+			resource.Meta["machine"] = machine
+			if op != "" {
+				resource.Meta["operation"] = op
+			}
+			return nil
+		}
+		class := tools.ClassifyError(err)
+		if !class.Fallback() {
+			return err
+		}
+		log.Printf("fail to create instance %q of %q in %q due to %s: %s\n", resource.ID, machine, cp.InstanceZone, class, err.Error())
+	}
+	return err
+}
+
+// instanceFailed moves the booting resource whose insert operation failed back to pending, with the next machine type
+// or in the next zone on capacity or quota errors, otherwise with the same machine type again.
+func (c *Controller) instanceFailed(service Provider, resource types.Resource, zones []string, cp CallParam, ev *AuditEvent, err error) (types.Resource, error) {
+	class := tools.ClassifyError(err)
+	machine := metaStr(resource.Meta, "machine")
+	log.Printf("fail to create instance %q of %q in %q due to %s: %s\n", resource.ID, machine, cp.InstanceZone, class, err.Error())
+
+	delete(resource.Meta, "operation")
+	resource.State = types.ResourcePending
+	resource.LastSynced = time.Now()
+	if !class.Fallback() {
+		ev.Reason = "instance-failed"
+		return resource, nil
+	}
+	machines := cp.machines()
+	for i, m := range machines[:len(machines)-1] {
+		if m == machine {
+			resource.Meta["machine"] = machines[i+1]
+			ev.Reason = "machine-fallback"
+			return resource, nil
+		}
+	}
+	return c.nextZone(service, resource, zones, cp, ev)
+}
+
+// nextZone moves the pending resource to the zone after its current one, the disk is restored from the snapshot
+// again in there. The resource is deleted if there is no more zone.
+func (c *Controller) nextZone(service Provider, resource types.Resource, zones []string, cp CallParam, ev *AuditEvent) (types.Resource, error) {
+	if err := service.DeleteDiskRetry(cp.InstanceProjectID, cp.InstanceZone, resource.ID, 5); err != nil {
+		log.Printf("fail to delete disk %q in %q: %s\n", resource.ID, cp.InstanceZone, err.Error())
+		return types.Resource{}, err
+	}
+
+	next := 0
+	for i, zone := range zones {
+		if zone == cp.InstanceZone {
+			next = i + 1
+		}
+	}
+	if next >= len(zones) {
+		log.Printf("no more zone for instance %q, mark deleted\n", resource.ID)
+		ev.Reason = "capacity-exhausted"
+		resource.State = types.ResourceDeleted
+	} else {
+		log.Printf("instance %q falls back to zone %q\n", resource.ID, zones[next])
+		if resource.Meta == nil {
+			resource.Meta = types.Meta{}
+		}
+		resource.Meta["zone"] = zones[next]
+		resource.Meta["machine"] = cp.machines()[0]
+		ev.Reason = "zone-fallback"
+	}
+	resource.LastSynced = time.Now()
+	return resource, nil
+}
+
+func dedupe(items []string) (deduped []string) {
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		if item != "" && !seen[item] {
+			seen[item] = true
+			deduped = append(deduped, item)
+		}
+	}
+	return
+}
@@ -0,0 +1,154 @@
+package pgplugin
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Provisioning models of the instances, the default one is preemptible.
+const (
+	ProvisioningPreemptible = "preemptible"
+	ProvisioningOnDemand    = "on-demand"
+	ProvisioningSpot        = "spot"
+)
+
+var DiskTypes = map[string]bool{
+	"pd-standard": true,
+	"pd-ssd":      true,
+	"pd-balanced": true,
+}
+
+var DefaultServiceAccountScopes = []string{"https://www.googleapis.com/auth/cloud-platform"}
+
+var (
+	tagPattern        = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+	labelKeyPattern   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValuePattern = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+)
+
+// Validate checks the instance settings of the CallParam, so that an invalid pool is rejected before any insert call.
+func (cp CallParam) Validate() error {
+	switch cp.Provisioning {
+	case "", ProvisioningPreemptible, ProvisioningOnDemand, ProvisioningSpot:
+	default:
+		return fmt.Errorf("unknown provisioning %q", cp.Provisioning)
+	}
+	if _, err := cp.MachineType(); err != nil {
+		return err
+	}
+	for _, zone := range cp.zones() {
+		if len(strings.Split(zone, "-")) < 3 {
+			return fmt.Errorf("invalid zone %q", zone)
+		}
+	}
+	if cp.DiskType != "" && !DiskTypes[cp.DiskType] {
+		return fmt.Errorf("unknown disk type %q", cp.DiskType)
+	}
+	if cp.DiskSizeGb < 0 {
+		return fmt.Errorf("invalid disk size %d", cp.DiskSizeGb)
+	}
+	if err := cp.checkPrices(); err != nil {
+		return err
+	}
+	if cp.ServiceAccount == "" && len(cp.ServiceAccountScopes) > 0 {
+		return fmt.Errorf("service account scopes %v without a service account", cp.ServiceAccountScopes)
+	}
+	for _, tag := range cp.NetworkTags {
+		if !tagPattern.MatchString(tag) {
+			return fmt.Errorf("invalid network tag %q", tag)
+		}
+	}
+	for k, v := range cp.Labels {
+		if k == "godemand" {
+			return fmt.Errorf("label %q is reserved", k)
+		}
+		if !labelKeyPattern.MatchString(k) || !labelValuePattern.MatchString(v) {
+			return fmt.Errorf("invalid label %q: %q", k, v)
+		}
+	}
+	return nil
+}
+
+// MachineType returns the custom machine type if the InstanceCPUs and InstanceMemoryMB are given, otherwise the InstanceMachine.
+// The custom ones follow the N1 rules: 1 or an even number of vCPUs and 0.9 to 6.5 GB memory per vCPU in multiples of 256 MB.
+func (cp CallParam) MachineType() (string, error) {
+	if cp.InstanceCPUs == 0 && cp.InstanceMemoryMB == 0 {
+		return cp.InstanceMachine, nil
+	}
+	if cp.InstanceCPUs <= 0 || cp.InstanceMemoryMB <= 0 {
+		return "", fmt.Errorf("custom machine needs both InstanceCPUs and InstanceMemoryMB, got %d and %d", cp.InstanceCPUs, cp.InstanceMemoryMB)
+	}
+	if cp.InstanceCPUs > 1 && cp.InstanceCPUs%2 != 0 || cp.InstanceCPUs > 96 {
+		return "", fmt.Errorf("custom machine needs 1 or an even number of vCPUs up to 96, got %d", cp.InstanceCPUs)
+	}
+	if cp.InstanceMemoryMB%256 != 0 || cp.InstanceMemoryMB*10 < cp.InstanceCPUs*9216 || cp.InstanceMemoryMB > cp.InstanceCPUs*6656 {
+		return "", fmt.Errorf("custom machine needs 0.9 to 6.5 GB memory per vCPU in multiples of 256 MB, got %d MB for %d vCPUs", cp.InstanceMemoryMB, cp.InstanceCPUs)
+	}
+	return fmt.Sprintf("custom-%d-%d", cp.InstanceCPUs, cp.InstanceMemoryMB), nil
+}
+
+// scheduling returns the scheduling of the Provisioning. The spot instances are stopped instead of deleted when
+// they are preempted, so that they can be started again like the preemptible ones.
+func (cp CallParam) scheduling() *compute.Scheduling {
+	switch cp.Provisioning {
+	case ProvisioningOnDemand:
+		return &compute.Scheduling{ProvisioningModel: "STANDARD"}
+	case ProvisioningSpot:
+		restart := false
+		return &compute.Scheduling{
+			ProvisioningModel:         "SPOT",
+			InstanceTerminationAction: "STOP",
+			AutomaticRestart:          &restart,
+			OnHostMaintenance:         "TERMINATE",
+		}
+	}
+	return &compute.Scheduling{Preemptible: true}
+}
+
+// diskType returns the DiskType, which is pd-standard by default as gcp.
+func (cp CallParam) diskType() string {
+	if cp.DiskType == "" {
+		return "pd-standard"
+	}
+	return cp.DiskType
+}
+
+// machine returns the machine type of valid CallParam.
+func (cp CallParam) machine() string {
+	m, _ := cp.MachineType()
+	return m
+}
+
+// labels returns the Labels of the CallParam with the reserved "godemand" one.
+func (cp CallParam) labels() map[string]string {
+	labels := map[string]string{"godemand": cp.SnapshotPrefix}
+	for k, v := range cp.Labels {
+		if k != "godemand" {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// networks returns the full paths of the Network and Subnetwork, the bare names are in the instance project and region.
+// The Subnetwork defaults to the name of the Network, which is the one of the auto mode networks.
+func (cp CallParam) networks(region string) (string, string) {
+	network, subnetwork := cp.Network, cp.Subnetwork
+	if network == "" {
+		network = "default"
+	}
+	if subnetwork == "" {
+		subnetwork = path.Base(network)
+	}
+	if !strings.Contains(network, "/") {
+		network = "projects/" + cp.InstanceProjectID + "/global/networks/" + network
+	}
+	if !strings.Contains(subnetwork, "/") {
+		subnetwork = "regions/" + region + "/subnetworks/" + subnetwork
+	}
+	return network, subnetwork
+}
@@ -0,0 +1,47 @@
+package pgplugin
+
+import (
+	"google.golang.org/api/compute/v1"
+)
+
+// The provider interfaces reuse the compute types as the common vocabulary of the state machine,
+// therefore the backends should report not found errors as *googleapi.Error with http.StatusNotFound.
+
+type InstanceProvider interface {
+	FindInstanceRetry(projectID, zoneID, instanceID string, times int) (*compute.Instance, error)
+	CreateInstanceRetry(projectID, zoneID string, instance *compute.Instance, times int) error
+	StartInstanceRetry(projectID, zoneID, instanceID string, times int) error
+	TerminateInstanceRetry(projectID, zoneID, instanceID string, times int) error
+	DeleteInstanceRetry(projectID, zoneID, instanceID string, times int) error
+}
+
+// OperationProvider is optionally implemented by the backends inserting instances asynchronously, the name of
+// the insert operation is kept in the resource Meta and polled on the later syncs instead of blocking the syncer.
+type OperationProvider interface {
+	InsertInstanceRetry(projectID, zoneID string, instance *compute.Instance, times int) (string, error)
+	FindOperation(projectID, zoneID, name string) (*compute.Operation, error)
+}
+
+type DiskProvider interface {
+	FindDisk(projectID, zoneID, diskID string) (*compute.Disk, error)
+	FindDiskRetry(projectID, zoneID, diskID string, times int) (*compute.Disk, error)
+	CreateDiskRetry(projectID, zoneID string, disk *compute.Disk, times int) error
+	DeleteDiskRetry(projectID, zoneID, diskID string, times int) error
+}
+
+type SnapshotProvider interface {
+	FindLatestSnapshot(projectID, prefix string) (*compute.Snapshot, error)
+}
+
+type InstanceProber interface {
+	Addr(instance *compute.Instance, port string) string
+	Poke(instance *compute.Instance, port string, times int) (bool, error)
+	GetLoad(addr string) (float64, float64, float64, error)
+}
+
+type Provider interface {
+	InstanceProvider
+	InstanceProber
+	DiskProvider
+	SnapshotProvider
+}
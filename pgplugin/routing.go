@@ -0,0 +1,84 @@
+package pgplugin
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/rueian/godemand-example/tools"
+	"github.com/rueian/godemand/types"
+)
+
+const (
+	RoutingNewestFirst      = "newest-first"
+	RoutingLeastLoaded      = "least-loaded"
+	RoutingLeastConnections = "least-connections"
+	RoutingRoundRobin       = "round-robin"
+	RoutingConsistentHash   = "consistent-hash"
+)
+
+// Candidate is a serving resource which is not overloaded, with its 1-minute load.
+type Candidate struct {
+	Resource types.Resource
+	Load     float64
+}
+
+// RoutingPolicy picks one of the candidates, which are sorted from the newest one.
+type RoutingPolicy func(c *Controller, poolID string, candidates []Candidate, params map[string]interface{}) types.Resource
+
+var RoutingPolicies = map[string]RoutingPolicy{
+	RoutingNewestFirst: func(c *Controller, poolID string, candidates []Candidate, params map[string]interface{}) types.Resource {
+		return candidates[0].Resource
+	},
+	RoutingLeastLoaded: func(c *Controller, poolID string, candidates []Candidate, params map[string]interface{}) types.Resource {
+		picked := candidates[0]
+		for _, candidate := range candidates[1:] {
+			if candidate.Load < picked.Load {
+				picked = candidate
+			}
+		}
+		return picked.Resource
+	},
+	RoutingLeastConnections: func(c *Controller, poolID string, candidates []Candidate, params map[string]interface{}) types.Resource {
+		picked, min := candidates[0], activeClients(candidates[0].Resource)
+		for _, candidate := range candidates[1:] {
+			if n := activeClients(candidate.Resource); n < min {
+				picked, min = candidate, n
+			}
+		}
+		return picked.Resource
+	},
+	RoutingRoundRobin: func(c *Controller, poolID string, candidates []Candidate, params map[string]interface{}) types.Resource {
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Resource.ID < candidates[j].Resource.ID })
+
+		counter, _ := c.RoundRobin.LoadOrStore(poolID, new(uint64))
+		n := atomic.AddUint64(counter.(*uint64), 1)
+		return candidates[n%uint64(len(candidates))].Resource
+	},
+	RoutingConsistentHash: func(c *Controller, poolID string, candidates []Candidate, params map[string]interface{}) types.Resource {
+		key := tools.GetStr(params, "ClientUser", "") + "/" + tools.GetStr(params, "ClientDatabase", "")
+
+		// rendezvous hashing only moves the clients of the changed resources
+		var picked types.Resource
+		var max uint64
+		for _, candidate := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			h.Write([]byte(candidate.Resource.ID))
+			if w := h.Sum64(); picked.ID == "" || w > max {
+				picked, max = candidate.Resource, w
+			}
+		}
+		return picked
+	},
+}
+
+func activeClients(res types.Resource) (n int) {
+	for _, c := range res.Clients {
+		if time.Since(c.Heartbeat) < 1*time.Minute {
+			n++
+		}
+	}
+	return
+}
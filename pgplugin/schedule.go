@@ -0,0 +1,44 @@
+package pgplugin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rueian/godemand-example/tools"
+)
+
+// Schedule overrides the lifetimes of a pool during its Window, or shuts down all instances of the pool after draining,
+// the pending ones are not booted until the shutdown ends.
+// Zero values keep the pool's own ones.
+type Schedule struct {
+	Window        string
+	MaxIdleSecond int
+	MaxServSecond int
+	MaxLifeSecond int
+	Shutdown      bool
+}
+
+// Scheduled returns the CallParam overridden by the first schedule containing the t.
+func (cp CallParam) Scheduled(t time.Time) (CallParam, error) {
+	for _, s := range cp.Schedules {
+		active, err := tools.InSchedule(s.Window, cp.TimeZone, t)
+		if err != nil {
+			return cp, fmt.Errorf("invalid schedule window %q: %w", s.Window, err)
+		}
+		if !active {
+			continue
+		}
+		if s.MaxIdleSecond > 0 {
+			cp.MaxIdleSecond = s.MaxIdleSecond
+		}
+		if s.MaxServSecond > 0 {
+			cp.MaxServSecond = s.MaxServSecond
+		}
+		if s.MaxLifeSecond > 0 {
+			cp.MaxLifeSecond = s.MaxLifeSecond
+		}
+		cp.Shutdown = s.Shutdown
+		break
+	}
+	return cp, nil
+}
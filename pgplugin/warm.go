@@ -0,0 +1,92 @@
+package pgplugin
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rueian/godemand-example/tools"
+	"github.com/rueian/godemand/plugin"
+	"github.com/rueian/godemand/types"
+)
+
+const (
+	WarmServing    = "serving"
+	WarmTerminated = "terminated"
+)
+
+// Scale creates an instance when the pool has less than MinInstances instances,
+// or has less than WarmInstances instances without clients during the WarmSchedule.
+// The warm instances are kept in the WarmState until they are taken by clients.
+func (c *Controller) Scale(pool types.ResourcePool, resources []types.Resource, cp CallParam) (types.Resource, error) {
+	if err := c.CheckBudget(pool.ID, cp); err != nil {
+		return types.Resource{}, err
+	}
+
+	if len(resources) < cp.MinInstances {
+		if cp.MaxInstances > 0 && len(resources) >= cp.MaxInstances {
+			return types.Resource{}, fmt.Errorf("pool %q reached MaxInstances %d before MinInstances %d: %w", pool.ID, cp.MaxInstances, cp.MinInstances, plugin.AcquireLaterErr)
+		}
+		log.Printf("pool %q has %d instances less than MinInstances %d, scale out\n", pool.ID, len(resources), cp.MinInstances)
+		return newResource(pool, cp), nil
+	}
+
+	if cp.WarmInstances > 0 {
+		if cp.WarmState != WarmServing && cp.WarmState != WarmTerminated {
+			return types.Resource{}, fmt.Errorf("unknown WarmState %q of pool %q", cp.WarmState, pool.ID)
+		}
+
+		active, err := tools.InSchedule(cp.WarmSchedule, cp.TimeZone, time.Now())
+		if err != nil {
+			return types.Resource{}, fmt.Errorf("invalid WarmSchedule of pool %q: %w", pool.ID, err)
+		}
+
+		spare := 0
+		for _, res := range resources {
+			if activeClients(res) == 0 && warmed(res, cp.WarmState) {
+				spare++
+			}
+		}
+
+		if active && spare < cp.WarmInstances {
+			if cp.MaxInstances > 0 && len(resources) >= cp.MaxInstances {
+				return types.Resource{}, fmt.Errorf("pool %q reached MaxInstances %d: %w", pool.ID, cp.MaxInstances, plugin.AcquireLaterErr)
+			}
+			log.Printf("pool %q has %d warm instances less than WarmInstances %d, scale out\n", pool.ID, spare, cp.WarmInstances)
+			res := newResource(pool, cp)
+			res.Meta = types.Meta{"warm": cp.WarmState}
+			return res, nil
+		}
+	}
+
+	return types.Resource{}, fmt.Errorf("pool %q has %d instances: %w", pool.ID, len(resources), ScaleSatisfiedErr)
+}
+
+// warmed reports whether the resource is in the warm state, or is a warm one on its way to the state.
+func warmed(res types.Resource, state string) bool {
+	if warm, ok := res.Meta["warm"].(string); ok && warm == state {
+		return true
+	}
+	switch state {
+	case WarmServing:
+		return res.State == types.ResourceServing
+	case WarmTerminated:
+		return res.State == types.ResourceTerminated || res.State == types.ResourceTerminating
+	}
+	return false
+}
+
+// taken clears the "warm" Meta of the resource handed to a client, so that it is not stopped again as a warm one.
+func taken(res types.Resource) types.Resource {
+	if _, ok := res.Meta["warm"]; !ok {
+		return res
+	}
+	meta := make(types.Meta, len(res.Meta))
+	for k, v := range res.Meta {
+		if k != "warm" {
+			meta[k] = v
+		}
+	}
+	res.Meta = meta
+	return res
+}
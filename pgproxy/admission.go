@@ -0,0 +1,165 @@
+package pgproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var AdmissionFullErr = errors.New("too many clients are waiting for the pool")
+var AdmissionTimeoutErr = errors.New("timeout waiting for the admission of the pool")
+
+// Admission limits the clients requesting resources of a pool at the same time. The others wait in a FIFO queue
+// bounded by the MaxWaiters and the MaxWait, so that a burst of clients against a cold pool does not hammer godemand.
+type Admission struct {
+	// Concurrency is the max number of the clients requesting resources of a pool at the same time.
+	Concurrency int
+	// MaxWaiters is the max number of the clients waiting in the queue of a pool, unlimited if zero.
+	MaxWaiters int
+	// MaxWait is the max time of a client waiting in the queue, unlimited if zero.
+	MaxWait time.Duration
+
+	mu    sync.Mutex
+	pools map[string]*admissionQueue
+}
+
+func NewAdmission(concurrency, maxWaiters int, maxWait time.Duration) *Admission {
+	return &Admission{Concurrency: concurrency, MaxWaiters: maxWaiters, MaxWait: maxWait, pools: map[string]*admissionQueue{}}
+}
+
+type admissionQueue struct {
+	active  int
+	waiters []chan struct{}
+
+	admitted int64
+	rejected int64
+	timeouts int64
+	maxDepth int
+}
+
+// AdmissionStat is the queue of a pool.
+type AdmissionStat struct {
+	Pool     string `json:"pool"`
+	Active   int    `json:"active"`
+	Waiting  int    `json:"waiting"`
+	MaxDepth int    `json:"max_waiting"`
+	Admitted int64  `json:"admitted"`
+	Rejected int64  `json:"rejected"`
+	Timeouts int64  `json:"timeouts"`
+}
+
+// Acquire waits for the turn of the client to request resources of the pool, the release must be called after
+// the request is done. It admits the client immediately if the admission is nil.
+func (a *Admission) Acquire(ctx context.Context, pool string) (release func(), err error) {
+	if a == nil {
+		return func() {}, nil
+	}
+
+	a.mu.Lock()
+	q, ok := a.pools[pool]
+	if !ok {
+		q = &admissionQueue{}
+		a.pools[pool] = q
+	}
+	if q.active < a.Concurrency && len(q.waiters) == 0 {
+		q.active++
+		q.admitted++
+		a.mu.Unlock()
+		return a.releaser(q), nil
+	}
+	if a.MaxWaiters > 0 && len(q.waiters) >= a.MaxWaiters {
+		q.rejected++
+		a.mu.Unlock()
+		return nil, AdmissionFullErr
+	}
+	turn := make(chan struct{})
+	q.waiters = append(q.waiters, turn)
+	if len(q.waiters) > q.maxDepth {
+		q.maxDepth = len(q.waiters)
+	}
+	a.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if a.MaxWait > 0 {
+		timer := time.NewTimer(a.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-turn:
+		return a.releaser(q), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = AdmissionTimeoutErr
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, w := range q.waiters {
+		if w == turn {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			if err == AdmissionTimeoutErr {
+				q.timeouts++
+			}
+			return nil, err
+		}
+	}
+	// the turn is given while leaving, pass it to the next one
+	a.next(q)
+	return nil, err
+}
+
+func (a *Admission) releaser(q *admissionQueue) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			a.next(q)
+			a.mu.Unlock()
+		})
+	}
+}
+
+// next gives the slot of a leaving client to the first waiter.
+func (a *Admission) next(q *admissionQueue) {
+	if len(q.waiters) > 0 {
+		close(q.waiters[0])
+		q.waiters = q.waiters[1:]
+		q.admitted++
+		return
+	}
+	q.active--
+}
+
+// Snapshot returns the queues sorted by the pool.
+func (a *Admission) Snapshot() []AdmissionStat {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats := make([]AdmissionStat, 0, len(a.pools))
+	for pool, q := range a.pools {
+		stats = append(stats, AdmissionStat{
+			Pool:     pool,
+			Active:   q.active,
+			Waiting:  len(q.waiters),
+			MaxDepth: q.maxDepth,
+			Admitted: q.admitted,
+			Rejected: q.rejected,
+			Timeouts: q.timeouts,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Pool < stats[j].Pool })
+	return stats
+}
+
+// ServeHTTP responds the queues in json.
+func (a *Admission) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.Snapshot())
+}
@@ -0,0 +1,58 @@
+package pgproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := NewAdmission(1, 2, 200*time.Millisecond)
+
+	release, err := a.Acquire(context.Background(), "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the waiters are admitted in order
+	order := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		i := i
+		go func() {
+			r, err := a.Acquire(context.Background(), "p")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+			time.Sleep(10 * time.Millisecond)
+			r()
+		}()
+		for len(a.Snapshot()) == 0 || a.Snapshot()[0].Waiting != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if _, err := a.Acquire(context.Background(), "p"); err != AdmissionFullErr {
+		t.Fatalf("expect AdmissionFullErr, got %v", err)
+	}
+	if _, err := a.Acquire(context.Background(), "other"); err != nil {
+		t.Fatalf("expect other pools not affected, got %v", err)
+	}
+
+	release()
+	release()
+	if first, second := <-order, <-order; first != 0 || second != 1 {
+		t.Fatalf("expect the FIFO order, got %d, %d", first, second)
+	}
+
+	release, _ = a.Acquire(context.Background(), "p")
+	if _, err := a.Acquire(context.Background(), "p"); err != AdmissionTimeoutErr {
+		t.Fatalf("expect AdmissionTimeoutErr, got %v", err)
+	}
+	release()
+
+	stat := a.Snapshot()[1]
+	if stat.Pool != "p" || stat.Active != 0 || stat.Waiting != 0 || stat.MaxDepth != 2 || stat.Admitted != 4 || stat.Rejected != 1 || stat.Timeouts != 1 {
+		t.Fatalf("unexpected stat %+v", stat)
+	}
+}
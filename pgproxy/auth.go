@@ -0,0 +1,417 @@
+package pgproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rueian/pgbroker/message"
+	"gopkg.in/yaml.v2"
+)
+
+// Credential is a user of the proxy. The Password is plain, a md5 secret like "md5<hex>",
+// or a SCRAM-SHA-256 secret as stored by postgres. The BackendUser and the BackendPassword are used
+// to authenticate to the backends, which are the user itself and the plain Password by default.
+type Credential struct {
+	Password        string `yaml:"password"`
+	BackendUser     string `yaml:"backend_user"`
+	BackendPassword string `yaml:"backend_password"`
+
+	scram *scramKeys
+	md5   string
+}
+
+func (c *Credential) prepare(user string) error {
+	if c.BackendUser == "" {
+		c.BackendUser = user
+	}
+	switch pw := c.Password; {
+	case strings.HasPrefix(pw, scramMechanism+"$"):
+		keys, err := parseScramKeys(pw)
+		if err != nil {
+			return fmt.Errorf("user %q: %w", user, err)
+		}
+		c.scram = &keys
+	case strings.HasPrefix(pw, "md5") && len(pw) == 35:
+		c.md5 = pw[3:]
+	case pw == "":
+		return fmt.Errorf("user %q has no password", user)
+	default:
+		keys := newScramKeys(pw, randomBytes(16), scramIterations)
+		c.scram, c.md5 = &keys, md5Secret(user, pw)
+		if c.BackendPassword == "" {
+			c.BackendPassword = pw
+		}
+	}
+	return nil
+}
+
+// Authenticator authenticates clients by SCRAM-SHA-256 or md5 before they are accepted by the pgbroker,
+// so that the resources are only requested by authenticated clients.
+type Authenticator struct {
+	// Timeout limits the time of clients to complete the authentication.
+	Timeout time.Duration
+
+	mu       sync.RWMutex
+	users    map[string]*Credential
+	sessions sync.Map
+}
+
+func NewAuthenticator() *Authenticator {
+	return &Authenticator{Timeout: 30 * time.Second, users: map[string]*Credential{}}
+}
+
+func (a *Authenticator) Set(users map[string]Credential) error {
+	prepared := make(map[string]*Credential, len(users))
+	for user, cred := range users {
+		cred := cred
+		if err := cred.prepare(user); err != nil {
+			return err
+		}
+		prepared[user] = &cred
+	}
+	a.mu.Lock()
+	a.users = prepared
+	a.mu.Unlock()
+	return nil
+}
+
+// Load sets the users from the credential file, which is either a yaml with a "users" section,
+// or a htpasswd like file of "user:password[:backend_user:backend_password]" lines.
+func (a *Authenticator) Load(path string) error {
+	users, err := LoadCredentials(path)
+	if err != nil {
+		return err
+	}
+	return a.Set(users)
+}
+
+// Watch reloads the users from the file periodically, the current users are kept if the file is broken.
+func (a *Authenticator) Watch(ctx context.Context, path string, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if err := a.Load(path); err != nil {
+			log.Printf("fail to reload credential file %q: %v\n", path, err)
+		}
+	}
+}
+
+func LoadCredentials(path string) (map[string]Credential, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f struct {
+		Users map[string]Credential `yaml:"users"`
+	}
+	if err := yaml.Unmarshal(b, &f); err == nil && f.Users != nil {
+		return f.Users, nil
+	}
+
+	users := make(map[string]Credential)
+	for i, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		n := 2
+		if len(fields) > 1 && strings.HasPrefix(fields[1], scramMechanism+"$") {
+			// the SCRAM-SHA-256 secret has two ":" in it
+			n = 4
+		}
+		if len(fields) < n || (len(fields) != n && len(fields) != n+2) {
+			return nil, fmt.Errorf("malformed line %d of credential file %q", i+1, path)
+		}
+		cred := Credential{Password: strings.Join(fields[1:n], ":")}
+		if len(fields) == n+2 {
+			cred.BackendUser, cred.BackendPassword = fields[n], fields[n+1]
+		}
+		users[fields[0]] = cred
+	}
+	return users, nil
+}
+
+func (a *Authenticator) lookup(user string) (*Credential, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	cred, ok := a.users[user]
+	return cred, ok
+}
+
+// Session returns the credential of the authenticated client.
+func (a *Authenticator) Session(clientAddr net.Addr) (*Credential, bool) {
+	cred, ok := a.sessions.Load(clientAddr.String())
+	if !ok {
+		return nil, false
+	}
+	return cred.(*Credential), true
+}
+
+// Listener authenticates the clients of the listener, the authenticated startup messages are replayed to the pgbroker.
+func (a *Authenticator) Listener(ln net.Listener) net.Listener {
+	return newHandshakeListener(ln, a.authenticate)
+}
+
+func (a *Authenticator) authenticate(conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(a.Timeout))
+	rd := bufio.NewReader(conn)
+
+	var startup []byte
+	for {
+		head := make([]byte, 4)
+		if _, err := io.ReadFull(rd, head); err != nil {
+			return conn, err
+		}
+		n := binary.BigEndian.Uint32(head)
+		if n < 8 || n > 10000 {
+			return conn, fmt.Errorf("invalid length %d of startup message", n)
+		}
+		startup = make([]byte, n)
+		copy(startup, head)
+		if _, err := io.ReadFull(rd, startup[4:]); err != nil {
+			return conn, err
+		}
+		if len(startup) != 8 {
+			break
+		}
+		// the encryption requests are rejected here if they are not handled by the TLSListener
+		if _, err := conn.Write([]byte{'N'}); err != nil {
+			return conn, err
+		}
+	}
+
+	m, err := message.ReadStartupMessage(startup[4:])
+	if err != nil {
+		io.Copy(conn, errorResp("FATAL", "08P01", err.Error()).Reader())
+		return conn, err
+	}
+	replay := &authedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(startup), rd), auth: a}
+	params, ok := m.(*message.StartupMessage)
+	if !ok {
+		// the cancel request is handled by the pgbroker
+		conn.SetDeadline(time.Time{})
+		return replay, nil
+	}
+
+	user := params.Parameters["user"]
+	cred, ok := a.lookup(user)
+	if !ok {
+		// run the exchange with a mock credential to not reveal the user doesn't exist
+		keys := scramKeys{iter: scramIterations, salt: randomBytes(16), storedKey: randomBytes(32), serverKey: randomBytes(32)}
+		cred = &Credential{scram: &keys}
+	}
+
+	if ok, err = a.exchange(conn, rd, cred); err != nil || !ok {
+		io.Copy(conn, errorResp("FATAL", "28P01", fmt.Sprintf("password authentication failed for user %q", user)).Reader())
+		if err == nil {
+			err = fmt.Errorf("password authentication failed for user %q", user)
+		}
+		return conn, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	replay.addr = conn.RemoteAddr().String()
+	a.sessions.Store(replay.addr, cred)
+	return replay, nil
+}
+
+func (a *Authenticator) exchange(conn net.Conn, rd *bufio.Reader, cred *Credential) (bool, error) {
+	if cred.scram == nil {
+		salt := randomBytes(4)
+		io.Copy(conn, (&message.AuthenticationMD5Password{ID: authMD5, Salt: salt}).Reader())
+		msg, err := readMessage(rd)
+		if err != nil {
+			return false, err
+		}
+		if msg[0] != 'p' {
+			return false, errors.New("password message is expected")
+		}
+		return subtle.ConstantTimeCompare([]byte(message.ReadPasswordMessage(msg[5:]).Password), []byte(md5Response(cred.md5, salt))) == 1, nil
+	}
+
+	s := &scramServer{keys: *cred.scram}
+	io.Copy(conn, (&message.AuthenticationSASL{ID: authSASL, Mechanisms: []string{scramMechanism}}).Reader())
+	msg, err := readMessage(rd)
+	if err != nil {
+		return false, err
+	}
+	if msg[0] != 'p' {
+		return false, errors.New("SASL initial response is expected")
+	}
+	initial := message.ReadSASLInitialResponse(msg[5:])
+	if initial.Mechanism != scramMechanism {
+		return false, fmt.Errorf("unsupported SASL mechanism %q", initial.Mechanism)
+	}
+	serverFirst, err := s.first(string(initial.Response.DataBytes()))
+	if err != nil {
+		return false, err
+	}
+	io.Copy(conn, (&message.AuthenticationSASLContinue{ID: authSASLContinue, Data: []byte(serverFirst)}).Reader())
+
+	if msg, err = readMessage(rd); err != nil {
+		return false, err
+	}
+	if msg[0] != 'p' {
+		return false, errors.New("SASL response is expected")
+	}
+	serverFinal, ok, err := s.final(string(message.ReadSASLResponse(msg[5:]).Data))
+	if err != nil || !ok {
+		return false, err
+	}
+	_, err = io.Copy(conn, (&message.AuthenticationSASLFinal{ID: authSASLFinal, Data: []byte(serverFinal)}).Reader())
+	return err == nil, err
+}
+
+// authedConn replays the startup message of the authenticated client, and ends the session on close.
+type authedConn struct {
+	net.Conn
+	r    io.Reader
+	auth *Authenticator
+	addr string
+}
+
+func (c *authedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *authedConn) Close() error {
+	if c.addr != "" {
+		c.auth.sessions.Delete(c.addr)
+	}
+	return c.Conn.Close()
+}
+
+// BackendAuthConn authenticates to the backend with the mapped credential of the client instead of the client itself.
+// The startup message is rewritten with the backend user, and the authentication requests of the backend are answered
+// by the proxy, so that the client only receives the final AuthenticationOk or ErrorResponse.
+type BackendAuthConn struct {
+	net.Conn
+	User     string
+	Password string
+	// SkipAuthenticationOk drops the AuthenticationOk of the backend if the client already received one.
+	SkipAuthenticationOk bool
+
+	rd      *bufio.Reader
+	in      bytes.Buffer
+	pending bytes.Buffer
+	started bool
+}
+
+func NewBackendAuthConn(conn net.Conn, user, password string) *BackendAuthConn {
+	return &BackendAuthConn{Conn: conn, User: user, Password: password, rd: bufio.NewReader(conn)}
+}
+
+func (c *BackendAuthConn) Write(b []byte) (int, error) {
+	if c.started {
+		return c.Conn.Write(b)
+	}
+	c.in.Write(b)
+	msg, ok := nextMessage(&c.in, true)
+	if !ok {
+		return len(b), nil
+	}
+	c.started = true
+
+	m, err := message.ReadStartupMessage(msg[4:])
+	if err != nil {
+		return 0, err
+	}
+	if startup, ok := m.(*message.StartupMessage); ok {
+		startup.Parameters["user"] = c.User
+		_, err = io.Copy(c.Conn, startup.Reader())
+	} else {
+		_, err = c.Conn.Write(msg)
+	}
+	if err == nil && c.in.Len() > 0 {
+		_, err = c.Conn.Write(c.in.Bytes())
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := m.(*message.StartupMessage); ok {
+		if err := c.authenticate(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// authenticate answers the authentication requests until the AuthenticationOk or the ErrorResponse, which is
+// then read by the client.
+func (c *BackendAuthConn) authenticate() error {
+	var scram *scramClient
+	for {
+		msg, err := readMessage(c.rd)
+		if err != nil {
+			return err
+		}
+		if msg[0] != 'R' {
+			c.pending.Write(msg)
+			if msg[0] == 'E' {
+				return nil
+			}
+			continue
+		}
+
+		var resp io.Reader
+		switch auth := message.ReadAuthentication(msg[5:]).(type) {
+		case *message.AuthenticationOk:
+			if !c.SkipAuthenticationOk {
+				c.pending.Write(msg)
+			}
+			return nil
+		case *message.AuthenticationMD5Password:
+			resp = (&message.PasswordMessage{Password: md5Response(md5Secret(c.User, c.Password), auth.Salt)}).Reader()
+		case *message.AuthenticationCleartextPassword:
+			resp = (&message.PasswordMessage{Password: c.Password}).Reader()
+		case *message.AuthenticationSASL:
+			scram = &scramClient{password: c.Password}
+			resp = (&message.SASLInitialResponse{Mechanism: scramMechanism, Response: message.NewValue([]byte(scram.first()))}).Reader()
+		case *message.AuthenticationSASLContinue:
+			if scram == nil {
+				return ScramErr
+			}
+			final, err := scram.final(string(auth.Data))
+			if err != nil {
+				return err
+			}
+			resp = (&message.SASLResponse{Data: []byte(final)}).Reader()
+		case *message.AuthenticationSASLFinal:
+			if scram == nil || !scram.verify(string(auth.Data)) {
+				return errors.New("fail to verify the SCRAM-SHA-256 signature of the backend")
+			}
+			continue
+		default:
+			return fmt.Errorf("unsupported authentication request of the backend")
+		}
+		if c.Password == "" {
+			return fmt.Errorf("no backend password of user %q", c.User)
+		}
+		if _, err := io.Copy(c.Conn, resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *BackendAuthConn) Read(b []byte) (int, error) {
+	if c.pending.Len() > 0 {
+		return c.pending.Read(b)
+	}
+	return c.rd.Read(b)
+}
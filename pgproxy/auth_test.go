@@ -0,0 +1,197 @@
+package pgproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rueian/pgbroker/message"
+)
+
+func TestScramClient(t *testing.T) {
+	// the example of RFC 7677
+	c := &scramClient{password: "pencil", clientFirst: "n=user,r=rOprNGfwEbeRWgbNEkqO"}
+	final, err := c.final("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final != "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Fatalf("unexpected client final message %q", final)
+	}
+	if !c.verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=") {
+		t.Fatalf("expect the server signature verified")
+	}
+}
+
+func TestLoadCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := newScramKeys("pw", []byte("salt"), 4096).String()
+	for name, content := range map[string]string{
+		"users.yaml": "users:\n  alice:\n    password: '" + secret + "'\n    backend_user: app\n    backend_password: apppw\n  bob:\n    password: pw\n",
+		"users.txt":  "# comment\nalice:" + secret + ":app:apppw\nbob:pw\n",
+	} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(content), 0600)
+
+		a := NewAuthenticator()
+		if err := a.Load(path); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		alice, _ := a.lookup("alice")
+		if alice == nil || alice.scram == nil || alice.scram.String() != secret || alice.BackendUser != "app" || alice.BackendPassword != "apppw" {
+			t.Fatalf("%s: unexpected alice %+v", name, alice)
+		}
+		bob, _ := a.lookup("bob")
+		if bob == nil || bob.scram == nil || bob.md5 != md5Secret("bob", "pw") || bob.BackendUser != "bob" || bob.BackendPassword != "pw" {
+			t.Fatalf("%s: unexpected bob %+v", name, bob)
+		}
+	}
+}
+
+// clientLogin authenticates like a postgres client, which accepts SCRAM-SHA-256 and md5.
+func clientLogin(addr, user, password string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	io.Copy(conn, (&message.StartupMessage{ProtocolVersion: 196608, Parameters: map[string]string{"user": user}}).Reader())
+
+	var scram *scramClient
+	for {
+		msg, err := readMessage(rd)
+		if err != nil {
+			return err
+		}
+		if msg[0] == 'E' {
+			return errors.New(message.ReadErrorResponse(msg[5:]).Fields[2].Value)
+		}
+		switch auth := message.ReadAuthentication(msg[5:]).(type) {
+		case *message.AuthenticationMD5Password:
+			io.Copy(conn, (&message.PasswordMessage{Password: md5Response(md5Secret(user, password), auth.Salt)}).Reader())
+		case *message.AuthenticationSASL:
+			scram = &scramClient{password: password}
+			io.Copy(conn, (&message.SASLInitialResponse{Mechanism: scramMechanism, Response: message.NewValue([]byte(scram.first()))}).Reader())
+		case *message.AuthenticationSASLContinue:
+			final, err := scram.final(string(auth.Data))
+			if err != nil {
+				return err
+			}
+			io.Copy(conn, (&message.SASLResponse{Data: []byte(final)}).Reader())
+		case *message.AuthenticationSASLFinal:
+			if !scram.verify(string(auth.Data)) {
+				return errors.New("fail to verify server signature")
+			}
+		case *message.AuthenticationOk:
+			return nil
+		}
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	a := NewAuthenticator()
+	if err := a.Set(map[string]Credential{
+		"alice": {Password: "pw", BackendUser: "app", BackendPassword: "apppw"},
+		"bob":   {Password: "md5" + md5Secret("bob", "pw")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authLn := a.Listener(ln)
+	defer authLn.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := authLn.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	for _, c := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "pw", true},
+		{"alice", "wrong", false},
+		{"bob", "pw", true},
+		{"bob", "wrong", false},
+		{"nobody", "pw", false},
+	} {
+		result := make(chan error, 1)
+		go func() { result <- clientLogin(ln.Addr().String(), c.user, c.password) }()
+		if !c.ok {
+			if err := <-result; err == nil {
+				t.Fatalf("expect %s with %q rejected", c.user, c.password)
+			}
+			continue
+		}
+
+		conn := <-accepted
+		startup, err := ioutil.ReadAll(io.LimitReader(conn, 4))
+		if err != nil || len(startup) != 4 {
+			t.Fatalf("expect the startup message replayed, got %v %v", startup, err)
+		}
+		cred, ok := a.Session(conn.RemoteAddr())
+		if !ok || (c.user == "alice" && cred.BackendUser != "app") {
+			t.Fatalf("unexpected session of %s: %+v", c.user, cred)
+		}
+		io.Copy(conn, (&message.AuthenticationOk{}).Reader())
+		if err := <-result; err != nil {
+			t.Fatalf("expect %s with %q accepted, got %v", c.user, c.password, err)
+		}
+		conn.Close()
+		if _, ok := a.Session(conn.RemoteAddr()); ok {
+			t.Fatalf("expect the session of %s ended", c.user)
+		}
+	}
+}
+
+func TestBackendAuthConn(t *testing.T) {
+	b := startFakeBackend(t)
+	defer b.ln.Close()
+
+	for _, c := range []struct {
+		password string
+		expected byte
+	}{
+		{testPassword, 'R'},
+		{"wrong", 'E'},
+	} {
+		conn, err := net.Dial("tcp", b.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend := NewBackendAuthConn(conn, testUser, c.password)
+		if _, err := io.Copy(backend, (&message.StartupMessage{ProtocolVersion: 196608, Parameters: map[string]string{"user": "alice"}}).Reader()); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := readMessage(bufio.NewReader(backend))
+		if err != nil || msg[0] != c.expected {
+			t.Fatalf("expect %c to the client, got %v %v", c.expected, msg, err)
+		}
+		if c.expected == 'R' {
+			if _, ok := message.ReadAuthentication(msg[5:]).(*message.AuthenticationOk); !ok {
+				t.Fatalf("expect AuthenticationOk to the client, got %v", msg)
+			}
+		}
+		backend.Close()
+	}
+}
@@ -0,0 +1,196 @@
+package pgproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rueian/godemand/types"
+	"github.com/rueian/pgbroker/message"
+)
+
+const (
+	bootRestoring = "restoring"
+	bootStarting  = "starting"
+	bootAccepting = "accepting"
+)
+
+// BootNotifier tells the clients waiting for their backends the boot progress by NoticeResponse messages,
+// and answers the failures of the waiting by an ErrorResponse with a SQLSTATE and a retry hint.
+type BootNotifier struct {
+	// Notices enables the progress notices. Since libpq rejects notices before the authentication completes,
+	// they are only sent to the clients authenticated by the proxy, following an early AuthenticationOk.
+	Notices bool
+	// Timeout limits the waiting for a resource if not zero.
+	Timeout time.Duration
+	// RetryAfter is suggested to the clients in the hint of the errors.
+	RetryAfter time.Duration
+
+	conns sync.Map
+}
+
+func NewBootNotifier(notices bool, timeout time.Duration) *BootNotifier {
+	return &BootNotifier{Notices: notices, Timeout: timeout, RetryAfter: 10 * time.Second}
+}
+
+// Listener tracks the client connections of the listener to write them while their backends are booting.
+// It should wrap the other listeners, so that the tracked connections are the ones served by the pgbroker.
+func (b *BootNotifier) Listener(ln net.Listener) net.Listener {
+	return &bootListener{Listener: ln, notifier: b}
+}
+
+type bootListener struct {
+	net.Listener
+	notifier *BootNotifier
+}
+
+func (l *bootListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &bootConn{Conn: conn, notifier: l.notifier, addr: conn.RemoteAddr().String()}
+	l.notifier.conns.Store(c.addr, c)
+	return c, nil
+}
+
+type bootConn struct {
+	net.Conn
+	notifier *BootNotifier
+	addr     string
+}
+
+func (c *bootConn) Close() error {
+	c.notifier.conns.Delete(c.addr)
+	return c.Conn.Close()
+}
+
+// wait starts the waiting of the client for the backend of the database, it is a no-op if the notifier is nil
+// or the client is not tracked.
+func (b *BootNotifier) wait(clientAddr net.Addr, database string, authenticated bool) *bootWait {
+	w := &bootWait{database: database}
+	if b == nil {
+		return w
+	}
+	if conn, ok := b.conns.Load(clientAddr.String()); ok {
+		w.conn = conn.(*bootConn).Conn
+	}
+	w.notices = b.Notices && authenticated
+	w.retryAfter = b.RetryAfter
+	return w
+}
+
+type bootWait struct {
+	mu         sync.Mutex
+	conn       net.Conn
+	database   string
+	notices    bool
+	retryAfter time.Duration
+	phase      string
+	authOk     bool
+	done       bool
+}
+
+// progress notices the client when the phase of the resource changes. Nothing is sent if the resource is
+// serving at first, so that the clients of the running backends are not affected.
+func (w *bootWait) progress(res types.Resource) {
+	var phase, msg string
+	switch res.State {
+	case types.ResourcePending:
+		phase, msg = bootRestoring, fmt.Sprintf("restoring the disk of database %q from the snapshot", w.database)
+	case types.ResourceBooting:
+		phase, msg = bootStarting, fmt.Sprintf("starting the instance of database %q", w.database)
+	case types.ResourceServing:
+		phase, msg = bootAccepting, fmt.Sprintf("database %q is accepting connections", w.database)
+	default:
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done || !w.notices || w.conn == nil || phase == w.phase || (w.phase == "" && phase == bootAccepting) {
+		return
+	}
+	w.phase = phase
+
+	var buf bytes.Buffer
+	if !w.authOk {
+		io.Copy(&buf, (&message.AuthenticationOk{ID: authOK}).Reader())
+	}
+	io.Copy(&buf, (&message.NoticeResponse{Fields: []message.NoticeField{
+		{Type: 'S', Value: "NOTICE"},
+		{Type: 'C', Value: "00000"},
+		{Type: 'M', Value: msg},
+	}}).Reader())
+	if w.write(buf.Bytes()) == nil {
+		w.authOk = true
+	}
+}
+
+// fail answers the client with a FATAL ErrorResponse with the code and a retry hint. The pgbroker writes its own
+// error after it, which is ignored by the client.
+func (w *bootWait) fail(code, msg string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done || w.conn == nil {
+		return
+	}
+	w.done = true
+
+	resp := errorResp("FATAL", code, msg)
+	resp.Fields = append(resp.Fields, message.ErrorField{Type: 'H', Value: fmt.Sprintf("Retry the connection in %s.", w.retryAfter)})
+	var buf bytes.Buffer
+	io.Copy(&buf, resp.Reader())
+	w.write(buf.Bytes())
+}
+
+func (w *bootWait) write(b []byte) error {
+	w.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	defer w.conn.SetWriteDeadline(time.Time{})
+	_, err := w.conn.Write(b)
+	return err
+}
+
+// authenticated reports whether the AuthenticationOk is sent to the client, then the one of the backend should be dropped.
+func (w *bootWait) authenticated() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.authOk
+}
+
+func (w *bootWait) stop() {
+	w.mu.Lock()
+	w.done = true
+	w.mu.Unlock()
+}
+
+// progressTransport reports the resources in the responses of the godemand api.
+type progressTransport struct {
+	http.RoundTripper
+	progress func(types.Resource)
+}
+
+func (t *progressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Body == nil {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var res types.Resource
+	if json.Unmarshal(body, &res) == nil && res.ID != "" {
+		t.progress(res)
+	}
+	return resp, nil
+}
@@ -0,0 +1,87 @@
+package pgproxy
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rueian/godemand/types"
+	"github.com/rueian/pgbroker/message"
+)
+
+func TestBootNotifier(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier := NewBootNotifier(true, 0)
+	ln = notifier.Listener(ln)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// the clients not authenticated by the proxy receive no notices
+	boot := notifier.wait(client.LocalAddr(), "app", false)
+	boot.progress(types.Resource{ID: "a", State: types.ResourceBooting})
+	boot.stop()
+
+	// the serving resources at first are not noticed
+	boot = notifier.wait(client.LocalAddr(), "app", true)
+	boot.progress(types.Resource{ID: "a", State: types.ResourceServing})
+	if boot.authenticated() {
+		t.Fatal("expect no AuthenticationOk sent for the serving resource")
+	}
+	boot.stop()
+
+	boot = notifier.wait(client.LocalAddr(), "app", true)
+	for _, state := range []types.ResourceState{types.ResourcePending, types.ResourceBooting, types.ResourceBooting, types.ResourceServing} {
+		boot.progress(types.Resource{ID: "a", State: state})
+	}
+	if !boot.authenticated() {
+		t.Fatal("expect AuthenticationOk sent before the notices")
+	}
+	boot.fail("57P03", "database \"app\" is still starting up")
+	boot.progress(types.Resource{ID: "a", State: types.ResourcePending})
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(client)
+	msg, err := readMessage(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := message.ReadAuthentication(msg[5:]).(*message.AuthenticationOk); msg[0] != 'R' || !ok {
+		t.Fatalf("expect AuthenticationOk, got %q", msg)
+	}
+	for _, expect := range []string{"restoring", "starting", "accepting"} {
+		if msg, err = readMessage(rd); err != nil {
+			t.Fatal(err)
+		}
+		notice := message.ReadNoticeResponse(msg[5:])
+		if msg[0] != 'N' || len(notice.Fields) != 3 || !strings.Contains(notice.Fields[2].Value, expect) {
+			t.Fatalf("expect the notice of %s, got %q", expect, msg)
+		}
+	}
+	if msg, err = readMessage(rd); err != nil {
+		t.Fatal(err)
+	}
+	resp := message.ReadErrorResponse(msg[5:])
+	if msg[0] != 'E' || len(resp.Fields) != 4 || resp.Fields[1].Value != "57P03" || resp.Fields[3].Type != 'H' {
+		t.Fatalf("unexpected error response %q", msg)
+	}
+
+	server.Close()
+	if _, ok := notifier.conns.Load(client.LocalAddr().String()); ok {
+		t.Fatal("expect the closed connection untracked")
+	}
+}
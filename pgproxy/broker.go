@@ -4,14 +4,23 @@ import (
 	"io"
 	"log"
 	"net"
-	"strings"
 
 	"github.com/rueian/pgbroker/backend"
 	"github.com/rueian/pgbroker/message"
 	"github.com/rueian/pgbroker/proxy"
 )
 
-func NewPGBroker(resolver backend.PGResolver) *proxy.Server {
+// BrokerOptions are the optional features of the proxy server.
+type BrokerOptions struct {
+	// Stats collects the latency and the rows of statements.
+	Stats *QueryStats
+	// QueryLog logs the queries, all of them are logged in full if nil.
+	QueryLog *QueryLogger
+}
+
+func NewPGBroker(resolver backend.PGResolver, options BrokerOptions) *proxy.Server {
+	stats, queryLog := options.Stats, options.QueryLog
+
 	clientMessageHandlers := proxy.NewClientMessageHandlers()
 	serverMessageHandlers := proxy.NewServerMessageHandlers()
 
@@ -20,9 +29,10 @@ func NewPGBroker(resolver backend.PGResolver) *proxy.Server {
 			c.StartHeartbeat()
 		}
 
-		user := ctx.ConnInfo.StartupParameters["user"]
-		database := ctx.ConnInfo.StartupParameters["database"]
-		log.Printf("Query: db=%s user=%s query=%s\n", database, user, strings.ReplaceAll(msg.QueryString, "\n", " "))
+		queryLog.Log(ctx.ConnInfo.StartupParameters, msg.QueryString)
+		if stats != nil {
+			stats.Query(ctx, msg.QueryString)
+		}
 		return msg, nil
 	})
 
@@ -31,25 +41,52 @@ func NewPGBroker(resolver backend.PGResolver) *proxy.Server {
 			c.StartHeartbeat()
 		}
 
-		user := ctx.ConnInfo.StartupParameters["user"]
-		database := ctx.ConnInfo.StartupParameters["database"]
-		log.Printf("Query: db=%s user=%s query=%s\n", database, user, strings.ReplaceAll(msg.QueryString, "\n", " "))
+		queryLog.Log(ctx.ConnInfo.StartupParameters, msg.QueryString)
+		if stats != nil {
+			stats.Parse(ctx, msg.PreparedStatementName, msg.QueryString)
+		}
 		return msg, nil
 	})
 
 	serverMessageHandlers.AddHandleReadyForQuery(func(ctx *proxy.Ctx, msg *message.ReadyForQuery) (query *message.ReadyForQuery, e error) {
 		if c, ok := ctx.ServerConn.(*Conn); ok {
 			c.StopHeartbeat()
+			c.Ready(msg.Status)
+		}
+		if stats != nil {
+			stats.ReadyForQuery(ctx)
 		}
 		return msg, nil
 	})
 
+	if stats != nil {
+		clientMessageHandlers.AddHandleBind(func(ctx *proxy.Ctx, msg *message.Bind) (*message.Bind, error) {
+			stats.Bind(ctx, msg.PortalName, msg.PreparedStatementName)
+			return msg, nil
+		})
+		clientMessageHandlers.AddHandleExecute(func(ctx *proxy.Ctx, msg *message.Execute) (*message.Execute, error) {
+			stats.Execute(ctx, msg.PortalName)
+			return msg, nil
+		})
+		serverMessageHandlers.AddHandleCommandComplete(func(ctx *proxy.Ctx, msg *message.CommandComplete) (*message.CommandComplete, error) {
+			stats.CommandComplete(ctx, msg.CommandTag)
+			return msg, nil
+		})
+		serverMessageHandlers.AddHandleErrorResponse(func(ctx *proxy.Ctx, msg *message.ErrorResponse) (*message.ErrorResponse, error) {
+			stats.Error(ctx)
+			return msg, nil
+		})
+	}
+
 	server := &proxy.Server{
 		PGResolver:            resolver,
 		ConnInfoStore:         backend.NewInMemoryConnInfoStore(),
 		ServerMessageHandlers: serverMessageHandlers,
 		ClientMessageHandlers: clientMessageHandlers,
 		OnHandleConnError: func(err error, ctx *proxy.Ctx, conn net.Conn) {
+			if stats != nil {
+				stats.Close(ctx)
+			}
 			if err == io.EOF {
 				return
 			}
@@ -70,5 +107,30 @@ func NewPGBroker(resolver backend.PGResolver) *proxy.Server {
 		},
 	}
 
+	if rewriter, ok := resolver.(backend.PGStartupMessageRewriter); ok {
+		server.PGStartupMessageRewriter = rewriter
+	}
+	if canceler, ok := resolver.(Canceler); ok {
+		server.ConnInfoStore = &cancelStore{ConnInfoStore: backend.NewInMemoryConnInfoStore(), canceler: canceler}
+	}
+
 	return server
 }
+
+// Canceler cancels the queries of the BackendKeyData given by itself instead of the backends.
+type Canceler interface {
+	Cancel(pid, secret uint32) bool
+}
+
+// cancelStore finds the connections of the cancel requests, the ones given by the Canceler are canceled by it.
+type cancelStore struct {
+	backend.ConnInfoStore
+	canceler Canceler
+}
+
+func (s *cancelStore) Find(clientAddress net.Addr, backendProcessID, backendSecretKey uint32) (*backend.ConnInfo, error) {
+	if s.canceler.Cancel(backendProcessID, backendSecretKey) {
+		return nil, nil
+	}
+	return s.ConnInfoStore.Find(clientAddress, backendProcessID, backendSecretKey)
+}
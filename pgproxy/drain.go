@@ -0,0 +1,90 @@
+package pgproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rueian/godemand/types"
+)
+
+// DrainWatcher finds the draining resources by their "draining" Meta, which is set by the pgplugin before stopping
+// the resources. Each resource is polled from godemand at most once per the Interval.
+type DrainWatcher struct {
+	Host     string
+	Interval time.Duration
+
+	mu     sync.Mutex
+	checks map[string]*drainCheck
+}
+
+type drainCheck struct {
+	at       time.Time
+	draining bool
+}
+
+func NewDrainWatcher(host string, interval time.Duration) *DrainWatcher {
+	return &DrainWatcher{Host: host, Interval: interval, checks: map[string]*drainCheck{}}
+}
+
+// Draining reports whether the resource is draining, it is false if the watcher is nil.
+func (w *DrainWatcher) Draining(ctx context.Context, resource types.Resource) bool {
+	if w == nil {
+		return false
+	}
+	key := resource.PoolID + "/" + resource.ID
+
+	w.mu.Lock()
+	check, ok := w.checks[key]
+	if ok && (check.draining || time.Since(check.at) < w.Interval) {
+		w.mu.Unlock()
+		return check.draining
+	}
+	for k, c := range w.checks {
+		if time.Since(c.at) > 10*w.Interval {
+			delete(w.checks, k)
+		}
+	}
+	if !ok {
+		check = &drainCheck{}
+		w.checks[key] = check
+	}
+	// the concurrent callers use the last result until this one is done
+	check.at = time.Now()
+	w.mu.Unlock()
+
+	draining := w.get(ctx, resource)
+
+	w.mu.Lock()
+	check.draining = check.draining || draining
+	w.mu.Unlock()
+	return draining
+}
+
+func (w *DrainWatcher) get(ctx context.Context, resource types.Resource) bool {
+	form := url.Values{"poolID": {resource.PoolID}, "id": {resource.ID}}
+	req, err := http.NewRequest("POST", w.Host+"/GetResource", strings.NewReader(form.Encode()))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+
+	var res types.Resource
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return false
+	}
+	_, draining := res.Meta["draining"]
+	return draining
+}
@@ -0,0 +1,104 @@
+package pgproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rueian/godemand/client"
+	"github.com/rueian/godemand/types"
+	"github.com/rueian/pgbroker/message"
+)
+
+func TestDrainWatcher(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		res := types.Resource{ID: r.FormValue("id"), PoolID: r.FormValue("poolID"), State: types.ResourceServing}
+		if res.ID == "old" {
+			res.Meta = types.Meta{"draining": time.Now().Format(time.RFC3339)}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer srv.Close()
+
+	w := NewDrainWatcher(srv.URL, time.Minute)
+	for i := 0; i < 2; i++ {
+		if w.Draining(context.Background(), types.Resource{ID: "new", PoolID: "pg11"}) {
+			t.Fatal("expect the new resource not draining")
+		}
+		if !w.Draining(context.Background(), types.Resource{ID: "old", PoolID: "pg11"}) {
+			t.Fatal("expect the old resource draining")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("expect the resources polled once per interval, got %d requests", n)
+	}
+}
+
+func TestConn_Drain(t *testing.T) {
+	server, backend := net.Pipe()
+	defer backend.Close()
+	c := WrapConn(server, types.Resource{ID: "old"}, nil)
+	defer c.Close()
+	c.draining = true
+
+	// the in-flight transaction is left to finish
+	c.Ready('T')
+	if c.drained {
+		t.Fatal("expect the session in a transaction not disconnected")
+	}
+	c.Ready('I')
+	if !c.drained {
+		t.Fatal("expect the idle session disconnected")
+	}
+
+	rd := bufio.NewReader(c)
+	msg, err := readMessage(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := message.ReadErrorResponse(msg[5:]); msg[0] != 'E' || resp.Fields[1].Value != "57P01" {
+		t.Fatalf("expect the FATAL error of the draining backend, got %q", msg)
+	}
+	if _, err := readMessage(rd); err != io.EOF {
+		t.Fatalf("expect EOF after the error, got %v", err)
+	}
+}
+
+func TestConn_Heartbeat(t *testing.T) {
+	var beats int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/Heartbeat" {
+			atomic.AddInt32(&beats, 1)
+		}
+		json.NewEncoder(w).Encode(types.Resource{ID: r.FormValue("id")})
+	}))
+	defer srv.Close()
+
+	server, backend := net.Pipe()
+	defer backend.Close()
+	c := WrapConn(server, types.Resource{ID: "r", PoolID: "pg11"}, client.NewHTTPClient(srv.URL, types.Client{ID: "c", Meta: map[string]interface{}{}}, srv.Client()))
+	c.drains = NewDrainWatcher(srv.URL, time.Minute)
+	defer c.Close()
+
+	// the transactions toggle the heartbeat while it is sent in the background
+	c.StartHeartbeat()
+	go c.Heartbeat()
+	for i := 0; i < 100; i++ {
+		c.StopHeartbeat()
+		c.StartHeartbeat()
+	}
+	c.StopHeartbeat()
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&beats); n < 1 || n > 2 {
+		t.Fatalf("expect the heartbeats not repeated within the interval, got %d", n)
+	}
+}
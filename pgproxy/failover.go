@@ -0,0 +1,299 @@
+package pgproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rueian/pgbroker/message"
+)
+
+// FailoverConn replaces the lost backend of an idle session, which is outside of transactions and waiting for
+// queries, with a new one from the Dial. The startup message and the SET commands of the session are replayed
+// to the new backend and their responses are dropped, so that the client doesn't notice. The sessions with named
+// prepared statements are not replaced, since they can't be restored by the replay. The new backend must not ask
+// for a password, which is answered by the BackendAuthConn of the Dial if the proxy authenticates the clients.
+type FailoverConn struct {
+	Dial func() (net.Conn, error)
+	// Timeout bounds the replay to the new backend.
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	conn     net.Conn
+	rd       *bufio.Reader
+	out      bytes.Buffer
+	in       bytes.Buffer
+	startup  []byte
+	waiting  int
+	unsynced bool
+	status   byte
+	failed   bool
+	prepared bool
+	closed   bool
+	// sets are the SET commands applied to the session, and pending are the ones waiting for the end of the transaction.
+	sets    []string
+	pending []string
+}
+
+func NewFailoverConn(conn net.Conn, dial func() (net.Conn, error)) *FailoverConn {
+	return &FailoverConn{Dial: dial, conn: conn, rd: bufio.NewReader(conn)}
+}
+
+func (c *FailoverConn) Read(b []byte) (int, error) {
+	for c.out.Len() == 0 {
+		c.mu.Lock()
+		rd := c.rd
+		c.mu.Unlock()
+
+		msg, err := readMessage(rd)
+		if err == nil && !(msg[0] == 'E' && isFatal(msg)) {
+			c.mu.Lock()
+			c.serverMessage(msg)
+			c.mu.Unlock()
+			c.out.Write(msg)
+			continue
+		}
+
+		c.mu.Lock()
+		if c.rd != rd {
+			// replaced by the Write
+			c.mu.Unlock()
+			continue
+		}
+		if !c.idle() {
+			c.mu.Unlock()
+			if err == nil {
+				c.out.Write(msg)
+				continue
+			}
+			return 0, err
+		}
+		if ferr := c.failover(); ferr != nil {
+			log.Printf("fail to replace the lost backend %s: %s\n", c.conn.RemoteAddr(), ferr.Error())
+			c.mu.Unlock()
+			if err == nil {
+				c.out.Write(msg)
+				continue
+			}
+			return 0, err
+		}
+		c.mu.Unlock()
+	}
+	return c.out.Read(b)
+}
+
+func (c *FailoverConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	idle := c.idle()
+	if _, err := c.conn.Write(b); err != nil {
+		if !idle {
+			return 0, err
+		}
+		if ferr := c.failover(); ferr != nil {
+			log.Printf("fail to replace the lost backend %s: %s\n", c.conn.RemoteAddr(), ferr.Error())
+			return 0, err
+		}
+		if _, err := c.conn.Write(b); err != nil {
+			return 0, err
+		}
+	}
+
+	c.in.Write(b)
+	for {
+		msg, ok := nextMessage(&c.in, c.startup == nil)
+		if !ok {
+			return len(b), nil
+		}
+		c.clientMessage(msg)
+	}
+}
+
+// idle reports whether the session can be moved to another backend.
+func (c *FailoverConn) idle() bool {
+	return !c.closed && !c.prepared && c.startup != nil && c.waiting == 0 && !c.unsynced && c.status == 'I'
+}
+
+func (c *FailoverConn) clientMessage(msg []byte) {
+	if c.startup == nil {
+		if m, err := message.ReadStartupMessage(msg[4:]); err == nil {
+			if _, ok := m.(*message.StartupMessage); ok {
+				c.startup = msg
+			}
+		}
+		return
+	}
+	switch msg[0] {
+	case 'Q':
+		c.waiting++
+		c.setCommand(message.ReadQuery(msg[5:]).QueryString)
+	case 'S', 'F':
+		c.waiting++
+		c.unsynced = false
+	case 'P':
+		parse := message.ReadParse(msg[5:])
+		if parse.PreparedStatementName != "" {
+			c.prepared = true
+		}
+		c.unsynced = true
+		c.setCommand(parse.QueryString)
+	case 'B', 'E', 'D', 'C', 'H':
+		c.unsynced = true
+	}
+}
+
+func (c *FailoverConn) serverMessage(msg []byte) {
+	switch msg[0] {
+	case 'E':
+		c.failed = true
+	case 'Z':
+		if c.waiting > 0 {
+			c.waiting--
+		}
+		c.status = msg[5]
+		switch {
+		case c.status == 'E':
+			c.failed = true
+		case c.status == 'I' && !c.failed:
+			c.sets = append(c.sets, c.pending...)
+			c.pending = nil
+		case c.status == 'I':
+			c.pending, c.failed = nil, false
+		}
+	}
+}
+
+// setCommand keeps the statements of the query if they change the session parameters.
+func (c *FailoverConn) setCommand(query string) {
+	stmts, _ := scanSQL(query)
+	for _, s := range stmts {
+		switch {
+		case s.words[0] == "set" && len(s.words) > 1 && (s.words[1] == "local" || s.words[1] == "transaction"):
+		case s.words[0] == "set" || (s.words[0] == "reset" && len(s.words) > 1 && s.words[1] != "all"):
+			c.pending = append(c.pending, s.text)
+		case s.words[0] == "reset" || (s.words[0] == "discard" && len(s.words) > 1 && s.words[1] == "all"):
+			c.sets, c.pending = nil, nil
+		}
+	}
+}
+
+// failover dials a new backend, replays the startup message and the SET commands, and drops their responses.
+func (c *FailoverConn) failover() error {
+	if c.Dial == nil {
+		return errors.New("failover is not enabled")
+	}
+	conn, err := c.Dial()
+	if err != nil {
+		return err
+	}
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	rd := bufio.NewReader(conn)
+	replay := func(msg []byte) error {
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		for {
+			msg, err := readMessage(rd)
+			if err != nil {
+				return err
+			}
+			if msg[0] == 'E' && isFatal(msg) {
+				return errors.New(errorMessage(msg))
+			}
+			if msg[0] == 'R' && len(msg) >= 9 && binary.BigEndian.Uint32(msg[5:9]) != 0 {
+				// the password of the client is not known by the proxy
+				return fmt.Errorf("backend asks for the authentication %d", binary.BigEndian.Uint32(msg[5:9]))
+			}
+			if msg[0] == 'Z' {
+				return nil
+			}
+		}
+	}
+
+	if err = replay(c.startup); err == nil {
+		for _, set := range c.sets {
+			var buf bytes.Buffer
+			io.Copy(&buf, (&message.Query{QueryString: set}).Reader())
+			if err = replay(buf.Bytes()); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	log.Printf("backend %s of the idle session is replaced by %s\n", c.conn.RemoteAddr(), conn.RemoteAddr())
+	c.conn.Close()
+	c.conn, c.rd = conn, rd
+	return nil
+}
+
+func (c *FailoverConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return c.conn.Close()
+}
+
+func (c *FailoverConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.RemoteAddr()
+}
+
+func (c *FailoverConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.LocalAddr()
+}
+
+func (c *FailoverConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.SetDeadline(t)
+}
+
+func (c *FailoverConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *FailoverConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.SetWriteDeadline(t)
+}
+
+func isFatal(msg []byte) bool {
+	for _, f := range message.ReadErrorResponse(msg[5:]).Fields {
+		if f.Type == 'S' {
+			return f.Value == "FATAL" || f.Value == "PANIC"
+		}
+	}
+	return false
+}
+
+func errorMessage(msg []byte) string {
+	for _, f := range message.ReadErrorResponse(msg[5:]).Fields {
+		if f.Type == 'M' {
+			return f.Value
+		}
+	}
+	return "unknown error"
+}
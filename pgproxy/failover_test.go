@@ -0,0 +1,116 @@
+package pgproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rueian/pgbroker/message"
+)
+
+func TestFailoverConn(t *testing.T) {
+	b := startFakeBackend(t)
+	defer b.ln.Close()
+	dial := func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", b.ln.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		return NewBackendAuthConn(conn, testUser, testPassword), nil
+	}
+
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := NewFailoverConn(conn, dial)
+	defer fc.Close()
+	c := &testClient{conn: fc, rd: bufio.NewReader(fc)}
+	io.Copy(fc, (&message.StartupMessage{ProtocolVersion: 196608, Parameters: map[string]string{"user": "client", "database": "db"}}).Reader())
+	for {
+		msg, err := readMessage(c.rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg[0] == 'Z' {
+			break
+		}
+	}
+
+	for _, q := range []string{"SET a = 1", "BEGIN", "SET LOCAL x = 1", "SET b = 2", "COMMIT"} {
+		if _, err := c.query(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the idle session moves to a new backend
+	conn.Close()
+	if tag, err := c.query("SELECT 1"); err != nil || tag != "2 SELECT 1" {
+		t.Fatalf("expect the query on the new backend, got %q %v", tag, err)
+	}
+
+	// the session in a transaction is cut
+	if _, err := c.query("BEGIN"); err != nil {
+		t.Fatal(err)
+	}
+	fc.mu.Lock()
+	fc.conn.Close()
+	fc.mu.Unlock()
+	fc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.query("SELECT 2"); err == nil {
+		t.Fatal("expect the session in a transaction not replaced")
+	}
+
+	var queries []string
+	for len(b.queries) > 0 {
+		queries = append(queries, <-b.queries)
+	}
+	if strings.Join(queries, ",") != "1 SET a = 1,1 BEGIN,1 SET LOCAL x = 1,1 SET b = 2,1 COMMIT,2 SET a = 1,2 SET b = 2,2 SELECT 1,2 BEGIN" {
+		t.Fatalf("unexpected queries on the backends %v", queries)
+	}
+}
+
+func TestFailoverConn_PasswordAsked(t *testing.T) {
+	b := startFakeBackend(t)
+	defer b.ln.Close()
+
+	conn, err := net.Dial("tcp", b.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the new backend asks for the md5 password, which is not answered without the BackendAuthConn
+	fc := NewFailoverConn(NewBackendAuthConn(conn, testUser, testPassword), func() (net.Conn, error) {
+		return net.Dial("tcp", b.ln.Addr().String())
+	})
+	fc.Timeout = time.Minute
+	defer fc.Close()
+	c := &testClient{conn: fc, rd: bufio.NewReader(fc)}
+	io.Copy(fc, (&message.StartupMessage{ProtocolVersion: 196608, Parameters: map[string]string{"user": "client", "database": "db"}}).Reader())
+	for {
+		msg, err := readMessage(c.rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg[0] == 'Z' {
+			break
+		}
+	}
+
+	conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.query("SELECT 1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expect the session not replaced")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the failover aborted on the password request")
+	}
+}
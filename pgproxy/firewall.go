@@ -0,0 +1,309 @@
+package pgproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rueian/pgbroker/message"
+	"gopkg.in/yaml.v2"
+)
+
+// FirewallRule matches the statements by their types, a regex of the statement, and patterns of the database and the user.
+// The types are "ddl", "dml", "drop_database", "copy_program", or the first keyword of statements like "vacuum".
+// The GRANT and REVOKE are "ddl", the DO, EXECUTE and CALL are both "ddl" and "dml", and the WITH, EXPLAIN and PREPARE
+// are typed by the statements nested in them.
+// Empty conditions match anything. The Action is "deny" by default, or "allow".
+type FirewallRule struct {
+	Name       string   `yaml:"name"`
+	Action     string   `yaml:"action"`
+	Statements []string `yaml:"statements"`
+	Query      string   `yaml:"query"`
+	Database   string   `yaml:"database"`
+	User       string   `yaml:"user"`
+
+	query    *regexp.Regexp
+	database matcher
+	user     matcher
+}
+
+// FirewallConfig has the rules evaluated in order, the first matched rule of a statement decides whether it is allowed.
+// The statements matching no rule are allowed. The blocks are only logged in the DryRun mode.
+type FirewallConfig struct {
+	Rules  []FirewallRule `yaml:"rules"`
+	DryRun bool           `yaml:"dry_run"`
+}
+
+const (
+	FirewallAllow = "allow"
+	FirewallDeny  = "deny"
+)
+
+type Firewall struct {
+	// QueryLog renders the blocked statements in the logs.
+	QueryLog *QueryLogger
+
+	mu     sync.RWMutex
+	rules  []*FirewallRule
+	dryRun bool
+}
+
+func NewFirewall(config FirewallConfig) (*Firewall, error) {
+	f := &Firewall{}
+	if err := f.Set(config); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *Firewall) Set(config FirewallConfig) error {
+	var rules []*FirewallRule
+	for i, rule := range config.Rules {
+		rule := rule
+		if rule.Name == "" {
+			rule.Name = "#" + strconv.Itoa(i+1)
+		}
+		switch rule.Action {
+		case "":
+			rule.Action = FirewallDeny
+		case FirewallAllow, FirewallDeny:
+		default:
+			return fmt.Errorf("firewall rule %q has unknown action %q", rule.Name, rule.Action)
+		}
+		var err error
+		if rule.Query != "" {
+			if rule.query, err = regexp.Compile(rule.Query); err != nil {
+				return fmt.Errorf("firewall rule %q: %w", rule.Name, err)
+			}
+		}
+		if rule.database, err = compilePattern(rule.Database); err != nil {
+			return err
+		}
+		if rule.user, err = compilePattern(rule.User); err != nil {
+			return err
+		}
+		statements := make([]string, len(rule.Statements))
+		for i, s := range rule.Statements {
+			statements[i] = strings.ToLower(s)
+		}
+		rule.Statements = statements
+		rules = append(rules, &rule)
+	}
+
+	f.mu.Lock()
+	f.rules, f.dryRun = rules, config.DryRun
+	f.mu.Unlock()
+	return nil
+}
+
+func (r *FirewallRule) match(database, user string, stmt sqlStatement) bool {
+	if !r.database(database) || !r.user(user) {
+		return false
+	}
+	if r.query != nil && !r.query.MatchString(stmt.text) {
+		return false
+	}
+	if len(r.Statements) == 0 {
+		return true
+	}
+	types := stmt.types()
+	for _, s := range r.Statements {
+		for _, t := range types {
+			if s == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check returns the deny rule blocking the query of the client, or nil if the query is allowed or the DryRun is on.
+func (f *Firewall) Check(params map[string]string, query string) *FirewallRule {
+	database, user := params["database"], params["user"]
+	stmts, _ := scanSQL(query)
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, stmt := range stmts {
+		for _, rule := range f.rules {
+			if !rule.match(database, user, stmt) {
+				continue
+			}
+			if rule.Action == FirewallAllow {
+				break
+			}
+			log.Printf("Firewall: rule=%s dry_run=%v db=%s user=%s %s\n", rule.Name, f.dryRun, database, user, f.QueryLog.Format(database, stmt.text))
+			if f.dryRun {
+				break
+			}
+			return rule
+		}
+	}
+	return nil
+}
+
+// FirewallConn blocks the Query and Parse messages written to the backend by the Firewall, and answers them from
+// the proxy. The blocked Query is replaced by a Sync, and the extended query messages after the blocked Parse are
+// dropped until the Sync, so that the backend only answers a ReadyForQuery, before which the ErrorResponse of the
+// blocked statement is inserted. The transaction of the session is not aborted by the blocked statement.
+type FirewallConn struct {
+	net.Conn
+	firewall *Firewall
+	params   map[string]string
+
+	in       bytes.Buffer
+	started  bool
+	skipping bool
+	rule     *FirewallRule
+
+	rd      *bufio.Reader
+	out     bytes.Buffer
+	errored bool
+
+	mu sync.Mutex
+	// syncs are the rules blocking the messages answered by the ReadyForQuery in order, nil for the allowed ones.
+	syncs []*FirewallRule
+}
+
+func NewFirewallConn(conn net.Conn, firewall *Firewall, params map[string]string) *FirewallConn {
+	return &FirewallConn{Conn: conn, firewall: firewall, params: params, rd: bufio.NewReader(conn)}
+}
+
+func (c *FirewallConn) Write(b []byte) (int, error) {
+	c.in.Write(b)
+	var out bytes.Buffer
+	for {
+		msg, ok := nextMessage(&c.in, !c.started)
+		if !ok {
+			break
+		}
+		if !c.started {
+			c.started = true
+			c.sync(nil)
+			out.Write(msg)
+			continue
+		}
+		if c.skipping && msg[0] != 'S' && msg[0] != 'X' {
+			continue
+		}
+		switch msg[0] {
+		case 'Q':
+			rule := c.firewall.Check(c.params, message.ReadQuery(msg[5:]).QueryString)
+			if rule != nil {
+				io.Copy(&out, (&message.Sync{}).Reader())
+				c.sync(rule)
+				continue
+			}
+			c.sync(nil)
+		case 'P':
+			if c.rule = c.firewall.Check(c.params, message.ReadParse(msg[5:]).QueryString); c.rule != nil {
+				c.skipping = true
+				continue
+			}
+		case 'S':
+			c.sync(c.rule)
+			c.rule, c.skipping = nil, false
+		case 'F':
+			c.sync(nil)
+		}
+		out.Write(msg)
+	}
+	if out.Len() > 0 {
+		if _, err := c.Conn.Write(out.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (c *FirewallConn) sync(rule *FirewallRule) {
+	c.mu.Lock()
+	c.syncs = append(c.syncs, rule)
+	c.mu.Unlock()
+}
+
+// Read inserts the ErrorResponse of the blocked statement before its ReadyForQuery, unless the backend has responded
+// an error of the same messages.
+func (c *FirewallConn) Read(b []byte) (int, error) {
+	for c.out.Len() == 0 {
+		msg, err := readMessage(c.rd)
+		if err != nil {
+			return 0, err
+		}
+		switch msg[0] {
+		case 'E':
+			c.errored = true
+		case 'Z':
+			var rule *FirewallRule
+			c.mu.Lock()
+			if len(c.syncs) > 0 {
+				rule, c.syncs = c.syncs[0], c.syncs[1:]
+			}
+			c.mu.Unlock()
+			if rule != nil && !c.errored {
+				io.Copy(&c.out, BlockedError(rule).Reader())
+			}
+			c.errored = false
+		}
+		c.out.Write(msg)
+	}
+	return c.out.Read(b)
+}
+
+// BlockedError is the ErrorResponse of the statement blocked by the rule.
+func BlockedError(rule *FirewallRule) *message.ErrorResponse {
+	return errorResp("ERROR", "42501", fmt.Sprintf("permission denied: statement blocked by firewall rule %q", rule.Name))
+}
+
+// Load sets the rules from the yaml or json file.
+func (f *Firewall) Load(path string) error {
+	config, err := LoadFirewallConfig(path)
+	if err != nil {
+		return err
+	}
+	return f.Set(config)
+}
+
+// Watch reloads the rules from the file periodically, the current rules are kept if the file is broken.
+func (f *Firewall) Watch(ctx context.Context, path string, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if err := f.Load(path); err != nil {
+			log.Printf("fail to reload firewall file %q: %v\n", path, err)
+		}
+	}
+}
+
+// LoadFirewallConfig reads the FirewallConfig, or the "firewall" section of the file like the godemand config.
+func LoadFirewallConfig(path string) (config FirewallConfig, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	var f struct {
+		FirewallConfig `yaml:",inline"`
+		Firewall       *FirewallConfig `yaml:"firewall"`
+	}
+	if err = yaml.Unmarshal(b, &f); err != nil {
+		return config, err
+	}
+	if f.Firewall != nil {
+		return *f.Firewall, nil
+	}
+	return f.FirewallConfig, nil
+}
@@ -0,0 +1,136 @@
+package pgproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rueian/pgbroker/message"
+)
+
+func TestScanSQL(t *testing.T) {
+	stmts, params := scanSQL(`SELECT 'a;''drop' , "x;y", E'\'; drop', $tag$ ; drop $tag$ FROM t WHERE a = $2 -- ; drop
+	/* ; /* nested ; */ drop */; COPY t TO PROGRAM 'cat';;  `)
+	if params != 2 {
+		t.Fatalf("expect 2 params, got %d", params)
+	}
+	if len(stmts) != 2 {
+		t.Fatalf("expect 2 statements, got %v", stmts)
+	}
+	if !reflect.DeepEqual(stmts[0].words, []string{"select", "from", "t", "where", "a"}) {
+		t.Fatalf("unexpected words %v", stmts[0].words)
+	}
+	if !reflect.DeepEqual(stmts[1].types(), []string{"copy", "copy_program"}) || stmts[1].text != "COPY t TO PROGRAM 'cat'" {
+		t.Fatalf("unexpected statement %v", stmts[1])
+	}
+}
+
+func TestFirewall_Check(t *testing.T) {
+	f, err := NewFirewall(FirewallConfig{Rules: []FirewallRule{
+		{Name: "admin", Action: FirewallAllow, User: "admin", Statements: []string{"ddl"}},
+		{Name: "no-ddl", Statements: []string{"DDL", "copy_program"}},
+		{Name: "no-sleep", Query: `(?i)pg_sleep`, Database: "app_*"},
+		{Name: "no-dml", Statements: []string{"dml"}, User: "u"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		user, database, query, rule string
+	}{
+		{"u", "app_1", "SELECT 1", ""},
+		{"u", "app_1", "select 1; drop table t", "no-ddl"},
+		{"u", "app_1", "SELECT 'drop table t'", ""},
+		{"admin", "app_1", "CREATE TABLE t (a int)", ""},
+		{"admin", "app_1", "copy t to program 'sh'", "no-ddl"},
+		{"u", "app_1", "SELECT pg_sleep(10)", "no-sleep"},
+		{"u", "other", "SELECT pg_sleep(10)", ""},
+		{"u", "app_1", "GRANT ALL ON t TO u", "no-ddl"},
+		{"u", "app_1", "REVOKE ALL ON t FROM u", "no-ddl"},
+		{"u", "app_1", "DO $$BEGIN EXECUTE 'DROP TABLE t'; END$$", "no-ddl"},
+		{"u", "app_1", "CALL cleanup()", "no-ddl"},
+		{"u", "app_1", "EXPLAIN ANALYZE CREATE TABLE t AS SELECT 1", "no-ddl"},
+		{"u", "app_1", "WITH x AS (DELETE FROM t RETURNING *) SELECT 1", "no-dml"},
+		{"u", "app_1", "EXPLAIN ANALYZE DELETE FROM t", "no-dml"},
+		{"u", "app_1", "PREPARE p AS UPDATE t SET a = 1", "no-dml"},
+		{"u", "app_1", "EXECUTE p", "no-ddl"},
+		{"u", "app_1", "WITH x AS (SELECT * FROM t FOR UPDATE) SELECT 1", ""},
+		{"u", "app_1", "EXPLAIN SELECT 'delete'", ""},
+	} {
+		rule := f.Check(map[string]string{"user": c.user, "database": c.database}, c.query)
+		if (rule == nil && c.rule != "") || (rule != nil && rule.Name != c.rule) {
+			t.Fatalf("expect %q blocked by %q, got %v", c.query, c.rule, rule)
+		}
+	}
+
+	f.Set(FirewallConfig{DryRun: true, Rules: []FirewallRule{{Statements: []string{"drop_database"}}}})
+	if rule := f.Check(map[string]string{}, "DROP DATABASE app"); rule != nil {
+		t.Fatalf("expect the query only logged in the dry run mode, got %v", rule)
+	}
+}
+
+func TestFirewallConn(t *testing.T) {
+	b := startFakeBackend(t)
+	defer b.ln.Close()
+	f, err := NewFirewall(FirewallConfig{Rules: []FirewallRule{{Name: "no-ddl", Statements: []string{"ddl"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", b.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := NewFirewallConn(NewBackendAuthConn(conn, testUser, testPassword), f, map[string]string{"user": "u"})
+	defer fc.Close()
+	c := &testClient{conn: fc, rd: bufio.NewReader(fc)}
+	io.Copy(fc, (&message.StartupMessage{ProtocolVersion: 196608, Parameters: map[string]string{"user": "u", "database": "db"}}).Reader())
+	if types := c.readUntilReady(t); types[len(types)-1] != 'Z' {
+		t.Fatalf("unexpected startup responses %q", types)
+	}
+
+	io.Copy(fc, (&message.Query{QueryString: "DROP TABLE t"}).Reader())
+	msg, err := readMessage(c.rd)
+	if err != nil || msg[0] != 'E' || !strings.Contains(string(msg), "no-ddl") {
+		t.Fatalf("expect the query blocked, got %q %v", msg, err)
+	}
+	if types := c.readUntilReady(t); string(types) != "Z" {
+		t.Fatalf("expect the ReadyForQuery after the error, got %q", types)
+	}
+	if tag, err := c.query("SELECT 1"); err != nil || tag != "1 SELECT 1" {
+		t.Fatalf("expect the session usable after the block, got %q %v", tag, err)
+	}
+
+	// the extended query messages of the blocked Parse are dropped until the Sync
+	var buf bytes.Buffer
+	io.Copy(&buf, (&message.Parse{QueryString: "CREATE TABLE t (a int)"}).Reader())
+	io.Copy(&buf, (&message.Bind{}).Reader())
+	io.Copy(&buf, (&message.Execute{}).Reader())
+	io.Copy(&buf, (&message.Sync{}).Reader())
+	fc.Write(buf.Bytes())
+	if types := c.readUntilReady(t); string(types) != "EZ" {
+		t.Fatalf("expect the error of the blocked Parse, got %q", types)
+	}
+
+	if q := <-b.queries; q != "1 SELECT 1" || len(b.queries) != 0 {
+		t.Fatalf("expect only the allowed query on the backend, got %q", q)
+	}
+}
+
+func (c *testClient) readUntilReady(t *testing.T) (types []byte) {
+	for {
+		msg, err := readMessage(c.rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, msg[0])
+		if msg[0] == 'Z' {
+			return types
+		}
+	}
+}
@@ -0,0 +1,765 @@
+package pgproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rueian/pgbroker/message"
+)
+
+const (
+	PoolingSession     = "session"
+	PoolingTransaction = "transaction"
+)
+
+var PoolTimeoutErr = errors.New("timeout waiting for a server connection")
+
+// PoolKey identifies the server connections which can be shared by clients.
+type PoolKey struct {
+	Pool     string
+	Resource string
+	User     string
+	Database string
+}
+
+// ServerPool keeps at most MaxConns authenticated server connections per PoolKey.
+// In the session mode, a client holds a server connection until it disconnects.
+// In the transaction mode, a client only holds a server connection until the ReadyForQuery outside of transactions,
+// so session states like prepared statements are not supported.
+// The ResetQuery is executed before a server connection is returned to the pool.
+//
+// The server connections are only opened while clients are connecting, so that the clients authenticate them.
+// The later clients are authenticated by the password of the first one instead, the md5 challenges are sent with
+// fresh salts and verified by the Password of the PooledConn. So the server connections of md5 and SASL are only
+// shared if the Password is known by the proxy, which requires the clients authenticated by the Authenticator.
+//
+// The clients receive the BackendKeyData generated by the pool instead of the one of the server connections,
+// which may be used by other clients later. Their cancel requests are routed to the server connections they hold by Cancel.
+type ServerPool struct {
+	Mode        string
+	MaxConns    int
+	IdleTimeout time.Duration
+	WaitTimeout time.Duration
+	ResetQuery  string
+	// BackendTLS re-encrypts the server connections if not nil.
+	BackendTLS *tls.Config
+
+	mu      sync.Mutex
+	groups  map[PoolKey]*connGroup
+	clients map[uint64]*PooledConn
+}
+
+func NewServerPool(mode string, maxConns int, idleTimeout time.Duration) *ServerPool {
+	return &ServerPool{
+		Mode:        mode,
+		MaxConns:    maxConns,
+		IdleTimeout: idleTimeout,
+		WaitTimeout: 30 * time.Second,
+		ResetQuery:  "DISCARD ALL",
+		groups:      map[PoolKey]*connGroup{},
+		clients:     map[uint64]*PooledConn{},
+	}
+}
+
+type connGroup struct {
+	total    int
+	idle     []*serverConn
+	wait     chan struct{}
+	verifier *verifier
+}
+
+type verifier struct {
+	method uint32
+	secret []byte
+}
+
+func (v *verifier) verify(password string, salt []byte) bool {
+	switch v.method {
+	case authMD5:
+		return subtle.ConstantTimeCompare([]byte(password), []byte(md5Response(string(v.secret), salt))) == 1
+	case authCleartext:
+		sum := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare(sum[:], v.secret) == 1
+	}
+	return false
+}
+
+const (
+	authOK        = 0
+	authCleartext = 3
+	authMD5       = 5
+
+	authSASL         = 10
+	authSASLContinue = 11
+	authSASLFinal    = 12
+)
+
+type serverConn struct {
+	net.Conn
+	rd        *bufio.Reader
+	handshake [][]byte
+	method    uint32
+	pid       uint32
+	secret    uint32
+	authed    bool
+	poolable  bool
+	resetting bool
+	usedAt    time.Time
+}
+
+// Get takes an idle server connection of the key, or dials the addr if the key has less than MaxConns connections.
+func (p *ServerPool) Get(ctx context.Context, key PoolKey, addr string) (*PooledConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.WaitTimeout)
+	defer cancel()
+
+	for {
+		p.mu.Lock()
+		g := p.group(key)
+		if s := p.popIdle(g); s != nil {
+			v := g.verifier
+			p.mu.Unlock()
+			return newPooledConn(p, key, addr, s, v), nil
+		}
+		if g.total < p.MaxConns {
+			g.total++
+			p.mu.Unlock()
+
+			conn, err := DialPG(addr, p.BackendTLS)
+			if err != nil {
+				p.release(key, nil, false)
+				return nil, err
+			}
+			return newPooledConn(p, key, addr, &serverConn{Conn: conn, rd: bufio.NewReader(conn)}, nil), nil
+		}
+		wait := g.wait
+		p.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%d server connections of %s/%s on %s are all in use: %w", p.MaxConns, key.User, key.Database, key.Resource, PoolTimeoutErr)
+		}
+	}
+}
+
+// Reap closes the server connections idle longer than the IdleTimeout periodically.
+func (p *ServerPool) Reap(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		p.mu.Lock()
+		for key, g := range p.groups {
+			p.popIdle(g)
+			if g.total == 0 {
+				delete(p.groups, key)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *ServerPool) group(key PoolKey) *connGroup {
+	g, ok := p.groups[key]
+	if !ok {
+		g = &connGroup{wait: make(chan struct{})}
+		p.groups[key] = g
+	}
+	return g
+}
+
+// popIdle returns the most recent idle connection, and closes the expired ones. The p.mu should be held.
+func (p *ServerPool) popIdle(g *connGroup) *serverConn {
+	var kept []*serverConn
+	for _, s := range g.idle {
+		if time.Since(s.usedAt) > p.IdleTimeout {
+			s.Close()
+			g.total--
+			continue
+		}
+		kept = append(kept, s)
+	}
+	g.idle = kept
+	if len(g.idle) == 0 {
+		return nil
+	}
+	s := g.idle[len(g.idle)-1]
+	g.idle = g.idle[:len(g.idle)-1]
+	return s
+}
+
+func (p *ServerPool) release(key PoolKey, s *serverConn, reusable bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	g := p.group(key)
+	if s != nil && reusable {
+		s.usedAt = time.Now()
+		s.resetting = false
+		g.idle = append(g.idle, s)
+	} else {
+		if s != nil {
+			s.Close()
+		}
+		g.total--
+	}
+	close(g.wait)
+	g.wait = make(chan struct{})
+}
+
+// register gives the client a random BackendKeyData which is unique in the pool.
+func (p *ServerPool) register(c *PooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		b := make([]byte, 8)
+		rand.Read(b)
+		c.pid, c.secret = binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+		if _, ok := p.clients[c.cancelKey()]; !ok {
+			p.clients[c.cancelKey()] = c
+			return
+		}
+	}
+}
+
+func (p *ServerPool) unregister(c *PooledConn) {
+	p.mu.Lock()
+	if p.clients[c.cancelKey()] == c {
+		delete(p.clients, c.cancelKey())
+	}
+	p.mu.Unlock()
+}
+
+// Cancel sends the cancel request to the server connection held by the client of the BackendKeyData.
+// It reports whether the BackendKeyData belongs to a client of the pool, the idle clients have nothing to cancel.
+func (p *ServerPool) Cancel(pid, secret uint32) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	c, ok := p.clients[uint64(pid)<<32|uint64(secret)]
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	c.mu.Lock()
+	s := c.server
+	c.mu.Unlock()
+	if s == nil {
+		return true
+	}
+	conn, err := DialPG(c.addr, p.BackendTLS)
+	if err != nil {
+		log.Printf("fail to send cancel request to %s: %v\n", c.addr, err)
+		return true
+	}
+	defer conn.Close()
+	io.Copy(conn, (&message.CancelRequest{RequestCode: cancelRequestCode, ProcessID: s.pid, SecretKey: s.secret}).Reader())
+	return true
+}
+
+func (p *ServerPool) setVerifier(key PoolKey, v *verifier) {
+	p.mu.Lock()
+	p.group(key).verifier = v
+	p.mu.Unlock()
+}
+
+const (
+	stageStartup = iota
+	stageAuth
+	stagePassthrough
+	stageReady
+	stageClosed
+)
+
+// PooledConn is the server connection seen by the pgbroker. It authenticates the client and
+// forwards messages to the server connections taken from the ServerPool.
+type PooledConn struct {
+	// Password is the password of the user known by the proxy, which verifies the later clients by md5 authentication.
+	Password string
+
+	pool     *ServerPool
+	key      PoolKey
+	addr     string
+	verifier *verifier
+	out      *queue
+	in       bytes.Buffer
+
+	mu        sync.Mutex
+	stage     int
+	server    *serverConn
+	pending   int
+	status    byte
+	cleartext string
+	salt      []byte
+	pid       uint32
+	secret    uint32
+}
+
+func newPooledConn(p *ServerPool, key PoolKey, addr string, s *serverConn, v *verifier) *PooledConn {
+	c := &PooledConn{
+		pool:     p,
+		key:      key,
+		addr:     addr,
+		verifier: v,
+		out:      newQueue(1 << 20),
+		server:   s,
+		status:   'I',
+	}
+	p.register(c)
+	return c
+}
+
+func (c *PooledConn) cancelKey() uint64 {
+	return uint64(c.pid)<<32 | uint64(c.secret)
+}
+
+// backendKeyData is the BackendKeyData of the client instead of the server connection.
+func (c *PooledConn) backendKeyData() []byte {
+	b, _ := ioutil.ReadAll((&message.BackendKeyData{ProcessID: c.pid, SecretKey: c.secret}).Reader())
+	return b
+}
+
+func (c *PooledConn) Read(b []byte) (int, error) {
+	return c.out.Read(b)
+}
+
+func (c *PooledConn) Write(b []byte) (int, error) {
+	c.in.Write(b)
+	for {
+		msg, ok := nextMessage(&c.in, c.stage == stageStartup)
+		if !ok {
+			return len(b), nil
+		}
+		if err := c.handle(msg); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *PooledConn) handle(msg []byte) error {
+	c.mu.Lock()
+	switch c.stage {
+	case stageStartup:
+		s := c.server
+		if c.verifier == nil {
+			c.stage = stagePassthrough
+			c.mu.Unlock()
+			go c.copy(s)
+			_, err := s.Write(msg)
+			return err
+		}
+		c.stage = stageAuth
+		c.mu.Unlock()
+		switch c.verifier.method {
+		case authMD5:
+			c.salt = randomBytes(4)
+			c.out.WriteFrom((&message.AuthenticationMD5Password{ID: authMD5, Salt: c.salt}).Reader())
+		case authCleartext:
+			c.out.WriteFrom((&message.AuthenticationCleartextPassword{ID: authCleartext}).Reader())
+		default:
+			c.accept()
+		}
+		return nil
+	case stageAuth:
+		c.mu.Unlock()
+		if msg[0] != 'p' || !c.verifier.verify(message.ReadPasswordMessage(msg[5:]).Password, c.salt) {
+			c.out.WriteFrom(errorResp("FATAL", "28P01", fmt.Sprintf("password authentication failed for user %q", c.key.User)).Reader())
+			c.Close()
+			return nil
+		}
+		c.accept()
+		return nil
+	case stagePassthrough:
+		s := c.server
+		if msg[0] == 'p' && s.method == authCleartext {
+			c.cleartext = message.ReadPasswordMessage(msg[5:]).Password
+		}
+		c.mu.Unlock()
+		_, err := s.Write(msg)
+		return err
+	case stageReady:
+		if msg[0] == 'X' {
+			c.mu.Unlock()
+			return nil
+		}
+		c.mu.Unlock()
+		s, err := c.attach(msg[0] == 'Q' || msg[0] == 'S' || msg[0] == 'F')
+		if err != nil {
+			return err
+		}
+		_, err = s.Write(msg)
+		return err
+	}
+	c.mu.Unlock()
+	return io.ErrClosedPipe
+}
+
+// accept replays the handshake of the server connection to the authenticated client.
+func (c *PooledConn) accept() {
+	c.mu.Lock()
+	s := c.server
+	c.stage = stageReady
+	c.mu.Unlock()
+
+	c.out.WriteFrom((&message.AuthenticationOk{ID: authOK}).Reader())
+	for _, msg := range s.handshake {
+		c.out.Write(msg)
+	}
+	c.out.Write(c.backendKeyData())
+	c.out.WriteFrom((&message.ReadyForQuery{Status: 'I'}).Reader())
+
+	if c.pool.Mode == PoolingTransaction {
+		c.mu.Lock()
+		c.server = nil
+		c.mu.Unlock()
+		c.pool.release(c.key, s, true)
+	} else {
+		go c.copy(s)
+	}
+}
+
+// attach takes a server connection for the client, and counts the message if it waits for a ReadyForQuery.
+func (c *PooledConn) attach(sync bool) (*serverConn, error) {
+	c.mu.Lock()
+	if c.server == nil {
+		c.mu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), c.pool.WaitTimeout)
+		s, err := c.pool.take(ctx, c.key)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.server = s
+		go c.copy(s)
+	}
+	if sync {
+		c.pending++
+	}
+	s := c.server
+	c.mu.Unlock()
+	return s, nil
+}
+
+// take waits for an idle server connection without dialing, because the client is already authenticated.
+func (p *ServerPool) take(ctx context.Context, key PoolKey) (*serverConn, error) {
+	for {
+		p.mu.Lock()
+		g := p.group(key)
+		if s := p.popIdle(g); s != nil {
+			p.mu.Unlock()
+			return s, nil
+		}
+		wait := g.wait
+		p.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%d server connections of %s/%s on %s are all in use: %w", p.MaxConns, key.User, key.Database, key.Resource, PoolTimeoutErr)
+		}
+	}
+}
+
+// copy forwards the messages of the server connection to the client until the connection is detached.
+func (c *PooledConn) copy(s *serverConn) {
+	for {
+		msg, err := readMessage(s.rd)
+		if err != nil {
+			c.mu.Lock()
+			attached := c.server == s
+			if attached {
+				c.server = nil
+			}
+			c.mu.Unlock()
+			c.pool.release(c.key, s, false)
+			if attached {
+				c.out.CloseWithError(err)
+			}
+			return
+		}
+
+		c.mu.Lock()
+		if s.resetting {
+			c.mu.Unlock()
+			if msg[0] == 'E' {
+				c.pool.release(c.key, s, false)
+				return
+			}
+			if msg[0] == 'Z' {
+				c.pool.release(c.key, s, true)
+				return
+			}
+			continue
+		}
+
+		switch c.stage {
+		case stagePassthrough:
+			c.capture(s, msg)
+			if msg[0] == 'K' {
+				msg = c.backendKeyData()
+			}
+			if c.stage == stageReady && c.pool.Mode == PoolingTransaction && s.poolable {
+				// the fresh server connection is returned to the pool right after the handshake.
+				c.server = nil
+				c.mu.Unlock()
+				c.out.Write(msg)
+				c.pool.release(c.key, s, true)
+				return
+			}
+		case stageReady:
+			if msg[0] == 'Z' {
+				c.pending--
+				c.status = msg[5]
+				if c.pool.Mode == PoolingTransaction && s.poolable && c.pending <= 0 && c.status == 'I' {
+					c.pending = 0
+					c.server = nil
+					c.mu.Unlock()
+					c.out.Write(msg)
+					c.reset(s)
+					return
+				}
+			}
+		}
+		c.mu.Unlock()
+
+		if err := c.out.Write(msg); err != nil {
+			c.pool.release(c.key, s, false)
+			return
+		}
+	}
+}
+
+// capture records the authentication and the handshake of the server connection. The c.mu should be held.
+func (c *PooledConn) capture(s *serverConn, msg []byte) {
+	switch msg[0] {
+	case 'R':
+		switch message.ReadAuthentication(msg[5:]).(type) {
+		case *message.AuthenticationOk:
+			s.authed = true
+		case *message.AuthenticationMD5Password:
+			s.method = authMD5
+		case *message.AuthenticationCleartextPassword:
+			s.method = authCleartext
+		case *message.AuthenticationSASL:
+			s.method = authSASL
+		case *message.AuthenticationSASLContinue, *message.AuthenticationSASLFinal:
+		default:
+			s.method = 1
+		}
+	case 'S':
+		s.handshake = append(s.handshake, msg)
+	case 'K':
+		key := message.ReadBackendKeyData(msg[5:])
+		s.pid, s.secret = key.ProcessID, key.SecretKey
+	case 'E':
+		c.stage = stageClosed
+	case 'Z':
+		c.stage = stageReady
+		if !s.authed {
+			return
+		}
+		v := &verifier{method: s.method}
+		switch {
+		case s.method == authOK:
+		case c.Password != "":
+			// the later clients answer the md5 challenges by the known password whatever the method of the server
+			v.method, v.secret = authMD5, []byte(md5Secret(c.key.User, c.Password))
+		case s.method == authCleartext:
+			sum := sha256.Sum256([]byte(c.cleartext))
+			v.secret = sum[:]
+		default:
+			// the md5 response of the client can't verify the others with different salts, neither can SASL
+			return
+		}
+		s.poolable = true
+		c.verifier = v
+		c.pool.setVerifier(c.key, v)
+	}
+}
+
+// reset executes the ResetQuery on the detached server connection, the copy of it returns it to the pool after done.
+// An empty ResetQuery is still sent to make sure the server connection is healthy.
+func (c *PooledConn) reset(s *serverConn) {
+	c.mu.Lock()
+	s.resetting = true
+	c.mu.Unlock()
+
+	if _, err := io.Copy(s, (&message.Query{QueryString: c.pool.ResetQuery}).Reader()); err != nil {
+		c.pool.release(c.key, s, false)
+		return
+	}
+	go c.copy(s)
+}
+
+func (c *PooledConn) Close() error {
+	c.pool.unregister(c)
+	c.mu.Lock()
+	prev, s := c.stage, c.server
+	if prev == stageClosed && s == nil {
+		c.mu.Unlock()
+		return nil
+	}
+	reusable := prev == stageReady && c.pending <= 0 && c.status == 'I' && s != nil && s.poolable
+	if reusable {
+		s.resetting = true
+	}
+	c.server = nil
+	c.stage = stageClosed
+	c.mu.Unlock()
+
+	c.out.CloseWithError(io.EOF)
+	switch {
+	case s == nil:
+		return nil
+	case prev == stageAuth || (prev == stageStartup && c.verifier != nil):
+		// the idle server connection is not used by the client yet.
+		c.pool.release(c.key, s, true)
+		return nil
+	case prev == stageStartup:
+		c.pool.release(c.key, s, false)
+		return nil
+	case reusable:
+		// the copy of the server connection takes the responses of the ResetQuery and releases it.
+		if _, err := io.Copy(s, (&message.Query{QueryString: c.pool.ResetQuery}).Reader()); err == nil {
+			return nil
+		}
+	}
+	// closing the server connection stops its copy, which releases it from the pool.
+	return s.Conn.Close()
+}
+
+func (c *PooledConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *PooledConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	if addr == nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+func (c *PooledConn) SetDeadline(t time.Time) error      { return nil }
+func (c *PooledConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *PooledConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// nextMessage takes a complete message from the buffer, the startup message has no type byte.
+func nextMessage(buf *bytes.Buffer, startup bool) ([]byte, bool) {
+	b := buf.Bytes()
+	offset := 1
+	if startup {
+		offset = 0
+	}
+	if len(b) < offset+4 {
+		return nil, false
+	}
+	n := offset + int(binary.BigEndian.Uint32(b[offset:offset+4]))
+	if len(b) < n {
+		return nil, false
+	}
+	msg := make([]byte, n)
+	buf.Read(msg)
+	return msg, true
+}
+
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 1+binary.BigEndian.Uint32(head[1:]))
+	copy(msg, head)
+	if _, err := io.ReadFull(r, msg[5:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func errorResp(severity, code, msg string) *message.ErrorResponse {
+	return &message.ErrorResponse{Fields: []message.ErrorField{
+		{Type: 'S', Value: severity},
+		{Type: 'C', Value: code},
+		{Type: 'M', Value: msg},
+	}}
+}
+
+// queue buffers the messages to the client, the writers wait when it is over the limit.
+type queue struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	buf   bytes.Buffer
+	limit int
+	err   error
+}
+
+func newQueue(limit int) *queue {
+	q := &queue{limit: limit}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *queue) Write(b []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.buf.Len() > q.limit && q.err == nil {
+		q.cond.Wait()
+	}
+	if q.err != nil {
+		return q.err
+	}
+	q.buf.Write(b)
+	q.cond.Broadcast()
+	return nil
+}
+
+func (q *queue) WriteFrom(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return q.Write(b)
+}
+
+func (q *queue) Read(b []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.buf.Len() == 0 && q.err == nil {
+		q.cond.Wait()
+	}
+	if q.buf.Len() > 0 {
+		n, _ := q.buf.Read(b)
+		q.cond.Broadcast()
+		return n, nil
+	}
+	return 0, q.err
+}
+
+func (q *queue) CloseWithError(err error) {
+	q.mu.Lock()
+	if q.err == nil {
+		q.err = err
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
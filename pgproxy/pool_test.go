@@ -0,0 +1,432 @@
+package pgproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rueian/pgbroker/message"
+)
+
+const (
+	testUser     = "u"
+	testPassword = "secret"
+)
+
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// fakeBackend is a postgres server with md5, cleartext or SASL authentication, which answers queries with "<backend id> <query>".
+type fakeBackend struct {
+	ln      net.Listener
+	method  uint32
+	dialed  int32
+	queries chan string
+	cancels chan string
+}
+
+func startFakeBackend(t *testing.T) *fakeBackend {
+	return startBackend(t, authMD5)
+}
+
+func startBackend(t *testing.T, method uint32) *fakeBackend {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBackend{ln: ln, method: method, queries: make(chan string, 100), cancels: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn, atomic.AddInt32(&b.dialed, 1))
+		}
+	}()
+	return b
+}
+
+func (b *fakeBackend) serve(conn net.Conn, id int32) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(rd, head); err != nil {
+		return
+	}
+	startup := make([]byte, binary.BigEndian.Uint32(head)-4)
+	if _, err := io.ReadFull(rd, startup); err != nil {
+		return
+	}
+	if binary.BigEndian.Uint32(startup) == cancelRequestCode {
+		b.cancels <- fmt.Sprintf("%d %d", binary.BigEndian.Uint32(startup[4:]), binary.BigEndian.Uint32(startup[8:]))
+		return
+	}
+
+	if b.method == authSASL {
+		if !b.scram(conn, rd) {
+			io.Copy(conn, errorResp("FATAL", "28P01", "password authentication failed").Reader())
+			return
+		}
+		b.ready(conn, id)
+		b.query(conn, rd, id)
+		return
+	}
+
+	salt := []byte{byte(id), 2, 3, 4}
+	want := md5Password(testUser, testPassword, salt)
+	if b.method == authCleartext {
+		want = testPassword
+		io.Copy(conn, (&message.AuthenticationCleartextPassword{ID: authCleartext}).Reader())
+	} else {
+		io.Copy(conn, (&message.AuthenticationMD5Password{ID: authMD5, Salt: salt}).Reader())
+	}
+	msg, err := readMessage(rd)
+	if err != nil || message.ReadPasswordMessage(msg[5:]).Password != want {
+		io.Copy(conn, errorResp("FATAL", "28P01", "password authentication failed").Reader())
+		return
+	}
+	b.ready(conn, id)
+	b.query(conn, rd, id)
+}
+
+// scram verifies the SCRAM-SHA-256 exchange of the testPassword.
+func (b *fakeBackend) scram(conn net.Conn, rd *bufio.Reader) bool {
+	s := &scramServer{keys: newScramKeys(testPassword, randomBytes(16), 4096)}
+	io.Copy(conn, (&message.AuthenticationSASL{ID: authSASL, Mechanisms: []string{scramMechanism}}).Reader())
+	msg, err := readMessage(rd)
+	if err != nil {
+		return false
+	}
+	serverFirst, err := s.first(string(message.ReadSASLInitialResponse(msg[5:]).Response.DataBytes()))
+	if err != nil {
+		return false
+	}
+	io.Copy(conn, (&message.AuthenticationSASLContinue{ID: authSASLContinue, Data: []byte(serverFirst)}).Reader())
+	if msg, err = readMessage(rd); err != nil {
+		return false
+	}
+	serverFinal, ok, err := s.final(string(message.ReadSASLResponse(msg[5:]).Data))
+	if err != nil || !ok {
+		return false
+	}
+	io.Copy(conn, (&message.AuthenticationSASLFinal{ID: authSASLFinal, Data: []byte(serverFinal)}).Reader())
+	return true
+}
+
+func (b *fakeBackend) ready(conn net.Conn, id int32) {
+	io.Copy(conn, (&message.AuthenticationOk{}).Reader())
+	io.Copy(conn, (&message.ParameterStatus{Name: "server_version", Value: "11"}).Reader())
+	io.Copy(conn, (&message.BackendKeyData{ProcessID: uint32(id), SecretKey: 1}).Reader())
+	io.Copy(conn, (&message.ReadyForQuery{Status: 'I'}).Reader())
+}
+
+func (b *fakeBackend) query(conn net.Conn, rd *bufio.Reader, id int32) {
+	status := byte('I')
+	for {
+		msg, err := readMessage(rd)
+		if err != nil || msg[0] == 'X' {
+			return
+		}
+		if msg[0] == 'S' {
+			io.Copy(conn, (&message.ReadyForQuery{Status: status}).Reader())
+			continue
+		}
+		if msg[0] != 'Q' {
+			continue
+		}
+		query := message.ReadQuery(msg[5:]).QueryString
+		b.queries <- fmt.Sprintf("%d %s", id, query)
+		switch query {
+		case "BEGIN":
+			status = 'T'
+		case "COMMIT":
+			status = 'I'
+		}
+		io.Copy(conn, (&message.CommandComplete{CommandTag: fmt.Sprintf("%d %s", id, query)}).Reader())
+		io.Copy(conn, (&message.ReadyForQuery{Status: status}).Reader())
+	}
+}
+
+type testClient struct {
+	conn net.Conn
+	rd   *bufio.Reader
+	salt []byte
+	key  *message.BackendKeyData
+}
+
+// login authenticates like a client through the pgbroker.
+func login(pool *ServerPool, addr, password string) (*testClient, error) {
+	return loginKnown(pool, addr, password, "")
+}
+
+// loginKnown authenticates with the known password of the proxy, like the clients authenticated by the Authenticator.
+func loginKnown(pool *ServerPool, addr, password, known string) (*testClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := pool.Get(ctx, PoolKey{Pool: "pg11", Resource: "r", User: testUser, Database: "db"}, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.Password = known
+	c := &testClient{conn: conn, rd: bufio.NewReader(conn)}
+	var scram *scramClient
+	io.Copy(conn, (&message.StartupMessage{ProtocolVersion: 196608, Parameters: map[string]string{"user": testUser, "database": "db"}}).Reader())
+
+	for {
+		msg, err := readMessage(c.rd)
+		if err != nil {
+			return nil, err
+		}
+		switch msg[0] {
+		case 'R':
+			switch auth := message.ReadAuthentication(msg[5:]).(type) {
+			case *message.AuthenticationMD5Password:
+				c.salt = auth.Salt
+				io.Copy(conn, (&message.PasswordMessage{Password: md5Password(testUser, password, auth.Salt)}).Reader())
+			case *message.AuthenticationCleartextPassword:
+				io.Copy(conn, (&message.PasswordMessage{Password: password}).Reader())
+			case *message.AuthenticationSASL:
+				scram = &scramClient{password: password}
+				io.Copy(conn, (&message.SASLInitialResponse{Mechanism: scramMechanism, Response: message.NewValue([]byte(scram.first()))}).Reader())
+			case *message.AuthenticationSASLContinue:
+				final, err := scram.final(string(auth.Data))
+				if err != nil {
+					return nil, err
+				}
+				io.Copy(conn, (&message.SASLResponse{Data: []byte(final)}).Reader())
+			}
+		case 'K':
+			c.key = message.ReadBackendKeyData(msg[5:])
+		case 'E':
+			conn.Close()
+			return nil, errors.New(message.ReadErrorResponse(msg[5:]).Fields[2].Value)
+		case 'Z':
+			return c, nil
+		}
+	}
+}
+
+func (c *testClient) query(q string) (string, error) {
+	io.Copy(c.conn, (&message.Query{QueryString: q}).Reader())
+	var tag string
+	for {
+		msg, err := readMessage(c.rd)
+		if err != nil {
+			return "", err
+		}
+		switch msg[0] {
+		case 'C':
+			tag = message.ReadCommandComplete(msg[5:]).CommandTag
+		case 'Z':
+			return tag, nil
+		}
+	}
+}
+
+func TestServerPool_Session(t *testing.T) {
+	b := startBackend(t, authCleartext)
+	defer b.ln.Close()
+	pool := NewServerPool(PoolingSession, 1, time.Minute)
+	pool.WaitTimeout = 100 * time.Millisecond
+
+	c1, err := login(pool, b.ln.Addr().String(), testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, err := c1.query("SELECT 1"); err != nil || tag != "1 SELECT 1" {
+		t.Fatalf("unexpected response %q %v", tag, err)
+	}
+	if _, err := login(pool, b.ln.Addr().String(), testPassword); !errors.Is(err, PoolTimeoutErr) {
+		t.Fatalf("expect the pool to be exhausted, got %v", err)
+	}
+	c1.conn.Close()
+
+	if _, err := login(pool, b.ln.Addr().String(), "wrong"); err == nil || !strings.Contains(err.Error(), "password authentication failed") {
+		t.Fatalf("expect wrong password rejected by the proxy, got %v", err)
+	}
+
+	c2, err := login(pool, b.ln.Addr().String(), testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, err := c2.query("SELECT 2"); err != nil || tag != "1 SELECT 2" {
+		t.Fatalf("expect the server connection reused, got %q %v", tag, err)
+	}
+	c2.conn.Close()
+
+	var queries []string
+	for len(b.queries) > 0 {
+		queries = append(queries, <-b.queries)
+	}
+	if strings.Join(queries, ",") != "1 SELECT 1,1 DISCARD ALL,1 SELECT 2" {
+		t.Fatalf("unexpected queries on the backend %v", queries)
+	}
+	if n := atomic.LoadInt32(&b.dialed); n != 1 {
+		t.Fatalf("expect 1 server connection, got %d", n)
+	}
+}
+
+func TestServerPool_Transaction(t *testing.T) {
+	b := startBackend(t, authCleartext)
+	defer b.ln.Close()
+	pool := NewServerPool(PoolingTransaction, 1, time.Minute)
+
+	c1, err := login(pool, b.ln.Addr().String(), testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second client shares the only server connection between transactions
+	c2, err := login(pool, b.ln.Addr().String(), testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		c     *testClient
+		query string
+	}{
+		{c1, "BEGIN"},
+		{c1, "SELECT 1"},
+		{c1, "COMMIT"},
+		{c2, "SELECT 2"},
+		{c1, "SELECT 3"},
+	} {
+		if tag, err := step.c.query(step.query); err != nil || tag != "1 "+step.query {
+			t.Fatalf("unexpected response of %q: %q %v", step.query, tag, err)
+		}
+	}
+	if n := atomic.LoadInt32(&b.dialed); n != 1 {
+		t.Fatalf("expect 1 server connection, got %d", n)
+	}
+
+	if c1.key == nil || c2.key == nil || *c1.key == *c2.key || c1.key.ProcessID == 1 || c2.key.ProcessID == 1 {
+		t.Fatalf("expect the clients to have their own key data, got %v %v", c1.key, c2.key)
+	}
+
+	// the cancel request of c1 is routed to the server connection it holds
+	if _, err := c1.query("BEGIN"); err != nil {
+		t.Fatal(err)
+	}
+	if !pool.Cancel(c2.key.ProcessID, c2.key.SecretKey) || !pool.Cancel(c1.key.ProcessID, c1.key.SecretKey) {
+		t.Fatal("expect the key data of the clients handled by the pool")
+	}
+	select {
+	case cancel := <-b.cancels:
+		if cancel != "1 1" {
+			t.Fatalf("unexpected cancel request %q", cancel)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect the cancel request sent to the backend")
+	}
+	if len(b.cancels) != 0 {
+		t.Fatal("expect no cancel request of the idle client")
+	}
+	if pool.Cancel(1, 1) {
+		t.Fatal("expect the key data of the server connection not handled by the pool")
+	}
+	c1.conn.Close()
+	c2.conn.Close()
+	if pool.Cancel(c1.key.ProcessID, c1.key.SecretKey) {
+		t.Fatal("expect the key data released after the client disconnected")
+	}
+}
+
+func TestServerPool_MD5(t *testing.T) {
+	b := startFakeBackend(t)
+	defer b.ln.Close()
+	pool := NewServerPool(PoolingTransaction, 2, time.Minute)
+
+	// the md5 server connections are not shared, because the proxy can't verify the clients
+	for _, q := range []string{"SELECT 1", "SELECT 2"} {
+		c, err := login(pool, b.ln.Addr().String(), testPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.query(q); err != nil {
+			t.Fatal(err)
+		}
+		defer c.conn.Close()
+	}
+	if n := atomic.LoadInt32(&b.dialed); n != 2 {
+		t.Fatalf("expect 2 server connections, got %d", n)
+	}
+}
+
+func TestServerPool_KnownPassword(t *testing.T) {
+	b := startFakeBackend(t)
+	defer b.ln.Close()
+	pool := NewServerPool(PoolingTransaction, 1, time.Minute)
+
+	c1, err := loginKnown(pool, b.ln.Addr().String(), testPassword, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.conn.Close()
+	if _, err := loginKnown(pool, b.ln.Addr().String(), "wrong", testPassword); err == nil || !strings.Contains(err.Error(), "password authentication failed") {
+		t.Fatalf("expect wrong password rejected by the proxy, got %v", err)
+	}
+	// the md5 server connection is shared with the clients verified by the known password
+	c2, err := loginKnown(pool, b.ln.Addr().String(), testPassword, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.conn.Close()
+	if tag, err := c2.query("SELECT 1"); err != nil || tag != "1 SELECT 1" {
+		t.Fatalf("unexpected response %q %v", tag, err)
+	}
+	if string(c1.salt) == string(c2.salt) {
+		t.Fatalf("expect fresh md5 salts of clients, got %v", c1.salt)
+	}
+	if n := atomic.LoadInt32(&b.dialed); n != 1 {
+		t.Fatalf("expect 1 server connection, got %d", n)
+	}
+}
+
+func TestServerPool_SASL(t *testing.T) {
+	b := startBackend(t, authSASL)
+	defer b.ln.Close()
+	pool := NewServerPool(PoolingTransaction, 1, time.Minute)
+
+	// the SASL server connection is not shared without the known password
+	c1, err := login(pool, b.ln.Addr().String(), testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.conn.Close()
+
+	// but verified by md5 of the known password
+	c2, err := loginKnown(pool, b.ln.Addr().String(), testPassword, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.conn.Close()
+	c3, err := loginKnown(pool, b.ln.Addr().String(), testPassword, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.conn.Close()
+	if c3.salt == nil {
+		t.Fatal("expect the later client verified by md5")
+	}
+	if tag, err := c3.query("SELECT 1"); err != nil || tag != "2 SELECT 1" {
+		t.Fatalf("unexpected response %q %v", tag, err)
+	}
+	if n := atomic.LoadInt32(&b.dialed); n != 2 {
+		t.Fatalf("expect 2 server connections, got %d", n)
+	}
+}
@@ -0,0 +1,126 @@
+package pgproxy
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+const (
+	QueryLogOff         = "off"
+	QueryLogFingerprint = "fingerprint"
+	QueryLogRedacted    = "redacted"
+	QueryLogFull        = "full"
+)
+
+// QueryLogger logs the queries of clients by the mode of their databases. The "fingerprint" mode only logs
+// the fingerprint of queries, and the "redacted" mode replaces the literals with "?". Only the SampleRate of
+// queries are logged. A nil QueryLogger logs all queries in full.
+type QueryLogger struct {
+	Mode       string
+	SampleRate float64
+
+	overrides []queryLogOverride
+}
+
+type queryLogOverride struct {
+	database matcher
+	mode     string
+	rate     float64
+}
+
+func NewQueryLogger(mode string, sampleRate float64) (*QueryLogger, error) {
+	if err := checkQueryLogMode(mode); err != nil {
+		return nil, err
+	}
+	return &QueryLogger{Mode: mode, SampleRate: sampleRate}, nil
+}
+
+func checkQueryLogMode(mode string) error {
+	switch mode {
+	case QueryLogOff, QueryLogFingerprint, QueryLogRedacted, QueryLogFull:
+		return nil
+	}
+	return fmt.Errorf("unknown query log mode %q", mode)
+}
+
+// Override sets the mode and the sample rate of the databases matching the pattern, the first matched override is used.
+func (l *QueryLogger) Override(database, mode string, sampleRate float64) error {
+	if err := checkQueryLogMode(mode); err != nil {
+		return err
+	}
+	m, err := compilePattern(database)
+	if err != nil {
+		return err
+	}
+	l.overrides = append(l.overrides, queryLogOverride{database: m, mode: mode, rate: sampleRate})
+	return nil
+}
+
+// SetOverrides parses the overrides like "analytics=fingerprint:0.1,app_*=off", the sample rate is the SampleRate if omitted.
+func (l *QueryLogger) SetOverrides(spec string) error {
+	for _, o := range strings.Split(spec, ",") {
+		if o = strings.TrimSpace(o); o == "" {
+			continue
+		}
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("malformed query log override %q", o)
+		}
+		mode, rate := parts[1], l.SampleRate
+		if i := strings.IndexByte(mode, ':'); i >= 0 {
+			r, err := strconv.ParseFloat(mode[i+1:], 64)
+			if err != nil {
+				return fmt.Errorf("malformed query log override %q: %w", o, err)
+			}
+			mode, rate = mode[:i], r
+		}
+		if err := l.Override(parts[0], mode, rate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *QueryLogger) policy(database string) (string, float64) {
+	if l == nil {
+		return QueryLogFull, 1
+	}
+	for _, o := range l.overrides {
+		if o.database(database) {
+			return o.mode, o.rate
+		}
+	}
+	return l.Mode, l.SampleRate
+}
+
+// Log logs the query of the client if it is sampled.
+func (l *QueryLogger) Log(params map[string]string, query string) {
+	database, user := params["database"], params["user"]
+	mode, rate := l.policy(database)
+	if mode == QueryLogOff || (rate < 1 && rand.Float64() >= rate) {
+		return
+	}
+	log.Printf("Query: db=%s user=%s %s\n", database, user, render(mode, query))
+}
+
+// Format renders the query of the database in its mode for other logs, which are not sampled.
+func (l *QueryLogger) Format(database, query string) string {
+	mode, _ := l.policy(database)
+	return render(mode, query)
+}
+
+func render(mode, query string) string {
+	switch mode {
+	case QueryLogFull:
+		return "query=" + strings.ReplaceAll(query, "\n", " ")
+	case QueryLogRedacted:
+		return "query=" + Redact(query)
+	case QueryLogFingerprint:
+		id, _ := Fingerprint(query)
+		return "fingerprint=" + id
+	}
+	return ""
+}
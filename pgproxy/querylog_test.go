@@ -0,0 +1,47 @@
+package pgproxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	redacted := Redact("ALTER USER app PASSWORD 'secret'; /* note */ SELECT * FROM \"Users\"\n WHERE email = E'a\\'b' AND age > 30 AND id = $1")
+	if redacted != `ALTER USER app PASSWORD ?; SELECT * FROM "Users" WHERE email = ? AND age > ? AND id = $1` {
+		t.Fatalf("unexpected redacted query %q", redacted)
+	}
+}
+
+func TestQueryLogger_Format(t *testing.T) {
+	l, err := NewQueryLogger(QueryLogRedacted, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetOverrides("analytics=fingerprint:0.1, /^debug_/=full,app_*=off"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewQueryLogger("verbose", 1); err == nil {
+		t.Fatalf("expect unknown mode rejected")
+	}
+
+	query := "SELECT * FROM t WHERE password = 'secret'"
+	id, _ := Fingerprint(query)
+	for database, expected := range map[string]string{
+		"main":       "query=SELECT * FROM t WHERE password = ?",
+		"analytics":  "fingerprint=" + id,
+		"debug_main": "query=" + query,
+		"app_1":      "",
+	} {
+		if formatted := l.Format(database, query); formatted != expected {
+			t.Fatalf("expect %q of %s, got %q", expected, database, formatted)
+		}
+	}
+	if mode, rate := l.policy("analytics"); mode != QueryLogFingerprint || rate != 0.1 {
+		t.Fatalf("unexpected policy of analytics %s %v", mode, rate)
+	}
+
+	var full *QueryLogger
+	if formatted := full.Format("main", "SELECT\n1"); !strings.HasSuffix(formatted, "SELECT 1") {
+		t.Fatalf("expect nil logger formats in full, got %q", formatted)
+	}
+}
@@ -2,65 +2,186 @@ package pgproxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/rueian/godemand/client"
 	"github.com/rueian/godemand/types"
 )
 
-var DatabaseMap = map[string]string{
-	"db1": "pg10",
-	"db2": "pg11",
-}
-
 type GodemandResolver struct {
-	Host        string
-	DatabaseMap map[string]string
+	Host   string
+	Router *Router
+	Pool   *ServerPool
+	// BackendTLS re-encrypts the connections to the backends if not nil.
+	BackendTLS *tls.Config
+	// Auth authenticates the clients by the proxy, and the backends are authenticated by the mapped credentials.
+	Auth *Authenticator
+	// Boot notices the clients the boot progress of their backends and answers the failures with retry hints.
+	Boot *BootNotifier
+	// Admission queues the clients requesting resources of the same pool.
+	Admission *Admission
+	// Drains finds the draining resources, whose idle sessions are disconnected.
+	Drains *DrainWatcher
+	// FailoverTimeout enables replacing the lost backends of idle sessions, which waits for a new resource within it.
+	FailoverTimeout time.Duration
+	// Firewall blocks the queries by its rules, which are answered by the proxy.
+	Firewall *Firewall
 }
 
 func (r *GodemandResolver) GetPGConn(ctx context.Context, clientAddr net.Addr, parameters map[string]string) (net.Conn, error) {
 	database := parameters["database"]
 	user := parameters["user"]
 
-	pool, ok := r.DatabaseMap[database]
+	pool, ok := r.Router.Route(clientAddr, parameters)
 	if !ok {
 		return nil, errors.New("database " + database + " is not supported by godemand")
 	}
 
+	var cred *Credential
+	if r.Auth != nil {
+		if cred, ok = r.Auth.Session(clientAddr); !ok {
+			return nil, errors.New("client " + clientAddr.String() + " is not authenticated")
+		}
+	}
+
+	boot := r.Boot.wait(clientAddr, database, cred != nil)
+	defer boot.stop()
+
+	httpClient := http.DefaultClient
+	if boot.notices {
+		httpClient = &http.Client{Transport: &progressTransport{RoundTripper: http.DefaultTransport, progress: boot.progress}}
+	}
+	if r.Boot != nil && r.Boot.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Boot.Timeout)
+		defer cancel()
+	}
+
+	release, err := r.Admission.Acquire(ctx, pool)
+	if err == AdmissionFullErr {
+		boot.fail("53300", fmt.Sprintf("too many clients are waiting for database %q", database))
+		return nil, err
+	}
+	if err != nil {
+		boot.fail("57P03", fmt.Sprintf("database %q is still starting up", database))
+		return nil, err
+	}
+
 	c := client.NewHTTPClient(r.Host, types.Client{
 		ID: clientAddr.String(),
 		Meta: map[string]interface{}{
 			"user":     user,
 			"database": database,
 		},
-	}, http.DefaultClient)
+	}, httpClient)
 
 	res, err := c.RequestResource(ctx, pool)
+	release()
+	if errors.Is(err, client.NotFoundError) {
+		// the pool rejects the request, forward the reason to the client.
+		err = errors.New(strings.TrimSuffix(err.Error(), ": "+client.NotFoundError.Error()))
+		boot.fail("08004", err.Error())
+		return nil, err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		boot.fail("57P03", fmt.Sprintf("database %q is still starting up", database))
+		return nil, err
+	}
 	if err != nil {
+		boot.fail("08001", fmt.Sprintf("fail to request the backend of database %q: %s", database, err.Error()))
 		return nil, err
 	}
 
-	if addr, ok := res.Meta["addr"]; ok {
-		conn, err := net.Dial("tcp", addr.(string))
-		if err != nil {
-			return nil, err
-		}
-		wrapConn := WrapConn(conn.(*net.TCPConn), res, c)
-		go wrapConn.Heartbeat()
+	conn, err := r.connect(ctx, pool, res, user, database, cred, boot.authenticated())
+	if err != nil {
+		boot.fail("08001", fmt.Sprintf("fail to connect the backend of database %q: %s", database, err.Error()))
+		return nil, err
+	}
+	wrapConn := WrapConn(conn, res, c)
+	wrapConn.drains = r.Drains
+	if r.FailoverTimeout > 0 {
+		fc := NewFailoverConn(conn, func() (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(wrapConn.ctx, r.FailoverTimeout)
+			defer cancel()
+			res, err := c.RequestResource(ctx, pool)
+			if err != nil {
+				return nil, err
+			}
+			conn, err := r.connect(ctx, pool, res, user, database, cred, false)
+			if err != nil {
+				return nil, err
+			}
+			wrapConn.setResource(res)
+			return conn, nil
+		})
+		fc.Timeout = r.FailoverTimeout
+		wrapConn.Conn = fc
+	}
+	if r.Firewall != nil {
+		wrapConn.Conn = NewFirewallConn(wrapConn.Conn, r.Firewall, parameters)
+	}
+	go wrapConn.Heartbeat()
+
+	return wrapConn, nil
+}
 
-		return wrapConn, nil
+// connect dials the backend of the resource, which is authenticated by the mapped credential if not nil.
+func (r *GodemandResolver) connect(ctx context.Context, pool string, res types.Resource, user, database string, cred *Credential, authenticated bool) (net.Conn, error) {
+	addr, ok := res.Meta["addr"].(string)
+	if !ok {
+		return nil, errors.New("resource doesn't include the ip addr")
+	}
+
+	var conn net.Conn
+	var err error
+	if r.Pool != nil {
+		key := PoolKey{Pool: pool, Resource: res.ID, User: user, Database: database}
+		if cred != nil {
+			key.User = cred.BackendUser
+		}
+		var pc *PooledConn
+		if pc, err = r.Pool.Get(ctx, key, addr); err == nil {
+			if cred != nil {
+				pc.Password = cred.BackendPassword
+			}
+			conn = pc
+		}
+	} else {
+		conn, err = DialPG(addr, r.BackendTLS)
+	}
+	if err != nil {
+		return nil, err
 	}
+	if cred != nil {
+		auth := NewBackendAuthConn(conn, cred.BackendUser, cred.BackendPassword)
+		auth.SkipAuthenticationOk = authenticated
+		conn = auth
+	}
+	return conn, nil
+}
+
+func (r *GodemandResolver) RewriteParameters(original map[string]string) map[string]string {
+	return r.Router.RewriteParameters(original)
+}
 
-	return nil, errors.New("resource doesn't include the ip addr")
+// Cancel routes the cancel request to the server connection held by the pooled client of the BackendKeyData.
+func (r *GodemandResolver) Cancel(pid, secret uint32) bool {
+	return r.Pool.Cancel(pid, secret)
 }
 
-func WrapConn(conn *net.TCPConn, resource types.Resource, client *client.HTTPClient) *Conn {
+func WrapConn(conn net.Conn, resource types.Resource, client *client.HTTPClient) *Conn {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Conn{
-		TCPConn:  conn,
+		Conn:     conn,
 		resource: resource,
 		client:   client,
 		ctx:      ctx,
@@ -69,7 +190,8 @@ func WrapConn(conn *net.TCPConn, resource types.Resource, client *client.HTTPCli
 }
 
 type Conn struct {
-	*net.TCPConn
+	net.Conn
+	mu       sync.Mutex
 	resource types.Resource
 	client   *client.HTTPClient
 
@@ -77,11 +199,56 @@ type Conn struct {
 	cancel      context.CancelFunc
 	heartbeat   bool
 	heartbeatAt time.Time
+	// beating serializes the heartbeats, the client is not safe for concurrent use.
+	beating sync.Mutex
+
+	drains   *DrainWatcher
+	status   byte
+	draining bool
+	drained  bool
+	final    io.Reader
 }
 
 func (c *Conn) Close() error {
 	c.cancel()
-	return c.TCPConn.Close()
+	return c.Conn.Close()
+}
+
+// Read ends the session with a FATAL ErrorResponse if it is disconnected due to the draining resource.
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == nil {
+		return n, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.drained {
+		return n, err
+	}
+	if c.final == nil {
+		c.final = errorResp("FATAL", "57P01", "terminating connection due to the backend draining").Reader()
+	}
+	return c.final.Read(b)
+}
+
+// Ready records the transaction status of the ReadyForQuery, and disconnects the idle session of the draining resource.
+func (c *Conn) Ready(status byte) {
+	c.mu.Lock()
+	c.status = status
+	c.mu.Unlock()
+	c.drain()
+}
+
+// drain disconnects the session if it is idle and the resource is draining, the in-flight transactions are left to finish.
+func (c *Conn) drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.draining || c.drained || c.heartbeat || c.status != 'I' {
+		return
+	}
+	log.Printf("disconnect the idle session of the draining resource %q\n", c.resource.ID)
+	c.drained = true
+	c.Conn.Close()
 }
 
 func (c *Conn) Heartbeat() {
@@ -91,24 +258,59 @@ func (c *Conn) Heartbeat() {
 			return
 		default:
 		}
-		if c.heartbeat {
+		c.mu.Lock()
+		heartbeat, resource := c.heartbeat, c.resource
+		if heartbeat {
 			c.heartbeatAt = time.Now()
-			c.client.Heartbeat(c.ctx, c.resource)
+		}
+		c.mu.Unlock()
+		if heartbeat {
+			c.beat(resource)
+		}
+		if c.drains.Draining(c.ctx, c.getResource()) {
+			c.mu.Lock()
+			c.draining = true
+			c.mu.Unlock()
+			c.drain()
 		}
 		time.Sleep(10 * time.Second)
 	}
 }
 
 func (c *Conn) StartHeartbeat() {
+	c.mu.Lock()
 	c.heartbeat = true
+	c.mu.Unlock()
 }
 
 func (c *Conn) StopHeartbeat() {
+	c.mu.Lock()
 	c.heartbeat = false
-	go func() {
-		if time.Since(c.heartbeatAt) > 10*time.Second {
-			c.heartbeatAt = time.Now()
-			c.client.Heartbeat(c.ctx, c.resource)
-		}
-	}()
+	stale, resource := time.Since(c.heartbeatAt) > 10*time.Second, c.resource
+	if stale {
+		c.heartbeatAt = time.Now()
+	}
+	c.mu.Unlock()
+	if stale {
+		go c.beat(resource)
+	}
+}
+
+func (c *Conn) beat(resource types.Resource) {
+	c.beating.Lock()
+	defer c.beating.Unlock()
+	c.client.Heartbeat(c.ctx, resource)
+}
+
+func (c *Conn) getResource() types.Resource {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resource
+}
+
+// setResource changes the resource of the heartbeats after the backend is replaced.
+func (c *Conn) setResource(resource types.Resource) {
+	c.mu.Lock()
+	c.resource, c.draining = resource, false
+	c.mu.Unlock()
 }
@@ -0,0 +1,290 @@
+package pgproxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Route routes the clients to the Pool by the Database, the User, the ApplicationName, the client CIDR
+// and other startup Params, including the "-c name=value" in the startup options.
+// A pattern is an exact name, a glob like "app_*", or a regex wrapped by slashes like "/^tenant_[0-9]+$/".
+// An empty pattern matches anything. A Pool like "$godemand.pool" is the value of that startup param.
+type Route struct {
+	Database        string            `yaml:"database"`
+	User            string            `yaml:"user"`
+	ApplicationName string            `yaml:"application_name"`
+	CIDR            string            `yaml:"cidr"`
+	Params          map[string]string `yaml:"params"`
+	Pool            string            `yaml:"pool"`
+}
+
+type RoutingConfig struct {
+	Routes  []Route `yaml:"routes"`
+	Default string  `yaml:"default"`
+}
+
+// the routing file is either a RoutingConfig, or a godemand config with a "routing" section
+// and "Databases" patterns in the params of pools.
+type routingFile struct {
+	RoutingConfig `yaml:",inline"`
+	Routing       RoutingConfig `yaml:"routing"`
+	Pools         map[string]struct {
+		Params struct {
+			Databases []string `yaml:"Databases"`
+		} `yaml:"params"`
+	} `yaml:"pools"`
+}
+
+type matcher func(string) bool
+
+type rule struct {
+	Route
+	matchers map[string]matcher
+	cidr     *net.IPNet
+}
+
+func (r rule) match(ip net.IP, params map[string]string) bool {
+	if r.cidr != nil && (ip == nil || !r.cidr.Contains(ip)) {
+		return false
+	}
+	for k, m := range r.matchers {
+		if !m(params[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Router resolves the pool of clients by the routes. The routes with more conditions besides the database
+// are matched before the others, and then the Default pool is used if no route matches.
+type Router struct {
+	mu    sync.RWMutex
+	rules []rule
+	def   string
+}
+
+func NewRouter(config RoutingConfig) (*Router, error) {
+	r := &Router{}
+	if err := r.Set(config); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Router) Set(config RoutingConfig) error {
+	var rules []rule
+	for _, route := range config.Routes {
+		if route.Pool == "" {
+			return fmt.Errorf("route of database %q and user %q has no pool", route.Database, route.User)
+		}
+		patterns := map[string]string{
+			"database":         route.Database,
+			"user":             route.User,
+			"application_name": route.ApplicationName,
+		}
+		for k, v := range route.Params {
+			patterns[k] = v
+		}
+		rl := rule{Route: route, matchers: make(map[string]matcher)}
+		for k, pattern := range patterns {
+			if pattern == "" {
+				continue
+			}
+			m, err := compilePattern(pattern)
+			if err != nil {
+				return err
+			}
+			rl.matchers[k] = m
+		}
+		if route.CIDR != "" {
+			_, cidr, err := net.ParseCIDR(route.CIDR)
+			if err != nil {
+				return err
+			}
+			rl.cidr = cidr
+		}
+		rules = append(rules, rl)
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].conditions() > rules[j].conditions() })
+
+	r.mu.Lock()
+	r.rules, r.def = rules, config.Default
+	r.mu.Unlock()
+	return nil
+}
+
+func (r rule) conditions() (n int) {
+	n = len(r.matchers)
+	if _, ok := r.matchers["database"]; ok {
+		n--
+	}
+	if r.cidr != nil {
+		n++
+	}
+	return n
+}
+
+// Route resolves the pool by the client address and its startup parameters.
+func (r *Router) Route(clientAddr net.Addr, parameters map[string]string) (string, bool) {
+	var ip net.IP
+	if addr, ok := clientAddr.(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	params := StartupParams(parameters)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rule := range r.rules {
+		if !rule.match(ip, params) {
+			continue
+		}
+		if strings.HasPrefix(rule.Pool, "$") {
+			pool := params[rule.Pool[1:]]
+			return pool, pool != ""
+		}
+		return rule.Pool, true
+	}
+	return r.def, r.def != ""
+}
+
+// StartupParams copies the startup parameters with the "-c name=value" or "--name=value" in the options.
+func StartupParams(parameters map[string]string) map[string]string {
+	params := make(map[string]string, len(parameters))
+	for _, opt := range parseOptions(parameters["options"]) {
+		params[opt[0]] = opt[1]
+	}
+	for k, v := range parameters {
+		params[k] = v
+	}
+	return params
+}
+
+// RewriteParameters removes the godemand options, which are only for routing, from the startup options.
+func (r *Router) RewriteParameters(original map[string]string) map[string]string {
+	rewritten := make(map[string]string, len(original))
+	for k, v := range original {
+		rewritten[k] = v
+	}
+	if options, ok := original["options"]; ok {
+		var kept []string
+		for _, opt := range parseOptions(options) {
+			if !strings.HasPrefix(opt[0], "godemand.") {
+				kept = append(kept, "-c "+opt[0]+"="+opt[1])
+			}
+		}
+		if len(kept) == 0 {
+			delete(rewritten, "options")
+		} else {
+			rewritten["options"] = strings.Join(kept, " ")
+		}
+	}
+	return rewritten
+}
+
+func parseOptions(options string) (opts [][2]string) {
+	fields := strings.Fields(options)
+	for i := 0; i < len(fields); i++ {
+		var kv string
+		switch f := fields[i]; {
+		case f == "-c" && i+1 < len(fields):
+			i++
+			kv = fields[i]
+		case strings.HasPrefix(f, "-c"):
+			kv = f[2:]
+		case strings.HasPrefix(f, "--"):
+			kv = f[2:]
+		default:
+			continue
+		}
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+			opts = append(opts, [2]string{strings.ReplaceAll(parts[0], "-", "_"), parts[1]})
+		}
+	}
+	return
+}
+
+// Load sets the routes from the yaml or json file.
+func (r *Router) Load(path string) error {
+	config, err := LoadRoutingConfig(path)
+	if err != nil {
+		return err
+	}
+	return r.Set(config)
+}
+
+// Watch reloads the routes from the file periodically, the current routes are kept if the file is broken.
+func (r *Router) Watch(ctx context.Context, path string, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if err := r.Load(path); err != nil {
+			log.Printf("fail to reload routing file %q: %v\n", path, err)
+		}
+	}
+}
+
+func LoadRoutingConfig(path string) (config RoutingConfig, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	var f routingFile
+	if err = yaml.Unmarshal(b, &f); err != nil {
+		return config, err
+	}
+
+	config.Routes = append(f.Routes, f.Routing.Routes...)
+	if config.Default = f.Default; config.Default == "" {
+		config.Default = f.Routing.Default
+	}
+
+	ids := make([]string, 0, len(f.Pools))
+	for id := range f.Pools {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, database := range f.Pools[id].Params.Databases {
+			config.Routes = append(config.Routes, Route{Database: database, Pool: id})
+		}
+	}
+	return config, nil
+}
+
+func compilePattern(pattern string) (matcher, error) {
+	switch {
+	case pattern == "":
+		return func(string) bool { return true }, nil
+	case len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed regex pattern %q: %w", pattern, err)
+		}
+		return re.MatchString, nil
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("malformed glob pattern %q: %w", pattern, err)
+		}
+		return func(s string) bool {
+			ok, _ := path.Match(pattern, s)
+			return ok
+		}, nil
+	}
+	return func(s string) bool { return s == pattern }, nil
+}
@@ -0,0 +1,108 @@
+package pgproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRouter_Route(t *testing.T) {
+	r, err := NewRouter(RoutingConfig{
+		Routes: []Route{
+			{Database: "db1", Pool: "pg10"},
+			{Database: "app_*", Pool: "pg11"},
+			{Database: "/^tenant_[0-9]+$/", Pool: "tenants"},
+			{Database: "db1", User: "admin", Pool: "admin"},
+			{ApplicationName: "metabase", Pool: "report"},
+			{CIDR: "10.1.0.0/16", Database: "db1", Pool: "office"},
+			{Params: map[string]string{"godemand.pool": "pg11-*"}, Pool: "$godemand.pool"},
+		},
+		Default: "pg11",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 5432}
+	office := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5432}
+	for _, c := range []struct {
+		addr   net.Addr
+		params map[string]string
+		pool   string
+	}{
+		{client, map[string]string{"user": "u", "database": "db1"}, "pg10"},
+		{client, map[string]string{"user": "admin", "database": "db1"}, "admin"},
+		{office, map[string]string{"user": "u", "database": "db1"}, "office"},
+		{client, map[string]string{"user": "u", "database": "app_orders"}, "pg11"},
+		{client, map[string]string{"user": "u", "database": "tenant_42"}, "tenants"},
+		{client, map[string]string{"user": "u", "database": "tenant_x"}, "pg11"},
+		{client, map[string]string{"user": "u", "database": "db1", "application_name": "metabase"}, "report"},
+		{client, map[string]string{"user": "u", "database": "db1", "options": "-c godemand.pool=pg11-big"}, "pg11-big"},
+		{client, map[string]string{"user": "u", "database": "db1", "options": "--godemand.pool=pg11-ssd"}, "pg11-ssd"},
+		{client, map[string]string{"user": "u", "database": "db1", "options": "-c godemand.pool=pg12"}, "pg10"},
+	} {
+		if pool, ok := r.Route(c.addr, c.params); !ok || pool != c.pool {
+			t.Errorf("expect %v routed to %q, got %q", c.params, c.pool, pool)
+		}
+	}
+
+	r.Set(RoutingConfig{})
+	if pool, ok := r.Route(client, map[string]string{"database": "db1"}); ok {
+		t.Errorf("expect no route without default, got %q", pool)
+	}
+
+	if _, err := NewRouter(RoutingConfig{Routes: []Route{{Database: "/(/", Pool: "p"}}}); err == nil {
+		t.Errorf("expect error of malformed regex")
+	}
+	if _, err := NewRouter(RoutingConfig{Routes: []Route{{CIDR: "10.1.0.0", Pool: "p"}}}); err == nil {
+		t.Errorf("expect error of malformed cidr")
+	}
+}
+
+func TestRouter_RewriteParameters(t *testing.T) {
+	r := &Router{}
+	rewritten := r.RewriteParameters(map[string]string{"user": "u", "options": "-c godemand.pool=pg11-big -c statement_timeout=5s"})
+	if rewritten["user"] != "u" || rewritten["options"] != "-c statement_timeout=5s" {
+		t.Errorf("expect godemand options removed, got %v", rewritten)
+	}
+	if _, ok := r.RewriteParameters(map[string]string{"options": "--godemand.pool=pg11-big"})["options"]; ok {
+		t.Errorf("expect empty options removed")
+	}
+}
+
+func TestLoadRoutingConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "godemand.yaml")
+	ioutil.WriteFile(path, []byte(`
+pools:
+  pg10:
+    plugin: pgplugin
+    params:
+      Databases: [db1]
+  pg11:
+    params:
+      Databases: ["app_*"]
+routing:
+  routes:
+    - database: db2
+      pool: pg11
+  default: pg10
+`), 0600)
+
+	r := &Router{}
+	if err := r.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	for database, expect := range map[string]string{"db1": "pg10", "db2": "pg11", "app_x": "pg11", "other": "pg10"} {
+		if pool, _ := r.Route(nil, map[string]string{"database": database}); pool != expect {
+			t.Errorf("expect %s routed to %q, got %q", database, expect, pool)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package pgproxy
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	scramMechanism  = "SCRAM-SHA-256"
+	scramIterations = 4096
+)
+
+var ScramErr = errors.New("malformed SCRAM-SHA-256 message")
+
+// scramKeys is the SCRAM-SHA-256 verifier of a password, as stored by postgres in the format of
+// "SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>".
+type scramKeys struct {
+	iter      int
+	salt      []byte
+	storedKey []byte
+	serverKey []byte
+}
+
+func newScramKeys(password string, salt []byte, iter int) scramKeys {
+	clientKey, serverKey := scramSaltedKeys(password, salt, iter)
+	storedKey := sha256.Sum256(clientKey)
+	return scramKeys{iter: iter, salt: salt, storedKey: storedKey[:], serverKey: serverKey}
+}
+
+func parseScramKeys(secret string) (keys scramKeys, err error) {
+	parts := strings.Split(strings.TrimPrefix(secret, scramMechanism+"$"), "$")
+	if len(parts) != 2 {
+		return keys, fmt.Errorf("malformed SCRAM-SHA-256 secret")
+	}
+	iterSalt, storedServer := strings.Split(parts[0], ":"), strings.Split(parts[1], ":")
+	if len(iterSalt) != 2 || len(storedServer) != 2 {
+		return keys, fmt.Errorf("malformed SCRAM-SHA-256 secret")
+	}
+	if keys.iter, err = strconv.Atoi(iterSalt[0]); err != nil {
+		return keys, err
+	}
+	if keys.salt, err = base64.StdEncoding.DecodeString(iterSalt[1]); err != nil {
+		return keys, err
+	}
+	if keys.storedKey, err = base64.StdEncoding.DecodeString(storedServer[0]); err != nil {
+		return keys, err
+	}
+	keys.serverKey, err = base64.StdEncoding.DecodeString(storedServer[1])
+	return keys, err
+}
+
+func (k scramKeys) String() string {
+	b64 := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("%s$%d:%s$%s:%s", scramMechanism, k.iter, b64(k.salt), b64(k.storedKey), b64(k.serverKey))
+}
+
+func scramSaltedKeys(password string, salt []byte, iter int) (clientKey, serverKey []byte) {
+	// Hi() of RFC 5802, which is the PBKDF2 of one block
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	salted := append([]byte(nil), u...)
+	for i := 1; i < iter; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range salted {
+			salted[j] ^= u[j]
+		}
+	}
+	return hmacSum(salted, "Client Key"), hmacSum(salted, "Server Key")
+}
+
+func hmacSum(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// scramAttrs parses the "k=v" attributes separated by ",".
+func scramAttrs(msg string) map[byte]string {
+	attrs := make(map[byte]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) >= 2 && attr[1] == '=' {
+			attrs[attr[0]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+// scramServer is the server side of a SCRAM-SHA-256 exchange, without channel binding.
+type scramServer struct {
+	keys        scramKeys
+	gs2Header   string
+	clientFirst string
+	serverFirst string
+	nonce       string
+}
+
+// first takes the client-first-message and returns the server-first-message.
+func (s *scramServer) first(clientFirst string) (string, error) {
+	parts := strings.SplitN(clientFirst, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+		return "", ScramErr
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirst = parts[2]
+
+	cnonce := scramAttrs(s.clientFirst)['r']
+	if cnonce == "" {
+		return "", ScramErr
+	}
+	s.nonce = cnonce + base64.RawStdEncoding.EncodeToString(randomBytes(18))
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(s.keys.salt), s.keys.iter)
+	return s.serverFirst, nil
+}
+
+// final verifies the proof of the client-final-message and returns the server-final-message.
+func (s *scramServer) final(clientFinal string) (string, bool, error) {
+	i := strings.LastIndex(clientFinal, ",p=")
+	if i < 0 {
+		return "", false, ScramErr
+	}
+	attrs := scramAttrs(clientFinal[:i])
+	if attrs['c'] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) || attrs['r'] != s.nonce {
+		return "", false, ScramErr
+	}
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return "", false, ScramErr
+	}
+
+	authMessage := s.clientFirst + "," + s.serverFirst + "," + clientFinal[:i]
+	clientKey := xorBytes(proof, hmacSum(s.keys.storedKey, authMessage))
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], s.keys.storedKey) {
+		return "", false, nil
+	}
+	return "v=" + base64.StdEncoding.EncodeToString(hmacSum(s.keys.serverKey, authMessage)), true, nil
+}
+
+// scramClient is the client side of a SCRAM-SHA-256 exchange, without channel binding.
+type scramClient struct {
+	password    string
+	clientFirst string
+	authMessage string
+	serverKey   []byte
+}
+
+func (c *scramClient) first() string {
+	c.clientFirst = "n=,r=" + base64.RawStdEncoding.EncodeToString(randomBytes(18))
+	return "n,," + c.clientFirst
+}
+
+// final takes the server-first-message and returns the client-final-message with the proof.
+func (c *scramClient) final(serverFirst string) (string, error) {
+	attrs := scramAttrs(serverFirst)
+	iter, err := strconv.Atoi(attrs['i'])
+	if err != nil || !strings.HasPrefix(attrs['r'], scramAttrs(c.clientFirst)['r']) {
+		return "", ScramErr
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil {
+		return "", ScramErr
+	}
+
+	clientKey, serverKey := scramSaltedKeys(c.password, salt, iter)
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + attrs['r']
+	c.authMessage = c.clientFirst + "," + serverFirst + "," + withoutProof
+	c.serverKey = serverKey
+	proof := xorBytes(clientKey, hmacSum(storedKey[:], c.authMessage))
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the signature of the server-final-message.
+func (c *scramClient) verify(serverFinal string) bool {
+	signature, err := base64.StdEncoding.DecodeString(scramAttrs(serverFinal)['v'])
+	return err == nil && hmac.Equal(signature, hmacSum(c.serverKey, c.authMessage))
+}
+
+// md5Secret is the md5 password stored by postgres without the "md5" prefix.
+func md5Secret(user, password string) string {
+	sum := md5.Sum([]byte(password + user))
+	return hex.EncodeToString(sum[:])
+}
+
+// md5Response is the response of the md5 password challenge.
+func md5Response(secret string, salt []byte) string {
+	sum := md5.Sum(append([]byte(secret), salt...))
+	return "md5" + hex.EncodeToString(sum[:])
+}
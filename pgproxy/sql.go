@@ -0,0 +1,277 @@
+package pgproxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	tokenOther = iota
+	tokenSpace
+	tokenWord
+	tokenNumber
+	tokenParam
+	tokenString
+	tokenIdent
+	tokenComment
+	tokenSemicolon
+)
+
+// sqlToken returns the kind and the end of the token at i. The strings include the escape strings and
+// the dollar quoted strings, and the idents are the quoted identifiers.
+func sqlToken(query string, i int) (int, int) {
+	switch ch := query[i]; {
+	case ch == ';':
+		return tokenSemicolon, i + 1
+	case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f':
+		j := i + 1
+		for j < len(query) && strings.IndexByte(" \t\n\r\f", query[j]) >= 0 {
+			j++
+		}
+		return tokenSpace, j
+	case ch == '\'':
+		return tokenString, skipQuoted(query, i+1, '\'', false)
+	case ch == '"':
+		return tokenIdent, skipQuoted(query, i+1, '"', false)
+	case (ch == 'e' || ch == 'E') && i+1 < len(query) && query[i+1] == '\'':
+		return tokenString, skipQuoted(query, i+2, '\'', true)
+	case strings.HasPrefix(query[i:], "--"):
+		if j := strings.IndexByte(query[i:], '\n'); j >= 0 {
+			return tokenComment, i + j
+		}
+		return tokenComment, len(query)
+	case strings.HasPrefix(query[i:], "/*"):
+		return tokenComment, skipComment(query, i)
+	case ch == '$':
+		j := i + 1
+		for j < len(query) && isDigit(query[j]) {
+			j++
+		}
+		if j > i+1 {
+			return tokenParam, j
+		}
+		if tag := dollarTag.FindString(query[i:]); tag != "" {
+			if end := strings.Index(query[i+len(tag):], tag); end >= 0 {
+				return tokenString, i + len(tag) + end + len(tag)
+			}
+			return tokenString, len(query)
+		}
+	case isDigit(ch):
+		j := i + 1
+		for j < len(query) && (isDigit(query[j]) || query[j] == '.') {
+			j++
+		}
+		if j < len(query) && (query[j] == 'e' || query[j] == 'E') {
+			k := j + 1
+			if k < len(query) && (query[k] == '+' || query[k] == '-') {
+				k++
+			}
+			if k < len(query) && isDigit(query[k]) {
+				for j = k; j < len(query) && isDigit(query[j]); j++ {
+				}
+			}
+		}
+		return tokenNumber, j
+	case isWordStart(ch):
+		j := i + 1
+		for j < len(query) && (isWordStart(query[j]) || query[j] == '$' || isDigit(query[j])) {
+			j++
+		}
+		return tokenWord, j
+	}
+	return tokenOther, i + 1
+}
+
+// sqlStatement is a statement of a query, the words are the lower cased keywords and identifiers
+// outside of literals, quoted identifiers and comments.
+type sqlStatement struct {
+	text  string
+	words []string
+}
+
+func (s sqlStatement) types() []string {
+	types := []string{s.words[0]}
+	switch s.words[0] {
+	case "create", "alter", "drop", "truncate", "comment", "grant", "revoke":
+		types = append(types, "ddl")
+		if s.words[0] == "drop" && len(s.words) > 1 && s.words[1] == "database" {
+			types = append(types, "drop_database")
+		}
+	case "insert", "update", "delete", "merge":
+		types = append(types, "dml")
+	case "do", "execute", "call":
+		// the functions and the prepared statements can run anything
+		types = append(types, "ddl", "dml")
+	case "with", "explain", "prepare":
+		// the data modifying statements can be nested in the CTEs, the EXPLAIN ANALYZE and the PREPARE
+		types = append(types, s.nestedTypes()...)
+	case "copy":
+		for _, w := range s.words {
+			if w == "program" {
+				types = append(types, "copy_program")
+				break
+			}
+		}
+	}
+	return types
+}
+
+// nestedTypes finds the "ddl" and "dml" of the statements nested in the words after the first one.
+func (s sqlStatement) nestedTypes() (types []string) {
+	var ddl, dml bool
+	for i, w := range s.words[1:] {
+		switch w {
+		case "insert", "delete", "merge":
+			dml = true
+		case "update":
+			// the row locks like FOR UPDATE and FOR NO KEY UPDATE
+			if prev := s.words[i]; prev != "for" && prev != "key" {
+				dml = true
+			}
+		case "create", "alter", "drop", "truncate":
+			ddl = true
+		case "execute":
+			ddl, dml = true, true
+		}
+	}
+	if ddl {
+		types = append(types, "ddl")
+	}
+	if dml {
+		types = append(types, "dml")
+	}
+	return types
+}
+
+// scanSQL splits the query into statements, and finds the max number of the $n parameters.
+func scanSQL(query string) (stmts []sqlStatement, params int) {
+	start := 0
+	var words []string
+	for i := 0; i < len(query); {
+		kind, end := sqlToken(query, i)
+		switch kind {
+		case tokenSemicolon:
+			if len(words) > 0 {
+				stmts = append(stmts, sqlStatement{text: strings.TrimSpace(query[start:i]), words: words})
+			}
+			words, start = nil, end
+		case tokenWord:
+			words = append(words, strings.ToLower(query[i:end]))
+		case tokenParam:
+			if n, _ := strconv.Atoi(query[i+1 : end]); n > params {
+				params = n
+			}
+		}
+		i = end
+	}
+	if len(words) > 0 {
+		stmts = append(stmts, sqlStatement{text: strings.TrimSpace(query[start:]), words: words})
+	}
+	return stmts, params
+}
+
+var placeholderList = regexp.MustCompile(`\?( ?, ?\?)+`)
+
+// Fingerprint normalizes the query by replacing the literals and the parameters with "?", removing the comments,
+// lowering the keywords and collapsing the spaces and the lists of literals. The id is the hash of the normalized query.
+func Fingerprint(query string) (id string, normalized string) {
+	normalized = rewriteSQL(query, func(kind int, token string) string {
+		switch kind {
+		case tokenString, tokenNumber, tokenParam:
+			return "?"
+		case tokenWord:
+			return strings.ToLower(token)
+		}
+		return token
+	})
+	normalized = placeholderList.ReplaceAllString(strings.TrimRight(normalized, "; "), "?")
+
+	h := fnv.New64a()
+	h.Write([]byte(normalized))
+	return fmt.Sprintf("%016x", h.Sum64()), normalized
+}
+
+// Redact replaces the string and number literals of the query with "?", removes the comments and collapses the spaces.
+func Redact(query string) string {
+	return rewriteSQL(query, func(kind int, token string) string {
+		if kind == tokenString || kind == tokenNumber {
+			return "?"
+		}
+		return token
+	})
+}
+
+// rewriteSQL rewrites the tokens of the query, the comments are removed and the spaces are collapsed.
+func rewriteSQL(query string, rewrite func(kind int, token string) string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(query); {
+		kind, end := sqlToken(query, i)
+		switch kind {
+		case tokenSpace, tokenComment:
+			space = b.Len() > 0
+		default:
+			if space {
+				b.WriteByte(' ')
+				space = false
+			}
+			b.WriteString(rewrite(kind, query[i:end]))
+		}
+		i = end
+	}
+	return b.String()
+}
+
+var dollarTag = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isWordStart(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch >= 0x80
+}
+
+// skipQuoted returns the end of the quoted literal or identifier started before i.
+func skipQuoted(query string, i int, quote byte, backslash bool) int {
+	for i < len(query) {
+		switch query[i] {
+		case '\\':
+			if backslash {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+			} else {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return i
+}
+
+// skipComment returns the end of the nested block comment started at i.
+func skipComment(query string, i int) int {
+	depth := 0
+	for i < len(query) {
+		switch {
+		case strings.HasPrefix(query[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(query[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return i
+}
@@ -0,0 +1,272 @@
+package pgproxy
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rueian/pgbroker/proxy"
+)
+
+// QueryStats aggregates the latency and the rows of statements by the database, the user and the query fingerprint.
+// The latency of a statement is measured from its Query or Execute until the ReadyForQuery of the server,
+// and the statements slower than the SlowThreshold are logged.
+type QueryStats struct {
+	SlowThreshold time.Duration
+	// Samples is the number of recent latencies kept per fingerprint to calculate percentiles.
+	Samples int
+	// MaxEntries limits the number of fingerprints, the statements of new fingerprints are not aggregated over it.
+	MaxEntries int
+	// QueryLog renders the slow statements in the logs.
+	QueryLog *QueryLogger
+
+	mu       sync.Mutex
+	entries  map[statKey]*statEntry
+	sessions sync.Map
+}
+
+func NewQueryStats(slowThreshold time.Duration) *QueryStats {
+	return &QueryStats{
+		SlowThreshold: slowThreshold,
+		Samples:       1000,
+		MaxEntries:    5000,
+		entries:       map[statKey]*statEntry{},
+	}
+}
+
+type statKey struct {
+	database    string
+	user        string
+	fingerprint string
+}
+
+type statEntry struct {
+	query   string
+	count   int64
+	errors  int64
+	rows    int64
+	total   time.Duration
+	max     time.Duration
+	samples []time.Duration
+	next    int
+}
+
+// QueryStat is the aggregated stats of a fingerprint, durations are in milliseconds.
+type QueryStat struct {
+	Database    string  `json:"database"`
+	User        string  `json:"user"`
+	Fingerprint string  `json:"fingerprint"`
+	Query       string  `json:"query"`
+	Count       int64   `json:"count"`
+	Errors      int64   `json:"errors"`
+	Rows        int64   `json:"rows"`
+	Total       float64 `json:"total_ms"`
+	Mean        float64 `json:"mean_ms"`
+	Max         float64 `json:"max_ms"`
+	P50         float64 `json:"p50_ms"`
+	P95         float64 `json:"p95_ms"`
+	P99         float64 `json:"p99_ms"`
+}
+
+// statSession tracks the statements of a client waiting for the ReadyForQuery.
+type statSession struct {
+	mu         sync.Mutex
+	statements map[string]string
+	portals    map[string]string
+	pending    []*execution
+	current    int
+}
+
+type execution struct {
+	query  string
+	simple bool
+	start  time.Time
+	rows   int64
+	failed bool
+}
+
+func (s *QueryStats) session(ctx *proxy.Ctx) *statSession {
+	if ss, ok := s.sessions.Load(ctx); ok {
+		return ss.(*statSession)
+	}
+	ss, _ := s.sessions.LoadOrStore(ctx, &statSession{statements: map[string]string{}, portals: map[string]string{}})
+	return ss.(*statSession)
+}
+
+func (s *QueryStats) Query(ctx *proxy.Ctx, query string) {
+	ss := s.session(ctx)
+	ss.mu.Lock()
+	ss.pending = append(ss.pending, &execution{query: query, simple: true, start: time.Now()})
+	ss.mu.Unlock()
+}
+
+func (s *QueryStats) Parse(ctx *proxy.Ctx, name, query string) {
+	ss := s.session(ctx)
+	ss.mu.Lock()
+	ss.statements[name] = query
+	ss.mu.Unlock()
+}
+
+func (s *QueryStats) Bind(ctx *proxy.Ctx, portal, statement string) {
+	ss := s.session(ctx)
+	ss.mu.Lock()
+	ss.portals[portal] = ss.statements[statement]
+	ss.mu.Unlock()
+}
+
+func (s *QueryStats) Execute(ctx *proxy.Ctx, portal string) {
+	ss := s.session(ctx)
+	ss.mu.Lock()
+	ss.pending = append(ss.pending, &execution{query: ss.portals[portal], start: time.Now()})
+	ss.mu.Unlock()
+}
+
+// CommandComplete adds the rows of the command tag like "SELECT 5" or "INSERT 0 3" to the current statement.
+func (s *QueryStats) CommandComplete(ctx *proxy.Ctx, tag string) {
+	ss := s.session(ctx)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.current >= len(ss.pending) {
+		return
+	}
+	e := ss.pending[ss.current]
+	if i := strings.LastIndexByte(tag, ' '); i >= 0 {
+		if n, err := strconv.ParseInt(tag[i+1:], 10, 64); err == nil {
+			e.rows += n
+		}
+	}
+	if !e.simple {
+		ss.current++
+	}
+}
+
+// Error marks the current statement failed, the rest statements before the Sync are skipped by the server.
+func (s *QueryStats) Error(ctx *proxy.Ctx) {
+	ss := s.session(ctx)
+	ss.mu.Lock()
+	if ss.current < len(ss.pending) {
+		ss.pending[ss.current].failed = true
+	}
+	ss.current = len(ss.pending)
+	ss.mu.Unlock()
+}
+
+// ReadyForQuery records the pending statements of the client.
+func (s *QueryStats) ReadyForQuery(ctx *proxy.Ctx) {
+	ss := s.session(ctx)
+	ss.mu.Lock()
+	pending := ss.pending
+	ss.pending, ss.current = nil, 0
+	ss.mu.Unlock()
+
+	now := time.Now()
+	for _, e := range pending {
+		if e.query != "" {
+			s.record(ctx.ConnInfo.StartupParameters, e, now.Sub(e.start))
+		}
+	}
+}
+
+// Close forgets the session of the client.
+func (s *QueryStats) Close(ctx *proxy.Ctx) {
+	s.sessions.Delete(ctx)
+}
+
+func (s *QueryStats) record(params map[string]string, e *execution, latency time.Duration) {
+	database, user := params["database"], params["user"]
+	if s.SlowThreshold > 0 && latency >= s.SlowThreshold {
+		log.Printf("Slow: db=%s user=%s duration=%s rows=%d failed=%v %s\n", database, user, latency, e.rows, e.failed, s.QueryLog.Format(database, e.query))
+	}
+
+	id, normalized := Fingerprint(e.query)
+	key := statKey{database: database, user: user, fingerprint: id}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		if len(s.entries) >= s.MaxEntries {
+			return
+		}
+		entry = &statEntry{query: normalized}
+		s.entries[key] = entry
+	}
+	entry.count++
+	entry.rows += e.rows
+	entry.total += latency
+	if e.failed {
+		entry.errors++
+	}
+	if latency > entry.max {
+		entry.max = latency
+	}
+	if len(entry.samples) < s.Samples {
+		entry.samples = append(entry.samples, latency)
+	} else if s.Samples > 0 {
+		entry.samples[entry.next] = latency
+		entry.next = (entry.next + 1) % s.Samples
+	}
+}
+
+// Snapshot returns the stats sorted by the total time.
+func (s *QueryStats) Snapshot() []QueryStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	stats := make([]QueryStat, 0, len(s.entries))
+	for key, entry := range s.entries {
+		samples := append([]time.Duration(nil), entry.samples...)
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		percentile := func(p float64) float64 {
+			if len(samples) == 0 {
+				return 0
+			}
+			// the nearest rank
+			return ms(samples[int(math.Ceil(p*float64(len(samples))))-1])
+		}
+		stats = append(stats, QueryStat{
+			Database:    key.database,
+			User:        key.user,
+			Fingerprint: key.fingerprint,
+			Query:       entry.query,
+			Count:       entry.count,
+			Errors:      entry.errors,
+			Rows:        entry.rows,
+			Total:       ms(entry.total),
+			Mean:        ms(entry.total) / float64(entry.count),
+			Max:         ms(entry.max),
+			P50:         percentile(0.5),
+			P95:         percentile(0.95),
+			P99:         percentile(0.99),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Total > stats[j].Total })
+	return stats
+}
+
+// ServeHTTP responds the stats in json, filtered by the "database" and the "user" and limited by the "limit" queries.
+func (s *QueryStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+
+	stats := make([]QueryStat, 0)
+	for _, stat := range s.Snapshot() {
+		if (q.Get("database") != "" && stat.Database != q.Get("database")) || (q.Get("user") != "" && stat.User != q.Get("user")) {
+			continue
+		}
+		if limit > 0 && len(stats) >= limit {
+			break
+		}
+		stats = append(stats, stat)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,72 @@
+package pgproxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rueian/pgbroker/backend"
+	"github.com/rueian/pgbroker/proxy"
+)
+
+func TestFingerprint(t *testing.T) {
+	id1, normalized := Fingerprint("SELECT  *\n FROM t /* hint */ WHERE a = 'x' AND b IN (1, 2.5, 3e10) AND c = $1; -- end")
+	if normalized != "select * from t where a = ? and b in (?) and c = ?" {
+		t.Fatalf("unexpected normalized query %q", normalized)
+	}
+	id2, _ := Fingerprint(`select * from t where a = E'y\'' and b in (4) and c = $2`)
+	if id1 != id2 {
+		t.Fatalf("expect the same fingerprint, got %s and %s", id1, id2)
+	}
+	if _, normalized := Fingerprint(`SELECT "Col1" FROM t2`); normalized != `select "Col1" from t2` {
+		t.Fatalf("unexpected normalized query %q", normalized)
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	stats := NewQueryStats(0)
+	ctx := &proxy.Ctx{ConnInfo: backend.ConnInfo{StartupParameters: map[string]string{"database": "db", "user": "u"}}}
+
+	// simple queries
+	for i := 0; i < 10; i++ {
+		stats.Query(ctx, "SELECT * FROM t WHERE id = 1")
+		stats.CommandComplete(ctx, "SELECT 2")
+		stats.ReadyForQuery(ctx)
+	}
+
+	// pipelined executions of prepared statements, the second one fails
+	stats.Parse(ctx, "s1", "UPDATE t SET a = $1")
+	stats.Bind(ctx, "", "s1")
+	stats.Execute(ctx, "")
+	time.Sleep(10 * time.Millisecond)
+	stats.Bind(ctx, "", "s1")
+	stats.Execute(ctx, "")
+	stats.CommandComplete(ctx, "UPDATE 3")
+	stats.Error(ctx)
+	stats.ReadyForQuery(ctx)
+	stats.Close(ctx)
+
+	rec := httptest.NewRecorder()
+	stats.ServeHTTP(rec, httptest.NewRequest("GET", "/?database=db", nil))
+	var result []QueryStat
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("expect 2 fingerprints, got %v", result)
+	}
+	update, selects := result[0], result[1]
+	if update.Query != "update t set a = ?" || update.Count != 2 || update.Errors != 1 || update.Rows != 3 || update.P99 < 10 {
+		t.Fatalf("unexpected stats of update %+v", update)
+	}
+	if selects.Query != "select * from t where id = ?" || selects.Count != 10 || selects.Rows != 20 || selects.Errors != 0 {
+		t.Fatalf("unexpected stats of select %+v", selects)
+	}
+
+	rec = httptest.NewRecorder()
+	stats.ServeHTTP(rec, httptest.NewRequest("GET", "/?user=other", nil))
+	if rec.Body.String() != "[]\n" {
+		t.Fatalf("expect no stats of other users, got %s", rec.Body.String())
+	}
+}
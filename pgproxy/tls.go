@@ -0,0 +1,276 @@
+package pgproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rueian/pgbroker/message"
+)
+
+const (
+	sslRequestCode    = 80877103
+	gssencRequestCode = 80877104
+	cancelRequestCode = 80877102
+)
+
+// handshakeListener runs the handshake of accepted connections in background, so that slow clients don't block others.
+type handshakeListener struct {
+	net.Listener
+	handshake func(net.Conn) (net.Conn, error)
+
+	conns chan net.Conn
+	err   chan error
+}
+
+func newHandshakeListener(ln net.Listener, handshake func(net.Conn) (net.Conn, error)) *handshakeListener {
+	l := &handshakeListener{
+		Listener:  ln,
+		handshake: handshake,
+		conns:     make(chan net.Conn),
+		err:       make(chan error, 1),
+	}
+	go l.serve()
+	return l
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.err:
+		l.err <- err
+		return nil, err
+	}
+}
+
+func (l *handshakeListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err <- err
+			return
+		}
+		go func() {
+			hsConn, err := l.handshake(conn)
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("fail to handshake with %s: %s\n", conn.RemoteAddr(), err.Error())
+				}
+				conn.Close()
+				return
+			}
+			select {
+			case l.conns <- hsConn:
+			case err := <-l.err:
+				l.err <- err
+				hsConn.Close()
+			}
+		}()
+	}
+}
+
+// TLSListener answers the SSLRequest of clients and terminates TLS before the connections are accepted by the pgbroker,
+// which rejects all SSLRequest. The clients without SSLRequest are rejected if Required, or passed through otherwise.
+type TLSListener struct {
+	*handshakeListener
+	Config   *tls.Config
+	Required bool
+	// Timeout limits the time of clients to send the first message and to complete the TLS handshake.
+	Timeout time.Duration
+}
+
+func NewTLSListener(ln net.Listener, config *tls.Config, required bool) *TLSListener {
+	l := &TLSListener{
+		Config:   config,
+		Required: required,
+		Timeout:  10 * time.Second,
+	}
+	l.handshakeListener = newHandshakeListener(ln, l.negotiate)
+	return l
+}
+
+func (l *TLSListener) negotiate(conn net.Conn) (net.Conn, error) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetKeepAlivePeriod(30 * time.Second)
+		tcp.SetKeepAlive(true)
+	}
+	conn.SetDeadline(time.Now().Add(l.Timeout))
+
+	head := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return conn, err
+		}
+		if binary.BigEndian.Uint32(head[:4]) != 8 {
+			break
+		}
+		switch binary.BigEndian.Uint32(head[4:]) {
+		case gssencRequestCode:
+			// GSS encryption is not supported, the client may try the SSLRequest next
+			if _, err := conn.Write([]byte{'N'}); err != nil {
+				return conn, err
+			}
+			continue
+		case sslRequestCode:
+			if _, err := conn.Write([]byte{'S'}); err != nil {
+				return conn, err
+			}
+			tlsConn := tls.Server(conn, l.Config)
+			if err := tlsConn.Handshake(); err != nil {
+				return conn, err
+			}
+			tlsConn.SetDeadline(time.Time{})
+			return tlsConn, nil
+		}
+		break
+	}
+
+	if l.Required && binary.BigEndian.Uint32(head[4:]) != cancelRequestCode {
+		io.Copy(conn, errorResp("FATAL", "28000", "SSL connection is required").Reader())
+		return conn, errors.New("client without SSL is rejected")
+	}
+	conn.SetDeadline(time.Time{})
+	return &peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(head), conn)}, nil
+}
+
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CertReloader serves the certificate of the files, and reloads it when the files are modified.
+type CertReloader struct {
+	CertPath string
+	KeyPath  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	r := &CertReloader{CertPath: certPath, KeyPath: keyPath}
+	if err := r.Load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) Load() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.CertPath, r.KeyPath)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert, r.modTime = &cert, modTime
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *CertReloader) lastModified() (t time.Time, err error) {
+	for _, path := range []string{r.CertPath, r.KeyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return t, err
+		}
+		if info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// Watch reloads the certificate periodically if the files are modified, the current one is kept if they are broken.
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		modTime, err := r.lastModified()
+		r.mu.RLock()
+		changed := err == nil && !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.Load(); err != nil {
+			log.Printf("fail to reload certificate %q: %s\n", r.CertPath, err.Error())
+		} else {
+			log.Printf("certificate %q reloaded\n", r.CertPath)
+		}
+	}
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// LoadCertPool reads the PEM encoded CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in %q", path)
+	}
+	return pool, nil
+}
+
+// DialPG connects to the postgres server, and negotiates TLS by the SSLRequest if the config is not nil.
+func DialPG(addr string, config *tls.Config) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil || config == nil {
+		return conn, err
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	resp := make([]byte, 1)
+	if _, err = io.Copy(conn, (&message.SSLRequest{RequestCode: sslRequestCode}).Reader()); err == nil {
+		_, err = io.ReadFull(conn, resp)
+	}
+	if err == nil && resp[0] != 'S' {
+		err = fmt.Errorf("server %s does not support SSL", addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
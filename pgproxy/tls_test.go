@@ -0,0 +1,120 @@
+package pgproxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rueian/pgbroker/message"
+)
+
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pgproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certPath, keyPath
+}
+
+func TestTLSListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certs, err := NewCertReloader(writeTestCert(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsLn := NewTLSListener(ln, &tls.Config{GetCertificate: certs.GetCertificate}, false)
+	defer tlsLn.Close()
+
+	startup := (&message.StartupMessage{ProtocolVersion: 196608, Parameters: map[string]string{"user": "u"}}).Reader()
+	expected, _ := ioutil.ReadAll(startup)
+
+	accept := func() (net.Conn, []byte) {
+		conn, err := tlsLn.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, received); err != nil {
+			t.Fatal(err)
+		}
+		return conn, received
+	}
+
+	// the client with SSLRequest
+	client, err := DialPG(ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write(expected)
+	conn, received := accept()
+	if _, ok := conn.(*tls.Conn); !ok || string(received) != string(expected) {
+		t.Fatalf("expect the tls connection receives the startup message, got %T %v", conn, received)
+	}
+	conn.Close()
+	client.Close()
+
+	// the client without SSLRequest
+	client, err = DialPG(ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write(expected)
+	conn, received = accept()
+	if _, ok := conn.(*tls.Conn); ok || string(received) != string(expected) {
+		t.Fatalf("expect the plain connection receives the startup message, got %T %v", conn, received)
+	}
+	conn.Close()
+	client.Close()
+
+	// the client without SSLRequest is rejected if TLS is required
+	tlsLn.Required = true
+	client, err = DialPG(ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write(expected)
+	msg, err := readMessage(bufio.NewReader(client))
+	if err != nil || msg[0] != 'E' {
+		t.Fatalf("expect the client is rejected, got %v %v", msg, err)
+	}
+	client.Close()
+}
@@ -0,0 +1,22 @@
+package service
+
+import (
+	"github.com/rueian/godemand-example/tools"
+	"github.com/rueian/godemand/config"
+)
+
+// LoadConfig loads the config like the config.LoadConfig, and normalizes the nested params of pools
+// decoded by yaml, so that they can be passed to plugins.
+func LoadConfig(path string) (*config.Config, error) {
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	for id, pool := range cfg.Pools {
+		if params, ok := tools.Normalize(pool.Params).(map[string]interface{}); ok {
+			pool.Params = params
+		}
+		cfg.Pools[id] = pool
+	}
+	return cfg, nil
+}
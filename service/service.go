@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rueian/godemand-example/pgplugin"
+	"github.com/rueian/godemand/api"
+	"github.com/rueian/godemand/plugin"
+	"github.com/rueian/godemand/types"
+)
+
+const ScalerClientID = "godemand-scaler"
+
+// Service is the api.Service which also passes the requesting client to the FindResource of the plugin.
+type Service struct {
+	*api.Service
+}
+
+func (s *Service) RequestResource(poolID string, client types.Client) (res types.Resource, err error) {
+	lockID, err := s.Locker.AcquireLock(poolID)
+	if err != nil {
+		return types.Resource{}, err
+	}
+	defer s.Locker.ReleaseLock(poolID, lockID)
+
+	poolConfig, err := s.Config.GetPool(poolID)
+	if err != nil {
+		return types.Resource{}, err
+	}
+
+	controller, err := s.Launchpad.GetController(poolConfig.Plugin)
+	if err != nil {
+		return types.Resource{}, err
+	}
+
+	pool, err := s.Pool.GetResources(poolID)
+	if err != nil {
+		return types.Resource{}, err
+	}
+
+	res, err = controller.FindResource(pool, ClientParams(poolConfig.Params, client))
+	if err != nil {
+		return types.Resource{}, restoreErr(err)
+	}
+
+	event := types.ResourceEvent{
+		ResourceID:     res.ID,
+		ResourcePoolID: res.PoolID,
+		Timestamp:      time.Now(),
+	}
+
+	if _, ok := pool.Resources[res.ID]; !ok {
+		event.Meta = types.Meta{
+			"type":   "created",
+			"client": client,
+		}
+		res.CreatedAt = time.Now()
+		res.StateChange = time.Now()
+	} else {
+		event.Meta = types.Meta{
+			"type":   "requested",
+			"client": client,
+		}
+	}
+	res.PoolID = pool.ID
+	if pool.Resources[res.ID].State != res.State && pool.Resources[res.ID].StateChange == res.StateChange {
+		res.StateChange = time.Now()
+	}
+	if res, err = s.Pool.SaveResource(res); err != nil {
+		return types.Resource{}, err
+	}
+	if err := s.Pool.AppendEvent(event); err != nil {
+		return types.Resource{}, err
+	}
+
+	return res, err
+}
+
+// Scale asks the plugin of every pool to create instances up to its MinInstances and WarmInstances periodically.
+func (s *Service) Scale(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		for id := range s.Config.Pools {
+			_, err := s.RequestResource(id, types.Client{ID: ScalerClientID, Meta: types.Meta{}})
+			if err != nil && !errors.Is(err, pgplugin.ScaleSatisfiedErr) && !errors.Is(err, pgplugin.RejectedErr) && !errors.Is(err, plugin.AcquireLaterErr) {
+				log.Printf("fail to scale pool %q: %v\n", id, err)
+			}
+		}
+	}
+}
+
+// PreemptionClientID is the client requesting the replacement of a preempted resource.
+const PreemptionClientID = "godemand-preemption"
+
+// Preempted moves the preempted resource out of rotation by the "draining" Meta, which also tells the pgproxy to
+// drain its connections, and requests a replacement for the pool before the instance stops.
+func (s *Service) Preempted(poolID, id string) error {
+	lockID, err := s.Locker.AcquireLock(id)
+	if err != nil {
+		return err
+	}
+	res, err := s.Pool.GetResource(poolID, id)
+	if err == nil && res.State == types.ResourceServing {
+		if res.Meta == nil {
+			res.Meta = types.Meta{}
+		}
+		now := time.Now().Format(time.RFC3339)
+		res.Meta["preempted"] = now
+		if _, ok := res.Meta["draining"]; !ok {
+			res.Meta["draining"] = now
+		}
+		_, err = s.Pool.SaveResource(res)
+	}
+	s.Locker.ReleaseLock(id, lockID)
+	if err != nil {
+		return err
+	}
+	if err := s.Pool.AppendEvent(types.ResourceEvent{ResourceID: id, ResourcePoolID: poolID, Timestamp: time.Now(), Meta: types.Meta{"type": "preempted"}}); err != nil {
+		return err
+	}
+
+	log.Printf("resource %q of pool %q is preempted, request a replacement\n", id, poolID)
+	if _, err := s.RequestResource(poolID, types.Client{ID: PreemptionClientID, Meta: types.Meta{}}); err != nil {
+		// the replacement is created by the next client request instead
+		log.Printf("fail to request a replacement of resource %q: %v\n", id, err)
+	}
+	return nil
+}
+
+// HandlePreempted serves the preemption notices from the loadavg agents of the instances.
+func (s *Service) HandlePreempted(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if err := s.Preempted(r.Form.Get("poolID"), r.Form.Get("id")); err != nil {
+		if errors.Is(err, types.ResourceNotFoundErr) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ClientParams copies the pool params with the ClientID, ClientScale, ClientUser and ClientDatabase of the client.
+func ClientParams(params map[string]interface{}, client types.Client) map[string]interface{} {
+	merged := make(map[string]interface{}, len(params)+3)
+	for k, v := range params {
+		merged[k] = v
+	}
+	merged["ClientID"] = client.ID
+	merged["ClientScale"] = client.ID == ScalerClientID
+	if user, ok := client.Meta["user"].(string); ok {
+		merged["ClientUser"] = user
+	}
+	if database, ok := client.Meta["database"].(string); ok {
+		merged["ClientDatabase"] = database
+	}
+	return merged
+}
+
+// the errors from plugins are flattened into strings by the rpc, restore the known ones by the pgplugin.ErrCodes
+// prefixing them for errors.Is. The RejectedErr is also restored as the types.ResourceNotFoundErr, which is answered
+// with 404, so that clients fail with its message immediately instead of retrying.
+func restoreErr(err error) error {
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "[") {
+		return err
+	}
+	i := strings.Index(msg, "] ")
+	if i < 0 {
+		return err
+	}
+	known, ok := pgplugin.ErrCodes[msg[1:i]]
+	if !ok {
+		return err
+	}
+	e := &pluginErr{msg: msg[i+2:], known: []error{known}}
+	if known == pgplugin.RejectedErr {
+		e.known = append(e.known, types.ResourceNotFoundErr)
+	}
+	return e
+}
+
+type pluginErr struct {
+	msg   string
+	known []error
+}
+
+func (e *pluginErr) Error() string {
+	return e.msg
+}
+
+func (e *pluginErr) Is(target error) bool {
+	for _, known := range e.known {
+		if target == known {
+			return true
+		}
+	}
+	return false
+}
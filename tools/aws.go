@@ -0,0 +1,457 @@
+package tools
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// EC2Service maps the compute vocabulary onto EC2: the project is the region, the zone is the availability zone,
+// and the boot disk of the instance is attached as a data volume since the AMI can't be replaced by an EBS snapshot.
+// The snapshot should contain a filesystem labeled "godemand" with the content of /var/lib/postgresql.
+func NewEC2Service(sess *session.Session, imageID string, securityGroupIDs []string, subnetID string) *EC2Service {
+	return &EC2Service{
+		Session:          sess,
+		ImageID:          imageID,
+		SecurityGroupIDs: securityGroupIDs,
+		SubnetID:         subnetID,
+		clients:          make(map[string]*ec2.EC2),
+	}
+}
+
+type EC2Service struct {
+	Session          *session.Session
+	ImageID          string
+	SecurityGroupIDs []string
+	SubnetID         string
+
+	mu      sync.Mutex
+	clients map[string]*ec2.EC2
+}
+
+const ec2DataDevice = "/dev/sdf"
+
+const ec2MountScript = `#!/bin/bash -e
+
+until [ -e /dev/disk/by-label/godemand ]; do sleep 1; done
+mount /dev/disk/by-label/godemand /var/lib/postgresql
+`
+
+var ec2InstanceStatus = map[string]string{
+	ec2.InstanceStateNamePending:      "PROVISIONING",
+	ec2.InstanceStateNameRunning:      "RUNNING",
+	ec2.InstanceStateNameStopping:     "STOPPING",
+	ec2.InstanceStateNameShuttingDown: "STOPPING",
+	ec2.InstanceStateNameStopped:      "TERMINATED",
+}
+
+var ec2VolumeStatus = map[string]string{
+	ec2.VolumeStateCreating:  "CREATING",
+	ec2.VolumeStateAvailable: "READY",
+	ec2.VolumeStateInUse:     "READY",
+	ec2.VolumeStateDeleting:  "DELETING",
+	ec2.VolumeStateError:     "FAILED",
+}
+
+func (s *EC2Service) client(region string) *ec2.EC2 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.clients[region]; ok {
+		return c
+	}
+	c := ec2.New(s.Session, aws.NewConfig().WithRegion(region))
+	s.clients[region] = c
+	return c
+}
+
+func (s *EC2Service) FindLatestSnapshot(projectID, prefix string) (*compute.Snapshot, error) {
+	out, err := s.client(projectID).DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+		OwnerIds: aws.StringSlice([]string{"self"}),
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:Name"), Values: aws.StringSlice([]string{prefix + "*"})},
+			{Name: aws.String("status"), Values: aws.StringSlice([]string{ec2.SnapshotStateCompleted})},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out.Snapshots) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(out.Snapshots, func(i, j int) bool { return out.Snapshots[i].StartTime.After(*out.Snapshots[j].StartTime) })
+
+	latest := out.Snapshots[0]
+	return &compute.Snapshot{
+		Name:              ec2Tag(latest.Tags, "Name"),
+		SelfLink:          aws.StringValue(latest.SnapshotId),
+		Status:            "READY",
+		CreationTimestamp: aws.TimeValue(latest.StartTime).Format(time.RFC3339),
+	}, nil
+}
+
+func (s *EC2Service) FindDisk(projectID, zoneID, diskID string) (*compute.Disk, error) {
+	v, err := s.findVolume(projectID, zoneID, diskID)
+	if err != nil {
+		return nil, err
+	}
+
+	disk := &compute.Disk{
+		Name:           diskID,
+		SelfLink:       aws.StringValue(v.VolumeId),
+		SourceSnapshot: aws.StringValue(v.SnapshotId),
+		Status:         ec2VolumeStatus[aws.StringValue(v.State)],
+		SizeGb:         aws.Int64Value(v.Size),
+	}
+	if disk.Status == "CREATING" && disk.SourceSnapshot != "" {
+		disk.Status = "RESTORING"
+	}
+	for _, a := range v.Attachments {
+		disk.Users = append(disk.Users, aws.StringValue(a.InstanceId))
+	}
+	return disk, nil
+}
+
+func (s *EC2Service) FindDiskRetry(projectID, zoneID, diskID string, times int) (disk *compute.Disk, err error) {
+	for i := 0; i < times; i++ {
+		if disk, err = s.FindDisk(projectID, zoneID, diskID); disk != nil {
+			return
+		}
+		time.Sleep(1 * time.Second)
+	}
+	return
+}
+
+func (s *EC2Service) CreateDiskRetry(projectID, zoneID string, disk *compute.Disk, times int) (err error) {
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone:  aws.String(zoneID),
+		SnapshotId:        aws.String(disk.SourceSnapshot),
+		VolumeType:        aws.String(ec2.VolumeTypeGp2),
+		TagSpecifications: ec2TagSpecifications(ec2.ResourceTypeVolume, disk.Name, disk.Labels),
+	}
+	if disk.SizeGb > 0 {
+		input.Size = aws.Int64(disk.SizeGb)
+	}
+	for i := 0; i < times; i++ {
+		// the CreateVolume is not idempotent, check the previous attempt before trying again
+		if _, err = s.findVolume(projectID, zoneID, disk.Name); err == nil {
+			return nil
+		}
+		if _, err = s.client(projectID).CreateVolume(input); err == nil {
+			return
+		} else if ClassifyError(err).Fallback() {
+			return
+		}
+		time.Sleep(1 * time.Second)
+	}
+	return
+}
+
+func (s *EC2Service) DeleteDiskRetry(projectID, zoneID, diskID string, times int) (err error) {
+	for i := 0; i < times; i++ {
+		var v *ec2.Volume
+		if v, err = s.findVolume(projectID, zoneID, diskID); IsStatusNotFound(err) {
+			return nil
+		}
+		if err == nil {
+			if _, err = s.client(projectID).DeleteVolume(&ec2.DeleteVolumeInput{VolumeId: v.VolumeId}); err == nil {
+				return
+			}
+		}
+		time.Sleep(1 * time.Second)
+	}
+	return
+}
+
+func (s *EC2Service) FindInstanceRetry(projectID, zoneID, instanceID string, times int) (instance *compute.Instance, err error) {
+	for i := 0; i < times; i++ {
+		var found *ec2.Instance
+		if found, err = s.findInstance(projectID, zoneID, instanceID); found != nil {
+			return ec2ToInstance(instanceID, found), nil
+		}
+		time.Sleep(1 * time.Second)
+	}
+	return
+}
+
+func (s *EC2Service) CreateInstanceRetry(projectID, zoneID string, instance *compute.Instance, times int) (err error) {
+	if len(instance.Disks) == 0 {
+		return fmt.Errorf("instance %q has no disk", instance.Name)
+	}
+
+	script := ec2MountScript
+	if instance.Metadata != nil {
+		for _, item := range instance.Metadata.Items {
+			if item.Key == "startup-script" && item.Value != nil {
+				// drop the shebang of the startup script
+				lines := strings.SplitN(*item.Value, "\n", 2)
+				script += lines[len(lines)-1]
+			}
+		}
+	}
+
+	input := &ec2.RunInstancesInput{
+		ImageId:           aws.String(s.ImageID),
+		InstanceType:      aws.String(path.Base(instance.MachineType)),
+		MinCount:          aws.Int64(1),
+		MaxCount:          aws.Int64(1),
+		ClientToken:       aws.String(uuid.NewV4().String()),
+		Placement:         &ec2.Placement{AvailabilityZone: aws.String(zoneID)},
+		UserData:          aws.String(base64.StdEncoding.EncodeToString([]byte(script))),
+		SecurityGroupIds:  aws.StringSlice(s.SecurityGroupIDs),
+		TagSpecifications: ec2TagSpecifications(ec2.ResourceTypeInstance, instance.Name, instance.Labels),
+	}
+	if s.SubnetID != "" {
+		input.SubnetId = aws.String(s.SubnetID)
+	}
+	if instance.Scheduling != nil && (instance.Scheduling.Preemptible || instance.Scheduling.ProvisioningModel == "SPOT") {
+		input.InstanceMarketOptions = &ec2.InstanceMarketOptionsRequest{
+			MarketType: aws.String(ec2.MarketTypeSpot),
+			SpotOptions: &ec2.SpotMarketOptions{
+				// persistent spot instances can be stopped and started like the preemptible ones, the request is cancelled on deletion
+				SpotInstanceType:             aws.String(ec2.SpotInstanceTypePersistent),
+				InstanceInterruptionBehavior: aws.String(ec2.InstanceInterruptionBehaviorStop),
+			},
+		}
+	}
+
+	var reservation *ec2.Reservation
+	for i := 0; i < times; i++ {
+		if reservation, err = s.client(projectID).RunInstances(input); err == nil {
+			break
+		} else if ClassifyError(err).Fallback() {
+			return err
+		}
+		time.Sleep(1 * time.Second)
+	}
+	if err != nil {
+		return err
+	}
+
+	created := reservation.Instances[0]
+	id := created.InstanceId
+
+	// the instance without the data volume is terminated, so that the retries create it again
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+	if err = s.client(projectID).WaitUntilInstanceRunningWithContext(ctx, &ec2.DescribeInstancesInput{InstanceIds: []*string{id}}); err != nil {
+		s.abort(projectID, created)
+		return err
+	}
+
+	disk := instance.Disks[0]
+	if _, err = s.client(projectID).AttachVolume(&ec2.AttachVolumeInput{
+		Device:     aws.String(ec2DataDevice),
+		InstanceId: id,
+		VolumeId:   aws.String(disk.Source),
+	}); err != nil {
+		s.abort(projectID, created)
+		return err
+	}
+
+	_, err = s.client(projectID).ModifyInstanceAttribute(&ec2.ModifyInstanceAttributeInput{
+		InstanceId: id,
+		BlockDeviceMappings: []*ec2.InstanceBlockDeviceMappingSpecification{
+			{
+				DeviceName: aws.String(ec2DataDevice),
+				Ebs:        &ec2.EbsInstanceBlockDeviceSpecification{DeleteOnTermination: aws.Bool(disk.AutoDelete)},
+			},
+		},
+	})
+	return err
+}
+
+// abort terminates the instance failed to be created.
+func (s *EC2Service) abort(projectID string, instance *ec2.Instance) {
+	if err := terminate(s.client(projectID), instance); err != nil {
+		log.Printf("fail to terminate the incomplete instance %s: %s\n", aws.StringValue(instance.InstanceId), err.Error())
+	}
+}
+
+func (s *EC2Service) StartInstanceRetry(projectID, zoneID, instanceID string, times int) error {
+	return s.instanceRetry(projectID, zoneID, instanceID, times, func(c *ec2.EC2, instance *ec2.Instance) (err error) {
+		_, err = c.StartInstances(&ec2.StartInstancesInput{InstanceIds: []*string{instance.InstanceId}})
+		return
+	})
+}
+
+func (s *EC2Service) TerminateInstanceRetry(projectID, zoneID, instanceID string, times int) error {
+	return s.instanceRetry(projectID, zoneID, instanceID, times, func(c *ec2.EC2, instance *ec2.Instance) (err error) {
+		_, err = c.StopInstances(&ec2.StopInstancesInput{InstanceIds: []*string{instance.InstanceId}})
+		return
+	})
+}
+
+func (s *EC2Service) DeleteInstanceRetry(projectID, zoneID, instanceID string, times int) error {
+	return s.instanceRetry(projectID, zoneID, instanceID, times, terminate)
+}
+
+// terminate cancels the persistent spot request of the instance before terminating it,
+// otherwise the request launches another instance after the termination.
+func terminate(c *ec2.EC2, instance *ec2.Instance) (err error) {
+	if instance.SpotInstanceRequestId != nil {
+		if _, err = c.CancelSpotInstanceRequests(&ec2.CancelSpotInstanceRequestsInput{
+			SpotInstanceRequestIds: []*string{instance.SpotInstanceRequestId},
+		}); err != nil {
+			return
+		}
+	}
+	_, err = c.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: []*string{instance.InstanceId}})
+	return
+}
+
+func (s *EC2Service) Addr(instance *compute.Instance, port string) string {
+	return instance.NetworkInterfaces[0].NetworkIP + ":" + port
+}
+
+func (s *EC2Service) Poke(instance *compute.Instance, port string, times int) (bool, error) {
+	var err error
+	var conn net.Conn
+	for i := 0; i < times; i++ {
+		time.Sleep(time.Second)
+		if conn, err = net.DialTimeout("tcp", s.Addr(instance, port), 1*time.Second); conn != nil {
+			conn.Close()
+			return true, nil
+		}
+	}
+	return false, err
+}
+
+func (s *EC2Service) GetLoad(addr string) (float64, float64, float64, error) {
+	return GetLoad(addr)
+}
+
+func (s *EC2Service) instanceRetry(projectID, zoneID, instanceID string, times int, fn func(c *ec2.EC2, instance *ec2.Instance) error) (err error) {
+	for i := 0; i < times; i++ {
+		var found *ec2.Instance
+		if found, err = s.findInstance(projectID, zoneID, instanceID); IsStatusNotFound(err) {
+			return nil
+		}
+		if err == nil {
+			if err = fn(s.client(projectID), found); err == nil {
+				return
+			}
+		}
+		time.Sleep(1 * time.Second)
+	}
+	return
+}
+
+func (s *EC2Service) findInstance(projectID, zoneID, instanceID string) (*ec2.Instance, error) {
+	out, err := s.client(projectID).DescribeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:Name"), Values: aws.StringSlice([]string{instanceID})},
+			{Name: aws.String("availability-zone"), Values: aws.StringSlice([]string{zoneID})},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{
+				ec2.InstanceStateNamePending,
+				ec2.InstanceStateNameRunning,
+				ec2.InstanceStateNameStopping,
+				ec2.InstanceStateNameShuttingDown,
+				ec2.InstanceStateNameStopped,
+			})},
+		},
+	})
+	if err != nil {
+		return nil, ec2Err(err)
+	}
+	for _, r := range out.Reservations {
+		for _, i := range r.Instances {
+			return i, nil
+		}
+	}
+	return nil, &googleapi.Error{Code: http.StatusNotFound, Message: fmt.Sprintf("instance %q not found", instanceID)}
+}
+
+func (s *EC2Service) findVolume(projectID, zoneID, diskID string) (*ec2.Volume, error) {
+	out, err := s.client(projectID).DescribeVolumes(&ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:Name"), Values: aws.StringSlice([]string{diskID})},
+			{Name: aws.String("availability-zone"), Values: aws.StringSlice([]string{zoneID})},
+		},
+	})
+	if err != nil {
+		return nil, ec2Err(err)
+	}
+	if len(out.Volumes) == 0 {
+		return nil, &googleapi.Error{Code: http.StatusNotFound, Message: fmt.Sprintf("disk %q not found", diskID)}
+	}
+	return out.Volumes[0], nil
+}
+
+func ec2ToInstance(name string, i *ec2.Instance) *compute.Instance {
+	instance := &compute.Instance{
+		Name:        name,
+		SelfLink:    aws.StringValue(i.InstanceId),
+		Status:      ec2InstanceStatus[aws.StringValue(i.State.Name)],
+		MachineType: aws.StringValue(i.InstanceType),
+		Labels:      make(map[string]string),
+		NetworkInterfaces: []*compute.NetworkInterface{
+			{
+				NetworkIP: aws.StringValue(i.PrivateIpAddress),
+				AccessConfigs: []*compute.AccessConfig{
+					{
+						Type:  "ONE_TO_ONE_NAT",
+						NatIP: aws.StringValue(i.PublicIpAddress),
+					},
+				},
+			},
+		},
+		Scheduling: &compute.Scheduling{
+			Preemptible: aws.StringValue(i.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot,
+		},
+	}
+	for _, t := range i.Tags {
+		instance.Labels[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	for _, b := range i.BlockDeviceMappings {
+		if b.Ebs != nil && aws.StringValue(b.DeviceName) == ec2DataDevice {
+			instance.Disks = append(instance.Disks, &compute.AttachedDisk{
+				Source:     aws.StringValue(b.Ebs.VolumeId),
+				AutoDelete: aws.BoolValue(b.Ebs.DeleteOnTermination),
+			})
+		}
+	}
+	return instance
+}
+
+func ec2TagSpecifications(resourceType, name string, labels map[string]string) []*ec2.TagSpecification {
+	tags := []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(name)}}
+	for k, v := range labels {
+		tags = append(tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return []*ec2.TagSpecification{{ResourceType: aws.String(resourceType), Tags: tags}}
+}
+
+func ec2Tag(tags []*ec2.Tag, key string) string {
+	for _, t := range tags {
+		if aws.StringValue(t.Key) == key {
+			return aws.StringValue(t.Value)
+		}
+	}
+	return ""
+}
+
+func ec2Err(err error) error {
+	if e, ok := err.(awserr.Error); ok && strings.HasSuffix(e.Code(), ".NotFound") {
+		return &googleapi.Error{Code: http.StatusNotFound, Message: e.Message()}
+	}
+	return err
+}
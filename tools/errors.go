@@ -0,0 +1,126 @@
+package tools
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrorClass classifies the errors of the compute apis, so that the callers know whether to retry the same request
+// or to fall back to another zone or machine type.
+type ErrorClass int
+
+const (
+	ErrorOther ErrorClass = iota
+	ErrorTransient
+	ErrorCapacity
+	ErrorQuota
+)
+
+// Fallback reports whether the request should be moved to another zone or machine type.
+func (c ErrorClass) Fallback() bool {
+	return c == ErrorCapacity || c == ErrorQuota
+}
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorTransient:
+		return "transient"
+	case ErrorCapacity:
+		return "capacity"
+	case ErrorQuota:
+		return "quota"
+	}
+	return "other"
+}
+
+// OperationErr is the error of a failed compute operation, the capacity errors of gcp are only reported this way.
+type OperationErr struct {
+	Codes   []string
+	Message string
+}
+
+func (e *OperationErr) Error() string {
+	return "operation failed with " + strings.Join(e.Codes, ",") + ": " + e.Message
+}
+
+// OperationError returns the OperationErr of the failed operation, or nil.
+func OperationError(op *compute.Operation) error {
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+	e := &OperationErr{}
+	var messages []string
+	for _, item := range op.Error.Errors {
+		e.Codes = append(e.Codes, item.Code)
+		messages = append(messages, item.Message)
+	}
+	e.Message = strings.Join(messages, "; ")
+	return e
+}
+
+var errorCodes = map[string]ErrorClass{
+	// gcp
+	"ZONE_RESOURCE_POOL_EXHAUSTED":              ErrorCapacity,
+	"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS": ErrorCapacity,
+	"RESOURCE_POOL_EXHAUSTED":                   ErrorCapacity,
+	"QUOTA_EXCEEDED":                            ErrorQuota,
+	"quotaExceeded":                             ErrorQuota,
+	"rateLimitExceeded":                         ErrorTransient,
+	"userRateLimitExceeded":                     ErrorTransient,
+	"backendError":                              ErrorTransient,
+	// aws
+	"InsufficientInstanceCapacity": ErrorCapacity,
+	"InsufficientVolumeCapacity":   ErrorCapacity,
+	"InstanceLimitExceeded":        ErrorQuota,
+	"VcpuLimitExceeded":            ErrorQuota,
+	"VolumeLimitExceeded":          ErrorQuota,
+	"MaxSpotInstanceCountExceeded": ErrorQuota,
+	"RequestLimitExceeded":         ErrorTransient,
+	"InternalError":                ErrorTransient,
+	"Unavailable":                  ErrorTransient,
+}
+
+// ClassifyError classifies the errors of the gcp and aws apis by their codes.
+func ClassifyError(err error) ErrorClass {
+	switch e := err.(type) {
+	case nil:
+		return ErrorOther
+	case *OperationErr:
+		return classifyCodes(e.Codes, e.Message)
+	case *googleapi.Error:
+		codes := make([]string, 0, len(e.Errors))
+		for _, item := range e.Errors {
+			codes = append(codes, item.Reason)
+		}
+		if c := classifyCodes(codes, e.Message); c != ErrorOther {
+			return c
+		}
+		if e.Code == http.StatusTooManyRequests || e.Code >= http.StatusInternalServerError {
+			return ErrorTransient
+		}
+	case awserr.Error:
+		return classifyCodes([]string{e.Code()}, e.Message())
+	}
+	return ErrorOther
+}
+
+func classifyCodes(codes []string, message string) ErrorClass {
+	class := ErrorOther
+	for _, code := range codes {
+		if c := errorCodes[code]; c > class {
+			class = c
+		}
+	}
+	if class == ErrorOther {
+		for code, c := range errorCodes {
+			if c.Fallback() && strings.Contains(message, code) && c > class {
+				class = c
+			}
+		}
+	}
+	return class
+}
@@ -0,0 +1,40 @@
+package tools
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassifyError(t *testing.T) {
+	op := &compute.Operation{Error: &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Code: "ZONE_RESOURCE_POOL_EXHAUSTED", Message: "no capacity"}}}}
+
+	cases := []struct {
+		Err  error
+		Want ErrorClass
+	}{
+		{nil, ErrorOther},
+		{errors.New("unknown"), ErrorOther},
+		{OperationError(op), ErrorCapacity},
+		{&OperationErr{Codes: []string{"QUOTA_EXCEEDED"}}, ErrorQuota},
+		{&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}, ErrorQuota},
+		{&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, ErrorTransient},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable, Message: "The zone does not have enough resources: ZONE_RESOURCE_POOL_EXHAUSTED"}, ErrorCapacity},
+		{&googleapi.Error{Code: http.StatusInternalServerError}, ErrorTransient},
+		{&googleapi.Error{Code: http.StatusNotFound}, ErrorOther},
+		{awserr.New("InsufficientInstanceCapacity", "no capacity", nil), ErrorCapacity},
+		{awserr.New("VcpuLimitExceeded", "limit", nil), ErrorQuota},
+	}
+	for _, c := range cases {
+		if got := ClassifyError(c.Err); got != c.Want {
+			t.Fatalf("expect %v classified as %v, got %v", c.Err, c.Want, got)
+		}
+	}
+	if OperationError(&compute.Operation{}) != nil {
+		t.Fatal("expect no error of the succeeded operation")
+	}
+}
@@ -0,0 +1,399 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// FakeComputeService is an in-memory replacement of the ComputeService for exercising the controller offline.
+// Transitional disk and instance statuses only move forward when Step is called.
+func NewFakeComputeService() *FakeComputeService {
+	return &FakeComputeService{
+		snapshots: make(map[string]*compute.Snapshot),
+		disks:     make(map[string]*compute.Disk),
+		instances: make(map[string]*compute.Instance),
+		ops:       make(map[string]*compute.Operation),
+		errs:      make(map[string][]error),
+		loads:     make(map[string][3]float64),
+		closed:    make(map[string]bool),
+	}
+}
+
+type FakeComputeService struct {
+	Latency time.Duration
+
+	mu        sync.Mutex
+	snapshots map[string]*compute.Snapshot
+	disks     map[string]*compute.Disk
+	instances map[string]*compute.Instance
+	ops       map[string]*compute.Operation
+	errs      map[string][]error
+	loads     map[string][3]float64
+	closed    map[string]bool
+	ips       int
+}
+
+var nextStatus = map[string]string{
+	"CREATING":     "READY",
+	"RESTORING":    "READY",
+	"PROVISIONING": "STAGING",
+	"STAGING":      "RUNNING",
+	"STOPPING":     "TERMINATED",
+}
+
+func NotFoundErr(kind, name string) error {
+	return &googleapi.Error{Code: http.StatusNotFound, Message: fmt.Sprintf("%s %q not found", kind, name)}
+}
+
+func (s *FakeComputeService) InjectError(method string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs[method] = append(s.errs[method], err)
+}
+
+func (s *FakeComputeService) AddSnapshot(projectID, name, status string, createdAt time.Time) *compute.Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := &compute.Snapshot{
+		Name:              name,
+		Status:            status,
+		SelfLink:          "projects/" + projectID + "/global/snapshots/" + name,
+		CreationTimestamp: createdAt.Format(time.RFC3339),
+	}
+	s.snapshots[projectID+"/"+name] = snapshot
+	return snapshot
+}
+
+func (s *FakeComputeService) Disk(projectID, zoneID, diskID string) *compute.Disk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.disks[key(projectID, zoneID, diskID)]
+}
+
+func (s *FakeComputeService) Instance(projectID, zoneID, instanceID string) *compute.Instance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.instances[key(projectID, zoneID, instanceID)]
+}
+
+func (s *FakeComputeService) SetDiskStatus(projectID, zoneID, diskID, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.disks[key(projectID, zoneID, diskID)]; ok {
+		d.Status = status
+	}
+}
+
+func (s *FakeComputeService) SetInstanceStatus(projectID, zoneID, instanceID, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i, ok := s.instances[key(projectID, zoneID, instanceID)]; ok {
+		i.Status = status
+	}
+}
+
+// SetPortClosed makes Poke fail on the port of the instance.
+func (s *FakeComputeService) SetPortClosed(instanceID, port string, closed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed[instanceID+":"+port] = closed
+}
+
+func (s *FakeComputeService) SetLoad(addr string, m1, m5, m15 float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loads[addr] = [3]float64{m1, m5, m15}
+}
+
+// Step moves every transitional status forward by one.
+func (s *FakeComputeService) Step() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.disks {
+		if next, ok := nextStatus[d.Status]; ok {
+			d.Status = next
+		}
+	}
+	for _, i := range s.instances {
+		if next, ok := nextStatus[i.Status]; ok {
+			i.Status = next
+		}
+	}
+	for _, op := range s.ops {
+		op.Status = "DONE"
+	}
+}
+
+func (s *FakeComputeService) FindLatestSnapshot(projectID, prefix string) (*compute.Snapshot, error) {
+	if err := s.call("FindLatestSnapshot"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var latest *compute.Snapshot
+	for k, snapshot := range s.snapshots {
+		if !strings.HasPrefix(k, projectID+"/"+prefix) || snapshot.Status != "READY" {
+			continue
+		}
+		if latest == nil || snapshot.CreationTimestamp > latest.CreationTimestamp {
+			latest = snapshot
+		}
+	}
+	return latest, nil
+}
+
+func (s *FakeComputeService) FindInstanceRetry(projectID, zoneID, instanceID string, times int) (*compute.Instance, error) {
+	if err := s.call("FindInstance"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i, ok := s.instances[key(projectID, zoneID, instanceID)]; ok {
+		copied := *i
+		return &copied, nil
+	}
+	return nil, NotFoundErr("instance", instanceID)
+}
+
+func (s *FakeComputeService) CreateInstanceRetry(projectID, zoneID string, instance *compute.Instance, times int) error {
+	if err := s.call("CreateInstance"); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := key(projectID, zoneID, instance.Name)
+	if _, ok := s.instances[k]; ok {
+		return &googleapi.Error{Code: http.StatusConflict, Message: fmt.Sprintf("instance %q already exists", instance.Name)}
+	}
+
+	created := *instance
+	created.Status = "PROVISIONING"
+	created.SelfLink = "projects/" + projectID + "/zones/" + zoneID + "/instances/" + instance.Name
+
+	s.ips++
+	created.NetworkInterfaces = nil
+	for _, n := range instance.NetworkInterfaces {
+		copied := *n
+		copied.NetworkIP = "10.0.0." + strconv.Itoa(s.ips)
+		created.NetworkInterfaces = append(created.NetworkInterfaces, &copied)
+	}
+
+	for _, attached := range instance.Disks {
+		for _, d := range s.disks {
+			if d.SelfLink == attached.Source {
+				d.Users = append(d.Users, created.SelfLink)
+			}
+		}
+	}
+
+	s.instances[k] = &created
+	return nil
+}
+
+// InsertInstanceRetry creates the instance with a running operation, the errors injected to "InstanceOperation"
+// fail the operation instead of creating the instance.
+func (s *FakeComputeService) InsertInstanceRetry(projectID, zoneID string, instance *compute.Instance, times int) (string, error) {
+	failed := s.call("InstanceOperation")
+	if failed == nil {
+		if err := s.CreateInstanceRetry(projectID, zoneID, instance, times); err != nil {
+			return "", err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op := &compute.Operation{Name: "operation-" + strconv.Itoa(len(s.ops)+1), Status: "RUNNING"}
+	if e, ok := failed.(*OperationErr); ok {
+		op.Error = &compute.OperationError{}
+		for _, code := range e.Codes {
+			op.Error.Errors = append(op.Error.Errors, &compute.OperationErrorErrors{Code: code, Message: e.Message})
+		}
+	} else if failed != nil {
+		op.Error = &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Message: failed.Error()}}}
+	}
+	s.ops[key(projectID, zoneID, op.Name)] = op
+	return op.Name, nil
+}
+
+func (s *FakeComputeService) FindOperation(projectID, zoneID, name string) (*compute.Operation, error) {
+	if err := s.call("FindOperation"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op, ok := s.ops[key(projectID, zoneID, name)]
+	if !ok {
+		return nil, NotFoundErr("operation", name)
+	}
+	copied := *op
+	return &copied, nil
+}
+
+func (s *FakeComputeService) StartInstanceRetry(projectID, zoneID, instanceID string, times int) error {
+	return s.setStatus("StartInstance", projectID, zoneID, instanceID, "TERMINATED", "STAGING")
+}
+
+func (s *FakeComputeService) TerminateInstanceRetry(projectID, zoneID, instanceID string, times int) error {
+	return s.setStatus("TerminateInstance", projectID, zoneID, instanceID, "RUNNING", "STOPPING")
+}
+
+func (s *FakeComputeService) DeleteInstanceRetry(projectID, zoneID, instanceID string, times int) error {
+	if err := s.call("DeleteInstance"); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := key(projectID, zoneID, instanceID)
+	instance, ok := s.instances[k]
+	if !ok {
+		return nil
+	}
+	delete(s.instances, k)
+
+	for _, attached := range instance.Disks {
+		for dk, d := range s.disks {
+			if d.SelfLink != attached.Source {
+				continue
+			}
+			if attached.AutoDelete {
+				delete(s.disks, dk)
+			} else {
+				d.Users = nil
+			}
+		}
+	}
+	return nil
+}
+
+func (s *FakeComputeService) FindDisk(projectID, zoneID, diskID string) (*compute.Disk, error) {
+	if err := s.call("FindDisk"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d, ok := s.disks[key(projectID, zoneID, diskID)]; ok {
+		copied := *d
+		return &copied, nil
+	}
+	return nil, NotFoundErr("disk", diskID)
+}
+
+func (s *FakeComputeService) FindDiskRetry(projectID, zoneID, diskID string, times int) (*compute.Disk, error) {
+	return s.FindDisk(projectID, zoneID, diskID)
+}
+
+func (s *FakeComputeService) CreateDiskRetry(projectID, zoneID string, disk *compute.Disk, times int) error {
+	if err := s.call("CreateDisk"); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := key(projectID, zoneID, disk.Name)
+	if _, ok := s.disks[k]; ok {
+		return &googleapi.Error{Code: http.StatusConflict, Message: fmt.Sprintf("disk %q already exists", disk.Name)}
+	}
+
+	created := *disk
+	created.Status = "CREATING"
+	if disk.SourceSnapshot != "" {
+		created.Status = "RESTORING"
+	}
+	created.SelfLink = "projects/" + projectID + "/zones/" + zoneID + "/disks/" + disk.Name
+
+	s.disks[k] = &created
+	return nil
+}
+
+func (s *FakeComputeService) DeleteDiskRetry(projectID, zoneID, diskID string, times int) error {
+	if err := s.call("DeleteDisk"); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.disks, key(projectID, zoneID, diskID))
+	return nil
+}
+
+func (s *FakeComputeService) Addr(instance *compute.Instance, port string) string {
+	return instance.NetworkInterfaces[0].NetworkIP + ":" + port
+}
+
+func (s *FakeComputeService) Poke(instance *compute.Instance, port string, times int) (bool, error) {
+	if err := s.call("Poke"); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(instance.NetworkInterfaces) == 0 {
+		return false, errors.New("no network interface")
+	}
+	if s.closed[instance.Name+":"+port] {
+		return false, fmt.Errorf("connection refused on port %s", port)
+	}
+	return true, nil
+}
+
+func (s *FakeComputeService) GetLoad(addr string) (float64, float64, float64, error) {
+	if err := s.call("GetLoad"); err != nil {
+		return 0, 0, 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l, ok := s.loads[addr]; ok {
+		return l[0], l[1], l[2], nil
+	}
+	return 0, 0, 0, nil
+}
+
+func (s *FakeComputeService) setStatus(method, projectID, zoneID, instanceID, from, to string) error {
+	if err := s.call(method); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.instances[key(projectID, zoneID, instanceID)]
+	if !ok {
+		return nil
+	}
+	if i.Status != from {
+		return &googleapi.Error{Code: http.StatusBadRequest, Message: fmt.Sprintf("instance %q is %s", instanceID, i.Status)}
+	}
+	i.Status = to
+	return nil
+}
+
+func (s *FakeComputeService) call(method string) (err error) {
+	if s.Latency > 0 {
+		time.Sleep(s.Latency)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if errs := s.errs[method]; len(errs) > 0 {
+		err, s.errs[method] = errs[0], errs[1:]
+	}
+	return
+}
+
+func key(projectID, zoneID, name string) string {
+	return projectID + "/" + zoneID + "/" + name
+}
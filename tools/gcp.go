@@ -12,16 +12,18 @@ import (
 
 func NewComputeService(service *compute.Service) *ComputeService {
 	return &ComputeService{
-		DisksService:     compute.NewDisksService(service),
-		SnapshotsService: compute.NewSnapshotsService(service),
-		InstancesService: compute.NewInstancesService(service),
+		DisksService:          compute.NewDisksService(service),
+		SnapshotsService:      compute.NewSnapshotsService(service),
+		InstancesService:      compute.NewInstancesService(service),
+		ZoneOperationsService: compute.NewZoneOperationsService(service),
 	}
 }
 
 type ComputeService struct {
-	DisksService     *compute.DisksService
-	SnapshotsService *compute.SnapshotsService
-	InstancesService *compute.InstancesService
+	DisksService          *compute.DisksService
+	SnapshotsService      *compute.SnapshotsService
+	InstancesService      *compute.InstancesService
+	ZoneOperationsService *compute.ZoneOperationsService
 }
 
 func (s *ComputeService) FindLatestSnapshot(projectID, prefix string) (*compute.Snapshot, error) {
@@ -60,16 +62,27 @@ func (s *ComputeService) CreateDiskRetry(projectID, zoneID string, disk *compute
 	for i := 0; i < times; i++ {
 		if _, err = s.DisksService.Insert(projectID, zoneID, disk).RequestId(id).Do(); err == nil {
 			return
+		} else if ClassifyError(err).Fallback() {
+			return
 		}
 		time.Sleep(1 * time.Second)
 	}
 	return
 }
 
-func (s *ComputeService) CreateInstanceRetry(projectID, zoneID string, instance *compute.Instance, times int) (err error) {
+func (s *ComputeService) CreateInstanceRetry(projectID, zoneID string, instance *compute.Instance, times int) error {
+	_, err := s.InsertInstanceRetry(projectID, zoneID, instance, times)
+	return err
+}
+
+// InsertInstanceRetry inserts the instance without waiting for it, the capacity errors of the zone are only reported by the returned operation.
+func (s *ComputeService) InsertInstanceRetry(projectID, zoneID string, instance *compute.Instance, times int) (name string, err error) {
 	id := uuid.NewV4().String()
 	for i := 0; i < times; i++ {
-		if _, err = s.InstancesService.Insert(projectID, zoneID, instance).RequestId(id).Do(); err == nil {
+		var op *compute.Operation
+		if op, err = s.InstancesService.Insert(projectID, zoneID, instance).RequestId(id).Do(); err == nil {
+			return op.Name, nil
+		} else if ClassifyError(err).Fallback() {
 			return
 		}
 		time.Sleep(1 * time.Second)
@@ -77,6 +90,10 @@ func (s *ComputeService) CreateInstanceRetry(projectID, zoneID string, instance
 	return
 }
 
+func (s *ComputeService) FindOperation(projectID, zoneID, name string) (*compute.Operation, error) {
+	return s.ZoneOperationsService.Get(projectID, zoneID, name).Do()
+}
+
 func (s *ComputeService) DeleteInstanceRetry(projectID, zoneID, instanceID string, times int) (err error) {
 	id := uuid.NewV4().String()
 	for i := 0; i < times; i++ {
@@ -152,3 +169,15 @@ func IsStatusNotFound(err error) bool {
 	}
 	return false
 }
+
+func (s *ComputeService) Addr(instance *compute.Instance, port string) string {
+	return instance.NetworkInterfaces[0].NetworkIP + ":" + port
+}
+
+func (s *ComputeService) Poke(instance *compute.Instance, port string, times int) (bool, error) {
+	return Poke(instance, port, times)
+}
+
+func (s *ComputeService) GetLoad(addr string) (float64, float64, float64, error) {
+	return GetLoad(addr)
+}
@@ -0,0 +1,398 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// LocalService runs postgres processes on the local machine by pg_ctl.
+// A snapshot is a postgres data directory under the SnapshotDir, and a disk is a copy of it under the Root.
+func NewLocalService(root, snapshotDir, pgCtl string) *LocalService {
+	return &LocalService{
+		Root:        root,
+		SnapshotDir: snapshotDir,
+		PgCtl:       pgCtl,
+	}
+}
+
+type LocalService struct {
+	Root        string
+	SnapshotDir string
+	PgCtl       string
+
+	mu sync.Mutex
+}
+
+type localDisk struct {
+	SourceSnapshot string
+	Status         string
+	Labels         map[string]string
+}
+
+type localInstance struct {
+	Disk    string
+	Port    int
+	Status  string
+	Labels  map[string]string
+	Machine string
+}
+
+func (s *LocalService) FindLatestSnapshot(projectID, prefix string) (*compute.Snapshot, error) {
+	entries, err := ioutil.ReadDir(s.SnapshotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []os.FileInfo
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), prefix) {
+			found = append(found, e)
+		}
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].ModTime().After(found[j].ModTime()) })
+
+	path, err := filepath.Abs(filepath.Join(s.SnapshotDir, found[0].Name()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &compute.Snapshot{
+		Name:              found[0].Name(),
+		SelfLink:          path,
+		Status:            "READY",
+		CreationTimestamp: found[0].ModTime().Format(time.RFC3339),
+	}, nil
+}
+
+func (s *LocalService) FindDisk(projectID, zoneID, diskID string) (*compute.Disk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var d localDisk
+	if err := readJSON(s.diskPath(diskID, "disk.json"), &d); err != nil {
+		return nil, notFoundOr(err, "disk", diskID)
+	}
+
+	disk := &compute.Disk{
+		Name:           diskID,
+		SelfLink:       s.diskPath(diskID),
+		SourceSnapshot: d.SourceSnapshot,
+		Status:         d.Status,
+		Labels:         d.Labels,
+	}
+
+	entries, _ := ioutil.ReadDir(s.instancePath())
+	for _, e := range entries {
+		var i localInstance
+		if err := readJSON(s.instancePath(e.Name()), &i); err == nil && i.Disk == disk.SelfLink {
+			disk.Users = append(disk.Users, s.instancePath(e.Name()))
+		}
+	}
+
+	return disk, nil
+}
+
+func (s *LocalService) FindDiskRetry(projectID, zoneID, diskID string, times int) (*compute.Disk, error) {
+	return s.FindDisk(projectID, zoneID, diskID)
+}
+
+func (s *LocalService) CreateDiskRetry(projectID, zoneID string, disk *compute.Disk, times int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := s.diskPath(disk.Name)
+	if _, err := os.Stat(dir); err == nil {
+		return &googleapi.Error{Code: http.StatusConflict, Message: fmt.Sprintf("disk %q already exists", disk.Name)}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	d := localDisk{SourceSnapshot: disk.SourceSnapshot, Status: "RESTORING", Labels: disk.Labels}
+	if err := writeJSON(s.diskPath(disk.Name, "disk.json"), d); err != nil {
+		return err
+	}
+
+	// restore the data directory in background like the gcp does
+	go func() {
+		err := copyDir(disk.SourceSnapshot, s.diskPath(disk.Name, "data"))
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if d.Status = "READY"; err != nil {
+			d.Status = "FAILED"
+		}
+		writeJSON(s.diskPath(disk.Name, "disk.json"), d)
+	}()
+
+	return nil
+}
+
+func (s *LocalService) DeleteDiskRetry(projectID, zoneID, diskID string, times int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return os.RemoveAll(s.diskPath(diskID))
+}
+
+func (s *LocalService) FindInstanceRetry(projectID, zoneID, instanceID string, times int) (*compute.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var i localInstance
+	if err := readJSON(s.instancePath(instanceID), &i); err != nil {
+		return nil, notFoundOr(err, "instance", instanceID)
+	}
+
+	running := s.pgCtl(i.Disk, "status") == nil
+	status := i.Status
+	switch {
+	case running && i.Status == "RUNNING":
+	case running:
+		status = "STOPPING"
+	case i.Status == "RUNNING":
+		status = "STAGING"
+	}
+
+	return &compute.Instance{
+		Name:        instanceID,
+		SelfLink:    s.instancePath(instanceID),
+		Status:      status,
+		Labels:      i.Labels,
+		MachineType: i.Machine,
+		NetworkInterfaces: []*compute.NetworkInterface{
+			{
+				NetworkIP: "127.0.0.1",
+			},
+		},
+		Disks: []*compute.AttachedDisk{
+			{
+				Boot:       true,
+				AutoDelete: true,
+				Source:     i.Disk,
+			},
+		},
+	}, nil
+}
+
+func (s *LocalService) CreateInstanceRetry(projectID, zoneID string, instance *compute.Instance, times int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(s.instancePath(instance.Name)); err == nil {
+		return &googleapi.Error{Code: http.StatusConflict, Message: fmt.Sprintf("instance %q already exists", instance.Name)}
+	}
+	if len(instance.Disks) == 0 {
+		return fmt.Errorf("instance %q has no disk", instance.Name)
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+
+	i := localInstance{
+		Disk:    instance.Disks[0].Source,
+		Port:    port,
+		Status:  "RUNNING",
+		Labels:  instance.Labels,
+		Machine: instance.MachineType,
+	}
+	if err = os.MkdirAll(s.instancePath(), 0700); err != nil {
+		return err
+	}
+	if err = writeJSON(s.instancePath(instance.Name), i); err != nil {
+		return err
+	}
+
+	return s.start(i)
+}
+
+func (s *LocalService) StartInstanceRetry(projectID, zoneID, instanceID string, times int) error {
+	return s.setStatus(instanceID, "RUNNING")
+}
+
+func (s *LocalService) TerminateInstanceRetry(projectID, zoneID, instanceID string, times int) error {
+	return s.setStatus(instanceID, "TERMINATED")
+}
+
+func (s *LocalService) DeleteInstanceRetry(projectID, zoneID, instanceID string, times int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var i localInstance
+	if err := readJSON(s.instancePath(instanceID), &i); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	s.pgCtl(i.Disk, "stop", "-m", "immediate")
+
+	if err := os.Remove(s.instancePath(instanceID)); err != nil {
+		return err
+	}
+	return os.RemoveAll(i.Disk)
+}
+
+func (s *LocalService) Addr(instance *compute.Instance, port string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// every port of a local instance is served by the postgres itself
+	var i localInstance
+	readJSON(s.instancePath(instance.Name), &i)
+	return "127.0.0.1:" + strconv.Itoa(i.Port)
+}
+
+func (s *LocalService) Poke(instance *compute.Instance, port string, times int) (bool, error) {
+	var err error
+	var conn net.Conn
+	for i := 0; i < times; i++ {
+		if conn, err = net.DialTimeout("tcp", s.Addr(instance, port), 1*time.Second); conn != nil {
+			conn.Close()
+			return true, nil
+		}
+		time.Sleep(time.Second)
+	}
+	return false, err
+}
+
+func (s *LocalService) GetLoad(addr string) (float64, float64, float64, error) {
+	output, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		// the loadavg is not available on every platform, treat it as idle.
+		return 0, 0, 0, nil
+	}
+	return parseLoad(output)
+}
+
+func (s *LocalService) setStatus(instanceID, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var i localInstance
+	if err := readJSON(s.instancePath(instanceID), &i); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	i.Status = status
+	if err := writeJSON(s.instancePath(instanceID), i); err != nil {
+		return err
+	}
+
+	if status == "RUNNING" {
+		return s.start(i)
+	}
+	go s.pgCtl(i.Disk, "stop", "-m", "fast")
+	return nil
+}
+
+func (s *LocalService) start(i localInstance) error {
+	opts := fmt.Sprintf("-p %d -c listen_addresses=127.0.0.1 -k '%s'", i.Port, filepath.Join(i.Disk, "data"))
+	return s.pgCtl(i.Disk, "start", "-W", "-l", filepath.Join(i.Disk, "postgres.log"), "-o", opts)
+}
+
+func (s *LocalService) pgCtl(disk string, args ...string) error {
+	return exec.Command(s.PgCtl, append([]string{"-D", filepath.Join(disk, "data")}, args...)...).Run()
+}
+
+func (s *LocalService) diskPath(elem ...string) string {
+	return filepath.Join(append([]string{s.Root, "disks"}, elem...)...)
+}
+
+func (s *LocalService) instancePath(elem ...string) string {
+	return filepath.Join(append([]string{s.Root, "instances"}, elem...)...)
+}
+
+func notFoundOr(err error, kind, name string) error {
+	if os.IsNotExist(err) {
+		return &googleapi.Error{Code: http.StatusNotFound, Message: fmt.Sprintf("%s %q not found", kind, name)}
+	}
+	return err
+}
+
+func readJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func writeJSON(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() || info.Name() == "postmaster.pid" {
+			return nil
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
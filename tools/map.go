@@ -1,5 +1,7 @@
 package tools
 
+import "fmt"
+
 func GetInt(m map[string]interface{}, k string, fallback int) int {
 	if v, ok := m[k]; ok {
 		if v, ok := v.(float64); ok {
@@ -9,6 +11,29 @@ func GetInt(m map[string]interface{}, k string, fallback int) int {
 	return fallback
 }
 
+func GetFloat(m map[string]interface{}, k string, fallback float64) float64 {
+	if v, ok := m[k]; ok {
+		if v, ok := v.(float64); ok {
+			return v
+		}
+	}
+	return fallback
+}
+
+func GetFloats(m map[string]interface{}, k string) map[string]float64 {
+	floats := make(map[string]float64)
+	if v, ok := m[k]; ok {
+		if v, ok := v.(map[string]interface{}); ok {
+			for name, item := range v {
+				if item, ok := item.(float64); ok {
+					floats[name] = item
+				}
+			}
+		}
+	}
+	return floats
+}
+
 func GetStr(m map[string]interface{}, k string, fallback string) string {
 	if v, ok := m[k]; ok {
 		if v, ok := v.(string); ok {
@@ -17,3 +42,78 @@ func GetStr(m map[string]interface{}, k string, fallback string) string {
 	}
 	return fallback
 }
+
+func GetBool(m map[string]interface{}, k string, fallback bool) bool {
+	if v, ok := m[k]; ok {
+		if v, ok := v.(bool); ok {
+			return v
+		}
+	}
+	return fallback
+}
+
+func GetStrs(m map[string]interface{}, k string) (strs []string) {
+	if v, ok := m[k]; ok {
+		if v, ok := v.([]interface{}); ok {
+			for _, item := range v {
+				if item, ok := item.(string); ok {
+					strs = append(strs, item)
+				}
+			}
+		}
+	}
+	return
+}
+
+func GetStrMap(m map[string]interface{}, k string) map[string]string {
+	strs := make(map[string]string)
+	if v, ok := m[k]; ok {
+		if v, ok := v.(map[string]interface{}); ok {
+			for name, item := range v {
+				if item, ok := item.(string); ok {
+					strs[name] = item
+				}
+			}
+		}
+	}
+	return strs
+}
+
+func GetMaps(m map[string]interface{}, k string) (maps []map[string]interface{}) {
+	if v, ok := m[k]; ok {
+		if v, ok := v.([]interface{}); ok {
+			for _, item := range v {
+				if item, ok := item.(map[string]interface{}); ok {
+					maps = append(maps, item)
+				}
+			}
+		}
+	}
+	return
+}
+
+// Normalize converts the map[interface{}]interface{} decoded by yaml into map[string]interface{} recursively,
+// otherwise the params can't be encoded into json for the plugins.
+func Normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = Normalize(item)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = Normalize(item)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			l[i] = Normalize(item)
+		}
+		return l
+	}
+	return v
+}
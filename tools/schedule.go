@@ -0,0 +1,124 @@
+package tools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a weekly time window like "Mon-Fri 09:00-18:00", "Sat,Sun 10:00-14:00" or "* 22:00-06:00".
+// The Days of an overnight window are the days it starts, so "Fri 22:00-06:00" ends on Saturday morning.
+type Window struct {
+	Days  [7]bool
+	Start int
+	End   int
+}
+
+func ParseWindow(s string) (w Window, err error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return w, fmt.Errorf("malformed window %q, expect \"<days> <hh:mm>-<hh:mm>\"", s)
+	}
+
+	if fields[0] == "*" {
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	} else {
+		for _, part := range strings.Split(fields[0], ",") {
+			days := strings.SplitN(strings.ToLower(part), "-", 2)
+			from, ok := weekdays[days[0]]
+			if !ok {
+				return w, fmt.Errorf("malformed weekday %q in window %q", days[0], s)
+			}
+			to := from
+			if len(days) == 2 {
+				if to, ok = weekdays[days[1]]; !ok {
+					return w, fmt.Errorf("malformed weekday %q in window %q", days[1], s)
+				}
+			}
+			for d := from; ; d = (d + 1) % 7 {
+				w.Days[d] = true
+				if d == to {
+					break
+				}
+			}
+		}
+	}
+
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return w, fmt.Errorf("malformed time range %q in window %q", fields[1], s)
+	}
+	if w.Start, err = parseClock(times[0]); err != nil {
+		return w, err
+	}
+	if w.End, err = parseClock(times[1]); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+// Contains reports whether the t is in the window. A window ends before it starts continues to the next day.
+func (w Window) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.Start <= w.End {
+		return w.Days[t.Weekday()] && minute >= w.Start && minute < w.End
+	}
+	if minute >= w.Start {
+		return w.Days[t.Weekday()]
+	}
+	return minute < w.End && w.Days[(t.Weekday()+6)%7]
+}
+
+// InSchedule reports whether the t is in any of the windows separated by ";" in the time zone.
+// An empty schedule contains all the time.
+func InSchedule(schedule, timezone string, t time.Time) (bool, error) {
+	if strings.TrimSpace(schedule) == "" {
+		return true, nil
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return false, err
+	}
+	t = t.In(loc)
+
+	for _, s := range strings.Split(schedule, ";") {
+		w, err := ParseWindow(s)
+		if err != nil {
+			return false, err
+		}
+		if w.Contains(t) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func parseClock(s string) (int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("malformed clock %q, expect hh:mm", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("malformed hour in clock %q", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("malformed minute in clock %q", s)
+	}
+	return h*60 + m, nil
+}
@@ -0,0 +1,52 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInSchedule(t *testing.T) {
+	// 2019-07-01 is a Monday
+	at := func(day int, clock string) time.Time {
+		ts, _ := time.Parse("2006-01-02 15:04", "2019-07-0"+string(rune('0'+day))+" "+clock)
+		return ts
+	}
+
+	cases := []struct {
+		Schedule string
+		At       time.Time
+		Want     bool
+	}{
+		{Schedule: "", At: at(1, "03:00"), Want: true},
+		{Schedule: "Mon-Fri 09:00-18:00", At: at(1, "09:00"), Want: true},
+		{Schedule: "Mon-Fri 09:00-18:00", At: at(1, "18:00"), Want: false},
+		{Schedule: "Mon-Fri 09:00-18:00", At: at(6, "10:00"), Want: false},
+		{Schedule: "Fri-Mon 09:00-18:00", At: at(7, "10:00"), Want: true},
+		{Schedule: "Sat,Sun 00:00-24:00", At: at(7, "23:59"), Want: true},
+		{Schedule: "Mon-Fri 09:00-18:00; Sat 10:00-12:00", At: at(6, "11:00"), Want: true},
+		{Schedule: "Mon 22:00-06:00", At: at(1, "23:00"), Want: true},
+		{Schedule: "Mon 22:00-06:00", At: at(2, "05:00"), Want: true},
+		{Schedule: "Mon 22:00-06:00", At: at(1, "05:00"), Want: false},
+		{Schedule: "* 08:00-20:00", At: at(3, "12:00"), Want: true},
+		// the overnight windows start on Sunday to cover Monday mornings
+		{Schedule: "Sun-Thu 22:00-07:00; Fri 22:00-24:00; Sat,Sun 00:00-24:00", At: at(1, "05:00"), Want: true},
+		{Schedule: "Sun-Thu 22:00-07:00; Fri 22:00-24:00; Sat,Sun 00:00-24:00", At: at(5, "05:00"), Want: true},
+		{Schedule: "Sun-Thu 22:00-07:00; Fri 22:00-24:00; Sat,Sun 00:00-24:00", At: at(5, "12:00"), Want: false},
+		{Schedule: "Sun-Thu 22:00-07:00; Fri 22:00-24:00; Sat,Sun 00:00-24:00", At: at(1, "07:00"), Want: false},
+		{Schedule: "Mon-Fri 22:00-07:00; Sat,Sun 00:00-24:00", At: at(1, "05:00"), Want: false},
+	}
+	for _, tc := range cases {
+		if got, err := InSchedule(tc.Schedule, "UTC", tc.At); err != nil || got != tc.Want {
+			t.Errorf("InSchedule(%q, %v) = %v %v, want %v", tc.Schedule, tc.At, got, err, tc.Want)
+		}
+	}
+
+	for _, s := range []string{"Mon", "Xyz 09:00-18:00", "Mon 09:00", "Mon 25:00-26:00", "Mon 09:60-10:00"} {
+		if _, err := InSchedule(s, "UTC", time.Now()); err == nil {
+			t.Errorf("expect error on %q", s)
+		}
+	}
+	if _, err := InSchedule("Mon 09:00-18:00", "Nowhere/City", time.Now()); err == nil {
+		t.Errorf("expect error on unknown time zone")
+	}
+}
@@ -62,6 +62,10 @@ func GetLoad(addr string) (float64, float64, float64, error) {
 		return 0, 0, 0, err
 	}
 
+	return parseLoad(output)
+}
+
+func parseLoad(output []byte) (float64, float64, float64, error) {
 	loading := strings.Split(string(output), " ")
 	if len(loading) < 3 {
 		return 0, 0, 0, errors.New("malformed loadavg")